@@ -1,10 +1,37 @@
 package main
 
 import (
+	"os"
+
+	"github.com/spf13/pflag"
+
+	"github.com/sysread/fnord/pkg/fnord"
+	"github.com/sysread/fnord/pkg/headless"
+	"github.com/sysread/fnord/pkg/rpc"
+	"github.com/sysread/fnord/pkg/server"
 	"github.com/sysread/fnord/pkg/ui"
 )
 
 func main() {
-	app := ui.New()
+	f := fnord.NewFnord()
+
+	// Sub-commands that talk to the assistant run without the UI
+	if args := pflag.Args(); len(args) > 0 {
+		var status int
+
+		switch args[0] {
+		case "ask":
+			status = headless.Ask(f, args[1:])
+		case "rpc":
+			status = rpc.Serve(f)
+		case "serve":
+			status = server.Serve(f)
+		}
+
+		f.Close()
+		os.Exit(status)
+	}
+
+	app := ui.New(f)
 	app.Run()
 }
@@ -1,22 +1,38 @@
 package chat_manager
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/sysread/fnord/pkg/debug"
 	"github.com/sysread/fnord/pkg/fnord"
+	"github.com/sysread/fnord/pkg/gpt"
 	"github.com/sysread/fnord/pkg/messages"
 	"github.com/sysread/fnord/pkg/storage"
 )
 
+// MaxStoredToolOutput limits how much of each tool call's output is stored
+// with the conversation.
+const MaxStoredToolOutput = 4096
+
 // ChatManager manages a conversation and provides methods for interacting with
 // the conversation.
 type ChatManager struct {
 	*messages.Conversation
 	fnord    *fnord.Fnord
+	client   gpt.Client
 	threadID string
+
+	// The conversation as stored, including its title and creation time
+	record      *storage.Conversation
+	recordMutex sync.Mutex
+
+	// Cancels the response currently being received, if any
+	mutex  sync.Mutex
+	cancel context.CancelFunc
 }
 
 // NewChatManager creates a new ChatManager instance.
@@ -24,6 +40,8 @@ func NewChatManager(fnord *fnord.Fnord) *ChatManager {
 	cm := &ChatManager{
 		Conversation: messages.NewConversation(),
 		fnord:        fnord,
+		client:       fnord.GptClient,
+		record:       &storage.Conversation{},
 	}
 
 	if fnord.Config.ProjectPath != "" {
@@ -36,83 +54,295 @@ func NewChatManager(fnord *fnord.Fnord) *ChatManager {
 			false,
 		)
 
-		cm.AddMessage(msg)
+		// If this fails, the error will be surfaced when the user sends
+		// their first message.
+		if err := cm.AddMessage(msg); err != nil {
+			debug.Log("Error informing the assistant of the selected project: %v", err)
+		}
 	}
 
 	return cm
 }
 
-// AddMessage adds a message to the conversation and persists the conversation.
-func (cm *ChatManager) AddMessage(msg messages.Message) {
-	cm.Conversation.AddMessage(msg)
+// LoadChatManager creates a ChatManager for a conversation previously stored
+// under threadID. Before new messages are added, ResumeThread must be called
+// to make sure the thread can be continued.
+func LoadChatManager(fnord *fnord.Fnord, threadID string) (*ChatManager, error) {
+	debug.Log("Loading conversation %s", threadID)
 
-	// Create the thread if it doesn't exist yet
-	if cm.threadID == "" {
-		threadID, err := cm.fnord.GptClient.CreateThread()
-		if err != nil {
-			panic(fmt.Sprintf("Error creating thread: %#v", err))
-		}
+	record, err := storage.LoadConversation(threadID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading conversation %s: %w", threadID, err)
+	}
+
+	return &ChatManager{
+		Conversation: &messages.Conversation{Messages: record.Messages},
+		fnord:        fnord,
+		client:       fnord.GptClient,
+		threadID:     threadID,
+		record:       record,
+	}, nil
+}
+
+// ThreadID returns the ID of the conversation's thread, which is empty until
+// the first message is added.
+func (cm *ChatManager) ThreadID() string {
+	return cm.threadID
+}
+
+// ResumeThread prepares the conversation's thread to receive new messages. If
+// the thread no longer exists on the server, an error wrapping
+// gpt.ErrThreadNotFound is returned, and the conversation may still be
+// continued with ContinueLocally.
+func (cm *ChatManager) ResumeThread() error {
+	return cm.client.ResumeThread(cm.threadID, cm.Messages)
+}
+
+// ContinueLocally continues a conversation whose thread no longer exists on
+// the server, using the Chat Completions API with the conversation's stored
+// messages as its history. The conversation is still stored under the
+// original thread ID.
+func (cm *ChatManager) ContinueLocally() error {
+	debug.Log("Continuing conversation %s locally", cm.threadID)
+
+	client, err := gpt.NewChatCompletionsClient(cm.fnord.Config)
+	if err != nil {
+		return err
+	}
+
+	if err := client.ResumeThread(cm.threadID, cm.Messages); err != nil {
+		return err
+	}
+
+	cm.client = client
+
+	return nil
+}
+
+// StartThread creates the conversation's thread, if it does not exist yet.
+// It is called by AddMessage, so it need only be called to learn the thread
+// ID before the first message is added.
+func (cm *ChatManager) StartThread() error {
+	if cm.threadID != "" {
+		return nil
+	}
+
+	threadID, err := cm.client.CreateThread()
+	if err != nil {
+		return fmt.Errorf("error creating thread: %w", err)
+	}
+
+	cm.threadID = threadID
+
+	return nil
+}
 
-		cm.threadID = threadID
+// AddMessage adds a message to the conversation and persists the conversation.
+// If the message cannot be sent to the assistant, it is not added to the
+// conversation and an error is returned.
+func (cm *ChatManager) AddMessage(msg messages.Message) error {
+	if err := cm.StartThread(); err != nil {
+		return err
 	}
 
 	// Add user messages to the thread. Assistant messages are added
 	// automatically during the thread run.
 	if msg.IsUserMessage() {
-		err := cm.fnord.GptClient.AddMessage(cm.threadID, msg.Content)
+		err := cm.client.AddMessage(cm.threadID, msg.Content)
 		if err != nil {
-			panic(fmt.Sprintf("Error adding message to thread: %#v", err))
+			return fmt.Errorf("error adding message to thread: %w", err)
 		}
 	}
 
-	// Store the conversation transcript
-	err := storage.UpdateConversation(cm.threadID, cm.ChatTranscript())
+	cm.Conversation.AddMessage(msg)
+
+	// Store the conversation
+	cm.recordMutex.Lock()
+	defer cm.recordMutex.Unlock()
+
+	cm.record.ID = cm.threadID
+	cm.record.Model = cm.client.Model()
+	cm.record.Messages = cm.Messages
+
+	err := storage.SaveConversation(cm.record)
+	if err != nil {
+		return fmt.Errorf("error updating conversation: %w", err)
+	}
+
+	return nil
+}
+
+// Title returns the conversation's title.
+func (cm *ChatManager) Title() string {
+	cm.recordMutex.Lock()
+	defer cm.recordMutex.Unlock()
+
+	return cm.record.Title
+}
+
+const maxTitleTranscript = 4000
+
+const titlePrompt = `Write a title for the conversation provided by the user, in no more than eight words. Respond with only the title, without quotes or punctuation at the end.`
+
+// generateTitle replaces the conversation's default title, the start of the
+// user's first message, with one written by the assistant. It is called in
+// the background once the assistant has first responded, since the title is
+// not needed right away. Failures are only logged.
+func (cm *ChatManager) generateTitle(transcript string) {
+	// The start of the conversation is enough to title it
+	if len(transcript) > maxTitleTranscript {
+		transcript = transcript[:maxTitleTranscript]
+	}
+
+	title, err := cm.client.GetCompletion(titlePrompt, transcript)
 	if err != nil {
-		panic(fmt.Sprintf("Error updating conversation: %#v", err))
+		debug.Log("Error generating a title for conversation %s: %v", cm.threadID, err)
+		return
+	}
+
+	title = strings.Trim(strings.TrimSpace(title), `"'.`)
+	if title == "" {
+		return
+	}
+
+	cm.recordMutex.Lock()
+	defer cm.recordMutex.Unlock()
+
+	cm.record.Title = title
+
+	if err := storage.SaveConversation(cm.record); err != nil {
+		debug.Log("Error saving the title of conversation %s: %v", cm.threadID, err)
 	}
 }
 
 // RequestResponse sends the user's input to the assistant and processes the
-// response.
-func (cm *ChatManager) RequestResponse(onChunkReceived, onStatusReceived func(string)) {
-	done := make(chan bool)
+// response, passing each event from the response stream to onEvent. If the
+// response is cancelled with CancelResponse, the partial response is added to
+// the conversation, marked as incomplete. If the response fails, whatever
+// was received is added to the conversation along with the error, so that
+// the last message is always the assistant's.
+func (cm *ChatManager) RequestResponse(onEvent func(gpt.Event)) error {
+	done := make(chan error)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm.mutex.Lock()
+	cm.cancel = cancel
+	cm.mutex.Unlock()
+
+	defer func() {
+		cm.mutex.Lock()
+		cm.cancel = nil
+		cm.mutex.Unlock()
+	}()
 
 	// Buffer to collect the streaming response
 	var buf strings.Builder
 
 	// Channel to receive the streaming response
-	responseChan := make(chan string)
+	events := make(chan gpt.Event)
 
 	// Start a goroutine to collect the streaming response and send it to the
 	// caller-supplied callback function.
 	go func() {
+		var runErr error
+		var toolCalls []messages.ToolCall
+
 		// Collect the streaming response
-		for chunk := range responseChan {
-			statusRe := regexp.MustCompile(`STATUS:\s*(.*)`)
-
-			if statusRe.MatchString(chunk) {
-				status := statusRe.FindStringSubmatch(chunk)[1]
-				onStatusReceived(status)
-			} else {
-				// Append the chunk to the buffer
-				buf.WriteString(chunk)
-
-				// Send the chunk to the caller-supplied callback function
-				onChunkReceived(chunk)
+		for event := range events {
+			switch event.Type {
+			case gpt.EventTextDelta:
+				buf.WriteString(event.Text)
+
+			case gpt.EventToolFinished:
+				toolCalls = append(toolCalls, newToolCall(event.Tool))
+				debug.Log("Response event: %s", event)
+
+			case gpt.EventError:
+				runErr = errors.New(event.Error)
+				debug.Log("Response event: %s", event)
+
+			default:
+				debug.Log("Response event: %s", event)
 			}
+
+			onEvent(event)
 		}
 
 		// Finally, add the full response to the conversation. This will
 		// trigger the conversation summary to be updated.
 		msg := messages.NewMessage(messages.Assistant, buf.String(), false)
-		cm.AddMessage(msg)
+		msg.ToolCalls = toolCalls
 
-		done <- true
+		// A cancelled response is not a failed one, even if cancelling it
+		// ended the stream with an error.
+		if ctx.Err() != nil {
+			msg.IsIncomplete = true
+
+			// Make sure the run has stopped on the server before the user
+			// can send another message.
+			if err := cm.client.CancelRun(cm.threadID); err != nil {
+				debug.Log("Error cancelling run: %v", err)
+			}
+		} else if runErr != nil {
+			msg.Error = runErr.Error()
+		}
+
+		err := cm.AddMessage(msg)
+
+		// Title the conversation once the assistant has responded to the
+		// user's first message
+		if err == nil && runErr == nil && cm.countAssistantMessages() == 1 {
+			go cm.generateTitle(cm.ChatTranscript())
+		}
+
+		done <- errors.Join(runErr, err)
 		close(done)
 	}()
 
 	// Start the streaming response producer
-	go cm.fnord.GptClient.RunThread(cm.threadID, responseChan)
+	go cm.client.RunThread(ctx, cm.threadID, events)
+
+	return <-done
+}
+
+func (cm *ChatManager) countAssistantMessages() int {
+	count := 0
+
+	for _, msg := range cm.Messages {
+		if msg.From == messages.Assistant && !msg.IsFailed() {
+			count++
+		}
+	}
+
+	return count
+}
+
+// newToolCall records a finished tool call. Tools may return a great deal
+// of output, such as entire files, so only the start of it is stored.
+func newToolCall(tool *gpt.ToolEvent) messages.ToolCall {
+	output := tool.Output
+	if len(output) > MaxStoredToolOutput {
+		output = output[:MaxStoredToolOutput] + "\n[truncated]"
+	}
 
-	<-done
+	return messages.ToolCall{
+		Name:      tool.Name,
+		Arguments: tool.Arguments,
+		Output:    output,
+		Failed:    tool.Failed,
+	}
+}
+
+// CancelResponse cancels the response currently being received by
+// RequestResponse, if any.
+func (cm *ChatManager) CancelResponse() {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if cm.cancel != nil {
+		debug.Log("Cancelling response")
+		cm.cancel()
+	}
 }
@@ -64,24 +64,19 @@ func ParseMessage(content string) ([]messages.Message, error) {
 
 				// Process each matching file
 				for _, match := range matches {
-					chunks := splitFileIntoDigestibleChunks(match)
-					msgList = append(msgList, messages.NewMessage(from, fmt.Sprintf("Attached file: %s (in %d parts)", match, len(chunks)), false))
-					for idx, part := range chunks {
-						content := fmt.Sprintf("Attached file (%s) part %d:\n\n%s", match, idx, part)
-						msgList = append(msgList, messages.NewMessage(from, content, true))
-					}
+					msgList = append(msgList, attachFile(match)...)
 				}
 
 			case "exec":
 				content := fmt.Sprintf("Executed command: %s", remaining)
-				msgList = append(msgList, messages.NewMessage(from, content, false))
+				msgList = append(msgList, newAttachmentMessage(from, content, false, remaining))
 
 				chunks := splitExecOutputIntoDigestibleChunks(remaining)
 
 				// We want to show the output of the command, so it's not hidden in the UI.
 				for idx, part := range chunks {
 					content := fmt.Sprintf("Attached command output (%s) part %d:\n\n%s", remaining, idx, part)
-					msgList = append(msgList, messages.NewMessage(from, content, false))
+					msgList = append(msgList, newAttachmentMessage(from, content, false, remaining))
 				}
 
 			default:
@@ -109,6 +104,60 @@ func ParseMessage(content string) ([]messages.Message, error) {
 	return msgList, nil
 }
 
+// AttachInput creates the messages attaching input that did not come from a
+// file, such as stdin, under the given name. Like an attached file, the input
+// is split into chunks that fit within the OpenAI token limit.
+func AttachInput(name string, content string) []messages.Message {
+	chunks := util.Chunkify(bufio.NewScanner(strings.NewReader(content)), MaxChunkSize)
+
+	msgList := []messages.Message{
+		newAttachmentMessage(messages.You, fmt.Sprintf("Attached input: %s (in %d parts)", name, len(chunks)), false, name),
+	}
+
+	for idx, part := range chunks {
+		content := fmt.Sprintf("Attached input (%s) part %d:\n\n%s", name, idx, part)
+		msgList = append(msgList, newAttachmentMessage(messages.You, content, true, name))
+	}
+
+	return msgList
+}
+
+// AttachFile creates the messages attaching a file, as the `\f` slash command
+// does, but without expanding wildcards in the path.
+func AttachFile(path string) ([]messages.Message, error) {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return nil, &MessageFileDoesNotExist{FilePath: path}
+	}
+
+	return attachFile(path), nil
+}
+
+// attachFile creates the messages attaching a file that is known to exist.
+// The file is split into chunks that fit within the OpenAI token limit.
+func attachFile(path string) []messages.Message {
+	chunks := splitFileIntoDigestibleChunks(path)
+
+	msgList := []messages.Message{
+		newAttachmentMessage(messages.You, fmt.Sprintf("Attached file: %s (in %d parts)", path, len(chunks)), false, path),
+	}
+
+	for idx, part := range chunks {
+		content := fmt.Sprintf("Attached file (%s) part %d:\n\n%s", path, idx, part)
+		msgList = append(msgList, newAttachmentMessage(messages.You, content, true, path))
+	}
+
+	return msgList
+}
+
+// newAttachmentMessage creates a message that is part of the file or command
+// output attached with a slash command.
+func newAttachmentMessage(from messages.Sender, content string, isHidden bool, attachment string) messages.Message {
+	msg := messages.NewMessage(from, content, isHidden)
+	msg.Attachment = attachment
+	return msg
+}
+
 // getAction checks if the line is an action (e.g. a slash command indicating a
 // file or exec command) and returns the action type and the remaining content
 // of the line.
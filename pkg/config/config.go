@@ -4,13 +4,66 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 )
 
 const (
 	DefaultBox = "default"
+
+	// Address on which the serve sub-command listens by default
+	DefaultListen = "127.0.0.1:8765"
+
+	// Output formats of the ask sub-command
+	OutputText = "text"
+	OutputANSI = "ansi"
+	OutputJSON = "json"
+
+	DefaultAPIBaseURL      = "https://api.openai.com/v1"
+	DefaultChatModel       = "gpt-4o"
+	DefaultCompletionModel = "gpt-4o-mini"
+	DefaultAPITimeout      = 60 * time.Second
+	DefaultAPIMaxRetries   = 4
+
+	// Number of project files indexed at once by default
+	DefaultIndexWorkers = 4
+
+	// BackendAssistants uses OpenAI's Assistants API, which stores threads
+	// and the assistant definition on the server.
+	BackendAssistants = "assistants"
+
+	// BackendChat uses the Chat Completions API, keeping the thread's
+	// message history locally. This works with OpenAI-compatible servers
+	// that do not implement the Assistants API.
+	BackendChat = "chat"
+
+	// EmbeddingProviderOpenAI uses OpenAI's embeddings API.
+	EmbeddingProviderOpenAI = "openai"
+
+	// EmbeddingProviderOpenAICompat uses any server implementing OpenAI's
+	// embeddings API, defaulting to the configured API base URL.
+	EmbeddingProviderOpenAICompat = "openai-compat"
+
+	// EmbeddingProviderOllama uses a local Ollama server.
+	EmbeddingProviderOllama = "ollama"
+
+	// EmbeddingProviderLocal uses a deterministic hashing embedder that runs
+	// entirely offline. It is much less accurate than a real model, but is
+	// useful for testing and air-gapped machines.
+	EmbeddingProviderLocal = "local"
+
+	// Tool policies control whether the assistant may call a tool. Under
+	// ToolPolicyAsk, the user is asked to approve each call.
+	ToolPolicyAllow = "allow"
+	ToolPolicyAsk   = "ask"
+	ToolPolicyDeny  = "deny"
+
+	DefaultOpenAIEmbeddingModel = "text-embedding-3-small"
+	DefaultOllamaEmbeddingModel = "nomic-embed-text"
+	DefaultOllamaBaseURL        = "http://localhost:11434/api"
 )
 
 type Config struct {
@@ -20,6 +73,58 @@ type Config struct {
 	Home         string
 	Box          string
 	ProjectPath  string
+	Backend      string
+
+	// Resume is the thread ID of a stored conversation to continue
+	Resume string
+
+	// API endpoint settings, allowing fnord to be used with OpenAI-compatible
+	// servers and proxies.
+	APIBaseURL         string
+	APIHeaders         map[string]string
+	OpenAIOrganization string
+	OpenAIProject      string
+
+	// APITimeout limits how long each API request may take. For streaming
+	// requests, it limits only the wait for the response to begin.
+	// Transient failures are retried up to APIMaxRetries times.
+	APITimeout    time.Duration
+	APIMaxRetries int
+
+	// ChatModel is used for conversations with the assistant. If empty, the
+	// model of the box's persona, or DefaultChatModel, is used.
+	// CompletionModel is used for smaller, one-off completions.
+	ChatModel       string
+	CompletionModel string
+
+	// ToolPolicies overrides the policy of individual tools, by name. The
+	// name "*" sets the policy of every tool not listed by name.
+	ToolPolicies map[string]string
+
+	// Embedding settings, used to index conversations, facts, and project
+	// files.
+	EmbeddingProvider string
+	EmbeddingModel    string
+	EmbeddingBaseURL  string
+
+	// IndexWorkers is the number of project files indexed at once. Each
+	// worker embeds one chunk of a file at a time.
+	IndexWorkers int
+
+	// Options of the export and import sub-commands. WithEmbeddings
+	// includes the documents' embeddings in an exported archive. Replace
+	// deletes a box's contents before importing an archive, rather than
+	// merging the archive into the box.
+	WithEmbeddings bool
+	Replace        bool
+
+	// Output is the format of the ask sub-command's response: OutputText,
+	// OutputANSI, or OutputJSON. If empty, ANSI is used when writing to a
+	// terminal, and plain text otherwise.
+	Output string
+
+	// Listen is the address on which the serve sub-command listens.
+	Listen string
 }
 
 func Getopts() *Config {
@@ -39,7 +144,12 @@ func Getopts() *Config {
 	return config.
 		validateOpenAIApiKey().
 		validateBox().
-		validateProjectPath()
+		validateProjectPath().
+		validateBackend().
+		validateEmbeddings().
+		validateToolPolicies().
+		validateIndexWorkers().
+		validateOutput()
 }
 
 func (c *Config) Usage() {
@@ -49,6 +159,28 @@ func (c *Config) Usage() {
 	fmt.Println("Sub-commands:")
 	fmt.Println("  list-boxes       List all previously created boxes")
 	fmt.Println("  list-projects    List all previously created projects")
+	fmt.Println("  facts list       List the facts saved in the box")
+	fmt.Println("  facts add [text] Save a fact in the box (read from stdin if not given)")
+	fmt.Println("  facts rm <id>... Delete facts from the box")
+	fmt.Println("  facts search <query>")
+	fmt.Println("                   Search the facts saved in the box")
+	fmt.Println("  box create <box> Create an empty box")
+	fmt.Println("  box delete <box> Delete a box, its facts, and its conversations")
+	fmt.Println("  box rename <from> <to>")
+	fmt.Println("                   Rename a box")
+	fmt.Println("  box copy <from> <to>")
+	fmt.Println("                   Copy a box into a new box")
+	fmt.Println("  box stats [box...]")
+	fmt.Println("                   Show what each box holds")
+	fmt.Println("  ask <question>   Ask the assistant a question and print the response. Input")
+	fmt.Println("                   piped to stdin is attached to the question. Exits with 1")
+	fmt.Println("                   if the response fails, or 2 if the question is invalid.")
+	fmt.Println("  rpc              Speak line-delimited JSON-RPC on stdin and stdout, for editor")
+	fmt.Println("                   extensions (see pkg/rpc/rpc.go)")
+	fmt.Println("  serve            Serve a local HTTP API for editors and other front ends (see")
+	fmt.Println("                   --listen and pkg/server/server.go)")
+	fmt.Println("  export <file>    Export the box's facts and conversations to a .tar.gz archive")
+	fmt.Println("  import <file>    Import an exported archive into the box")
 
 	fmt.Println("")
 	fmt.Println("Options:")
@@ -63,8 +195,35 @@ func (c *Config) Usage() {
 	fmt.Println("    FNORD_HOME            Base directory for storage (default: $HOME/.config/fnord)")
 	fmt.Println("    FNORD_BOX             Name of the box to use (same as --box)")
 	fmt.Println("    FNORD_PROJECT_PATH    Path to the project directory (same as --project)")
+	fmt.Println("    FNORD_BACKEND         API backend to use (same as --backend)")
+	fmt.Println("    FNORD_API_BASE_URL    Base URL of the API (same as --api-base-url)")
+	fmt.Println("    FNORD_API_HEADERS     Extra request headers, as 'Name: value' pairs separated by ';' (same as --header)")
+	fmt.Println("    FNORD_API_TIMEOUT     Timeout for API requests, e.g. '90s' (same as --api-timeout)")
+	fmt.Println("    FNORD_API_MAX_RETRIES Times to retry failed API requests (same as --api-max-retries)")
+	fmt.Println("    FNORD_CHAT_MODEL      Model used for chat (same as --chat-model)")
+	fmt.Println("    FNORD_COMPLETION_MODEL Model used for one-off completions (same as --completion-model)")
+	fmt.Println("    FNORD_EMBEDDING_PROVIDER Embedding provider (same as --embedding-provider)")
+	fmt.Println("    FNORD_EMBEDDING_MODEL Embedding model (same as --embedding-model)")
+	fmt.Println("    FNORD_EMBEDDING_BASE_URL Base URL of the embedding server (same as --embedding-base-url)")
+	fmt.Println("    FNORD_INDEX_WORKERS   Number of project files indexed at once (same as --index-workers)")
+	fmt.Println("    OPENAI_ORG_ID         OpenAI organization ID (same as --openai-org)")
+	fmt.Println("    OPENAI_PROJECT_ID     OpenAI project ID (same as --openai-project)")
+	fmt.Println("    FNORD_TOOL_POLICY     Tool policies, as 'name=policy' pairs separated by ',' (same as --tool-policy)")
 	fmt.Println("    FNORD_TESTING         Enable testing mode (same as --testing)")
 
+	fmt.Println("")
+	fmt.Println("Personas:")
+	fmt.Println("  A box may override the assistant's instructions, model, and tools with a")
+	fmt.Println("  persona in $FNORD_HOME/personas/<box>.json. See pkg/gpt/assistant.go for details.")
+
+	fmt.Println("")
+	fmt.Println("Tools:")
+	fmt.Println("  Scripts may be made available to the assistant by defining them in")
+	fmt.Println("  $FNORD_HOME/tools/*.json, with a name, description, JSON schema of their")
+	fmt.Println("  parameters, and a command to run. See pkg/gpt/shell_tools.go for details.")
+	fmt.Println("  Tools provided by MCP servers may be added by listing the servers in")
+	fmt.Println("  $FNORD_HOME/mcp.json, in the same \"mcpServers\" format used by other MCP clients.")
+
 	fmt.Println("")
 
 	os.Exit(0)
@@ -84,7 +243,44 @@ func (c *Config) ReadCommandLineOptions() *Config {
 	pflag.BoolVarP(&c.Testing, "testing", "t", false, "enable testing mode (forces --box to be 'testing')")
 	pflag.StringVarP(&c.Box, "box", "b", defaultBox, "boxes are isolated workspaces; conversations held within a box are isolated from other boxes")
 	pflag.StringVarP(&c.ProjectPath, "project", "p", c.ProjectPath, "path to the project directory; it will be indexed to make available for the assistant")
+	pflag.StringVarP(&c.Resume, "resume", "r", "", "thread ID of a previous conversation in the box to continue")
+	pflag.StringVar(&c.Backend, "backend", c.Backend, "API backend to use; 'assistants' (OpenAI Assistants API) or 'chat' (any Chat Completions-compatible server)")
+	pflag.StringVar(&c.APIBaseURL, "api-base-url", c.APIBaseURL, "base URL of the OpenAI-compatible API")
+	pflag.DurationVar(&c.APITimeout, "api-timeout", c.APITimeout, "timeout for API requests")
+	pflag.IntVar(&c.APIMaxRetries, "api-max-retries", c.APIMaxRetries, "number of times to retry API requests that fail with transient errors")
+	pflag.StringVar(&c.ChatModel, "chat-model", c.ChatModel, "model used for chat (default: the box's persona's model, or "+DefaultChatModel+")")
+	pflag.StringVar(&c.CompletionModel, "completion-model", c.CompletionModel, "model used for one-off completions")
+	pflag.StringVar(&c.OpenAIOrganization, "openai-org", c.OpenAIOrganization, "OpenAI organization ID")
+	pflag.StringVar(&c.OpenAIProject, "openai-project", c.OpenAIProject, "OpenAI project ID")
+
+	pflag.StringVar(&c.EmbeddingProvider, "embedding-provider", c.EmbeddingProvider, "embedding provider; 'openai', 'openai-compat', 'ollama', or 'local'")
+	pflag.StringVar(&c.EmbeddingModel, "embedding-model", c.EmbeddingModel, "embedding model (default depends on the provider)")
+	pflag.StringVar(&c.EmbeddingBaseURL, "embedding-base-url", c.EmbeddingBaseURL, "base URL of the embedding server (default depends on the provider)")
+	pflag.IntVar(&c.IndexWorkers, "index-workers", c.IndexWorkers, "number of project files indexed at once")
+
+	pflag.BoolVar(&c.WithEmbeddings, "with-embeddings", false, "export: include embeddings, so that the archive can be imported without embedding it again")
+	pflag.BoolVar(&c.Replace, "replace", false, "import: replace the box's facts and conversations instead of merging the archive into them")
+
+	pflag.StringVarP(&c.Output, "output", "o", "", "ask: format of the response; 'text', 'ansi' (rendered markdown), or 'json' (one event per line) (default: 'ansi' on a terminal, otherwise 'text')")
+
+	pflag.StringVar(&c.Listen, "listen", DefaultListen, "serve: address on which to listen, as 'host:port'")
+
+	var toolPolicies []string
+	pflag.StringArrayVar(&toolPolicies, "tool-policy", nil, "policy for a tool, as 'name=allow|ask|deny'; use '*' as the name to set the policy of all other tools (may be repeated)")
+
+	var headers []string
+	pflag.StringArrayVar(&headers, "header", nil, "extra header to send with API requests, as 'Name: value' (may be repeated)")
+
 	pflag.Parse()
+
+	for _, header := range headers {
+		c.addHeaders(header)
+	}
+
+	for _, policy := range toolPolicies {
+		c.addToolPolicies(policy)
+	}
+
 	return c
 }
 
@@ -93,6 +289,57 @@ func (c *Config) SetEnvOptions() *Config {
 	c.Box = os.Getenv("FNORD_BOX")
 	c.ProjectPath = os.Getenv("FNORD_PROJECT_PATH")
 
+	c.Backend = os.Getenv("FNORD_BACKEND")
+	if c.Backend == "" {
+		c.Backend = BackendAssistants
+	}
+
+	c.APIBaseURL = getEnvDefault("FNORD_API_BASE_URL", DefaultAPIBaseURL)
+	c.ChatModel = os.Getenv("FNORD_CHAT_MODEL")
+	c.CompletionModel = getEnvDefault("FNORD_COMPLETION_MODEL", DefaultCompletionModel)
+	c.APITimeout = DefaultAPITimeout
+	if value := os.Getenv("FNORD_API_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			die("Invalid FNORD_API_TIMEOUT (%s): %s", value, err)
+		}
+
+		c.APITimeout = timeout
+	}
+
+	c.APIMaxRetries = DefaultAPIMaxRetries
+	if value := os.Getenv("FNORD_API_MAX_RETRIES"); value != "" {
+		retries, err := strconv.Atoi(value)
+		if err != nil {
+			die("Invalid FNORD_API_MAX_RETRIES (%s): %s", value, err)
+		}
+
+		c.APIMaxRetries = retries
+	}
+
+	c.OpenAIOrganization = os.Getenv("OPENAI_ORG_ID")
+	c.OpenAIProject = os.Getenv("OPENAI_PROJECT_ID")
+
+	c.EmbeddingProvider = getEnvDefault("FNORD_EMBEDDING_PROVIDER", EmbeddingProviderOpenAI)
+	c.EmbeddingModel = os.Getenv("FNORD_EMBEDDING_MODEL")
+	c.EmbeddingBaseURL = os.Getenv("FNORD_EMBEDDING_BASE_URL")
+
+	c.IndexWorkers = DefaultIndexWorkers
+	if value := os.Getenv("FNORD_INDEX_WORKERS"); value != "" {
+		workers, err := strconv.Atoi(value)
+		if err != nil {
+			die("Invalid FNORD_INDEX_WORKERS (%s): %s", value, err)
+		}
+
+		c.IndexWorkers = workers
+	}
+
+	c.APIHeaders = map[string]string{}
+	c.addHeaders(os.Getenv("FNORD_API_HEADERS"))
+
+	c.ToolPolicies = map[string]string{}
+	c.addToolPolicies(os.Getenv("FNORD_TOOL_POLICY"))
+
 	if os.Getenv("FNORD_TESTING") == "true" || os.Getenv("FNORD_TESTING") == "1" {
 		c.Testing = true
 	}
@@ -127,7 +374,9 @@ func (c *Config) SetTestingOverrides() *Config {
 //------------------------------------------------------------------------------
 
 func (c *Config) validateOpenAIApiKey() *Config {
-	if c.OpenAIApiKey == "" {
+	// Only OpenAI itself requires an API key. Local and proxied servers may
+	// not need one, or may be authenticated using --header.
+	if c.OpenAIApiKey == "" && c.APIBaseURL == DefaultAPIBaseURL {
 		die("OPENAI_API_KEY must be set in the shell environment")
 	}
 
@@ -161,10 +410,129 @@ func (c *Config) validateProjectPath() *Config {
 	return c
 }
 
+func (c *Config) validateBackend() *Config {
+	switch c.Backend {
+	case BackendAssistants, BackendChat:
+		return c
+	default:
+		die("Backend must be one of '%s' or '%s' (got '%s')", BackendAssistants, BackendChat, c.Backend)
+	}
+
+	return c
+}
+
+func (c *Config) validateEmbeddings() *Config {
+	switch c.EmbeddingProvider {
+	case EmbeddingProviderOpenAI:
+		if c.EmbeddingModel == "" {
+			c.EmbeddingModel = DefaultOpenAIEmbeddingModel
+		}
+
+	case EmbeddingProviderOpenAICompat:
+		if c.EmbeddingModel == "" {
+			c.EmbeddingModel = DefaultOpenAIEmbeddingModel
+		}
+
+		if c.EmbeddingBaseURL == "" {
+			c.EmbeddingBaseURL = c.APIBaseURL
+		}
+
+	case EmbeddingProviderOllama:
+		if c.EmbeddingModel == "" {
+			c.EmbeddingModel = DefaultOllamaEmbeddingModel
+		}
+
+		if c.EmbeddingBaseURL == "" {
+			c.EmbeddingBaseURL = DefaultOllamaBaseURL
+		}
+
+	case EmbeddingProviderLocal:
+		// The local embedder has no model or server
+
+	default:
+		die("Embedding provider must be one of 'openai', 'openai-compat', 'ollama', or 'local' (got '%s')", c.EmbeddingProvider)
+	}
+
+	return c
+}
+
+func (c *Config) validateToolPolicies() *Config {
+	for name, policy := range c.ToolPolicies {
+		switch policy {
+		case ToolPolicyAllow, ToolPolicyAsk, ToolPolicyDeny:
+		default:
+			die("Policy for tool '%s' must be one of 'allow', 'ask', or 'deny' (got '%s')", name, policy)
+		}
+	}
+
+	return c
+}
+
+func (c *Config) validateIndexWorkers() *Config {
+	if c.IndexWorkers < 1 {
+		die("The number of index workers must be at least 1 (got %d)", c.IndexWorkers)
+	}
+
+	return c
+}
+
+func (c *Config) validateOutput() *Config {
+	switch c.Output {
+	case "", OutputText, OutputANSI, OutputJSON:
+		return c
+	default:
+		die("Output must be one of '%s', '%s', or '%s' (got '%s')", OutputText, OutputANSI, OutputJSON, c.Output)
+	}
+
+	return c
+}
+
 //------------------------------------------------------------------------------
 // Helper functions
 //------------------------------------------------------------------------------
 
+// addHeaders parses a list of 'Name: value' headers, separated by semicolons,
+// and adds them to APIHeaders.
+func (c *Config) addHeaders(headers string) {
+	for _, header := range strings.Split(headers, ";") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(header, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			die("Invalid header (expected 'Name: value'): %s", header)
+		}
+
+		c.APIHeaders[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+}
+
+// addToolPolicies parses a list of 'name=policy' pairs, separated by commas,
+// and adds them to ToolPolicies.
+func (c *Config) addToolPolicies(policies string) {
+	for _, entry := range strings.Split(policies, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		name, policy, found := strings.Cut(entry, "=")
+		if !found || strings.TrimSpace(name) == "" {
+			die("Invalid tool policy (expected 'name=policy'): %s", entry)
+		}
+
+		c.ToolPolicies[strings.TrimSpace(name)] = strings.TrimSpace(policy)
+	}
+}
+
+func getEnvDefault(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return defaultValue
+}
+
 func die(fmtString string, args ...interface{}) {
 	panic(fmt.Sprintf(fmtString, args...))
 }
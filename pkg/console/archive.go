@@ -0,0 +1,100 @@
+package console
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+// Export handles the export command, which writes the selected box's facts
+// and conversations to an archive. The archive is written to stdout if the
+// file is "-".
+func Export(conf *config.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: fnord export [--box <box>] [--with-embeddings] <file.tar.gz>")
+	}
+
+	file := args[0]
+
+	var out io.Writer = os.Stdout
+	if file != "-" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		out = f
+	}
+
+	result, err := storage.ExportBox(out, conf.WithEmbeddings)
+	if err != nil {
+		if file != "-" {
+			os.Remove(file)
+		}
+
+		return fmt.Errorf("error exporting box %s: %w", conf.Box, err)
+	}
+
+	// Keep stdout clean when the archive is written to it
+	fmt.Fprintf(os.Stderr, "Exported %d facts and %d conversations from box %s\n", result.Facts, result.Conversations, conf.Box)
+
+	return nil
+}
+
+// Import handles the import command, which reads an archive written by
+// Export into the selected box. The archive is read from stdin if the file is
+// "-".
+func Import(conf *config.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: fnord import [--box <box>] [--replace] <file.tar.gz>")
+	}
+
+	file := args[0]
+
+	var in io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		in = f
+	}
+
+	result, err := storage.ImportBox(in, conf.Replace)
+	if err != nil {
+		var collisions *storage.ImportCollisions
+		if errors.As(err, &collisions) {
+			for _, id := range collisions.Facts {
+				fmt.Fprintf(os.Stderr, "Fact %s already exists with different content\n", id)
+			}
+
+			for _, id := range collisions.Conversations {
+				fmt.Fprintf(os.Stderr, "Conversation %s already exists with different content\n", id)
+			}
+
+			return fmt.Errorf("%w; nothing was imported (use --replace to replace the box's contents)", err)
+		}
+
+		return fmt.Errorf("error importing into box %s: %w", conf.Box, err)
+	}
+
+	fmt.Printf("Imported %d facts and %d conversations from box %s into box %s", result.Facts, result.Conversations, result.Box, conf.Box)
+	if result.Skipped > 0 {
+		fmt.Printf(" (%d already present)", result.Skipped)
+	}
+
+	fmt.Println()
+
+	if !result.UsedEmbeddings && result.Facts+result.Conversations > 0 {
+		fmt.Println("The archive's documents were embedded again with the configured embedding provider.")
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package console
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/gpt"
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+const boxUsage = `Usage: fnord box <command> [arguments]
+
+Commands:
+  list              List every box
+  create <box>      Create an empty box
+  delete <box>      Delete a box, its facts, and its conversations
+  rename <from> <to>
+                    Rename a box
+  copy <from> <to>  Copy a box's facts and conversations into a new box
+  stats [box...]    Show what each box holds (all boxes if none are given)
+`
+
+// Box handles the box command, which manages boxes as a whole.
+func Box(conf *config.Config, args []string) error {
+	if len(args) == 0 {
+		fmt.Print(boxUsage)
+		return nil
+	}
+
+	command, args := args[0], args[1:]
+
+	switch command {
+	case "list":
+		ListBoxes()
+
+	case "create":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: fnord box create <box>")
+		}
+
+		if err := storage.CreateBox(args[0]); err != nil {
+			return err
+		}
+
+		fmt.Printf("Created box %s\n", args[0])
+
+	case "delete":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: fnord box delete <box>")
+		}
+
+		box := args[0]
+
+		stats, err := storage.GetBoxStats(box)
+		if err != nil {
+			return err
+		}
+
+		prompt := fmt.Sprintf("Delete box %s with %d facts and %d conversations? This cannot be undone.", box, stats.Facts, stats.Conversations)
+		if !confirm(prompt) {
+			fmt.Println("Cancelled.")
+			return nil
+		}
+
+		if err := storage.DeleteBox(box); err != nil {
+			return err
+		}
+
+		fmt.Printf("Deleted box %s\n", box)
+
+		// The persona is configuration written by the user, so it is left
+		// for them to remove.
+		if path := personaPath(conf, box); fileExists(path) {
+			fmt.Printf("The box's persona was kept: %s\n", path)
+		}
+
+	case "rename":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: fnord box rename <from> <to>")
+		}
+
+		if err := storage.RenameBox(args[0], args[1]); err != nil {
+			return err
+		}
+
+		if err := movePersona(conf, args[0], args[1]); err != nil {
+			return fmt.Errorf("the box was renamed, but its persona was not: %w", err)
+		}
+
+		fmt.Printf("Renamed box %s to %s\n", args[0], args[1])
+
+	case "copy":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: fnord box copy <from> <to>")
+		}
+
+		if err := storage.CopyBox(args[0], args[1]); err != nil {
+			return err
+		}
+
+		if err := copyPersona(conf, args[0], args[1]); err != nil {
+			return fmt.Errorf("the box was copied, but its persona was not: %w", err)
+		}
+
+		fmt.Printf("Copied box %s to %s\n", args[0], args[1])
+
+	case "stats":
+		boxes := args
+
+		if len(boxes) == 0 {
+			var err error
+			if boxes, err = storage.GetBoxes(); err != nil {
+				return fmt.Errorf("error listing boxes: %w", err)
+			}
+		}
+
+		for _, box := range boxes {
+			stats, err := storage.GetBoxStats(box)
+			if err != nil {
+				return err
+			}
+
+			printBoxStats(stats)
+		}
+
+	default:
+		fmt.Print(boxUsage)
+		return fmt.Errorf("unknown box command: %s", command)
+	}
+
+	return nil
+}
+
+func printBoxStats(stats *storage.BoxStats) {
+	lastActivity := "never"
+	if !stats.LastActivity.IsZero() {
+		lastActivity = stats.LastActivity.Local().Format("2006-01-02 15:04")
+	}
+
+	fmt.Println(stats.Name)
+	fmt.Printf("    Facts:         %d\n", stats.Facts)
+	fmt.Printf("    Conversations: %d (%d messages)\n", stats.Conversations, stats.Messages)
+	fmt.Printf("    Last activity: %s\n", lastActivity)
+	fmt.Println()
+}
+
+// confirm asks the user a yes or no question on the terminal. Anything other
+// than yes is taken as no.
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
+
+func personaPath(conf *config.Config, box string) string {
+	return filepath.Join(conf.Home, gpt.PersonasDir, box+".json")
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// movePersona moves a box's persona, if it has one, to another box.
+func movePersona(conf *config.Config, from, to string) error {
+	err := os.Rename(personaPath(conf, from), personaPath(conf, to))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// copyPersona copies a box's persona, if it has one, to another box.
+func copyPersona(conf *config.Config, from, to string) error {
+	buf, err := os.ReadFile(personaPath(conf, from))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(personaPath(conf, to), buf, 0600)
+}
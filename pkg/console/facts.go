@@ -0,0 +1,127 @@
+package console
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+// How many facts `facts search` returns
+const factSearchResults = 10
+
+const factsUsage = `Usage: fnord facts <command> [arguments]
+
+Commands:
+  list             List every fact in the box
+  add [text]       Add a fact; the text is read from stdin if not given
+  rm <id>...       Delete facts by ID
+  search <query>   Search the box's facts
+`
+
+// Facts handles the facts command, which manages the facts saved in the
+// selected box.
+func Facts(args []string) error {
+	if len(args) == 0 {
+		fmt.Print(factsUsage)
+		return nil
+	}
+
+	command, args := args[0], args[1:]
+
+	switch command {
+	case "list":
+		facts, err := storage.ListFacts()
+		if err != nil {
+			return fmt.Errorf("error listing facts: %w", err)
+		}
+
+		if len(facts) == 0 {
+			fmt.Println("No facts have been saved in this box yet.")
+			return nil
+		}
+
+		printFacts(facts)
+
+	case "add":
+		content := strings.Join(args, " ")
+
+		if content == "" {
+			buf, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return fmt.Errorf("error reading fact from stdin: %w", err)
+			}
+
+			content = string(buf)
+		}
+
+		content = strings.TrimSpace(content)
+		if content == "" {
+			return fmt.Errorf("the fact is empty")
+		}
+
+		id, err := storage.CreateFact(content)
+		if err != nil {
+			return fmt.Errorf("error adding fact: %w", err)
+		}
+
+		fmt.Println(id)
+
+	case "rm":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: fnord facts rm <id>...")
+		}
+
+		for _, id := range args {
+			// Deleting a fact that does not exist is not an error in
+			// storage, so check first to catch typos.
+			if _, err := storage.ReadFact(id); err != nil {
+				return fmt.Errorf("fact not found: %s", id)
+			}
+
+			if err := storage.DeleteFact(id); err != nil {
+				return fmt.Errorf("error deleting fact %s: %w", id, err)
+			}
+
+			fmt.Printf("Deleted %s\n", id)
+		}
+
+	case "search":
+		query := strings.Join(args, " ")
+		if query == "" {
+			return fmt.Errorf("usage: fnord facts search <query>")
+		}
+
+		facts, err := storage.SearchFacts(query, factSearchResults)
+		if err != nil {
+			return fmt.Errorf("error searching facts: %w", err)
+		}
+
+		if len(facts) == 0 {
+			fmt.Println("No matching facts.")
+			return nil
+		}
+
+		printFacts(facts)
+
+	default:
+		fmt.Print(factsUsage)
+		return fmt.Errorf("unknown facts command: %s", command)
+	}
+
+	return nil
+}
+
+func printFacts(facts []storage.Result) {
+	for _, fact := range facts {
+		fmt.Printf("%s (updated %s)\n", fact.ID, fact.Updated)
+
+		for _, line := range strings.Split(fact.Content, "\n") {
+			fmt.Println("    " + line)
+		}
+
+		fmt.Println()
+	}
+}
@@ -6,7 +6,24 @@ import (
 
 var LogChannel = make(chan string, 100)
 
+// Log formats a message and sends it to LogChannel. If the channel is full,
+// because nothing is reading it yet (or at all), the message is dropped
+// rather than blocking the caller.
 func Log(format string, v ...interface{}) {
 	msg := fmt.Sprintf(format, v...)
-	LogChannel <- msg
+
+	select {
+	case LogChannel <- msg:
+	default:
+	}
+}
+
+// Discard drains the log channel, dropping every message, so that logging
+// does not block when nothing displays the logs, as when running a
+// command-line subcommand.
+func Discard() {
+	go func() {
+		for range LogChannel {
+		}
+	}()
 }
@@ -1,41 +1,161 @@
 package fnord
 
 import (
+	"fmt"
 	"os"
 
+	"github.com/spf13/pflag"
+
 	"github.com/sysread/fnord/pkg/config"
 	"github.com/sysread/fnord/pkg/console"
+	"github.com/sysread/fnord/pkg/debug"
 	"github.com/sysread/fnord/pkg/gpt"
+	"github.com/sysread/fnord/pkg/mcp"
 	"github.com/sysread/fnord/pkg/storage"
 )
 
 type Fnord struct {
 	Config    *config.Config
-	GptClient *gpt.OpenAIClient
+	GptClient gpt.Client
+
+	// MCP servers providing additional tools
+	MCPServers []*mcp.Client
 }
 
 func NewFnord() *Fnord {
 	conf := config.Getopts()
-	gptClient := gpt.NewOpenAIClient(conf)
 
 	err := storage.Init(conf)
 	if err != nil {
 		panic(err)
 	}
 
-	if len(os.Args) > 1 {
-		switch os.Args[1] {
-		case "list-boxes":
-			console.ListBoxes()
-			os.Exit(0)
-		case "list-projects":
-			console.ListProjects()
-			os.Exit(0)
-		}
+	// Sub-commands only need storage, so they are run before the tools are
+	// loaded and the assistant is set up.
+	runSubCommand(conf, pflag.Args())
+
+	// User-defined tools must be registered before the client is created,
+	// since the assistant's tool definitions are generated from the registry.
+	if err := gpt.RegisterShellTools(conf, gpt.Tools); err != nil {
+		panic(err)
+	}
+
+	mcpServers, err := gpt.StartMCPServers(conf, gpt.Tools)
+	if err != nil {
+		panic(err)
+	}
+
+	gpt.Tools.SetPolicies(conf.ToolPolicies)
+
+	gptClient, err := gpt.NewClient(conf)
+	if err != nil {
+		panic(err)
+	}
+
+	// The project is indexed only once it's clear that the assistant, which
+	// searches it, will be used.
+	if err := storage.InitProject(conf); err != nil {
+		panic(err)
 	}
 
 	return &Fnord{
-		Config:    conf,
-		GptClient: gptClient,
+		Config:     conf,
+		GptClient:  gptClient,
+		MCPServers: mcpServers,
+	}
+}
+
+// AssistantSubCommands are the sub-commands that talk to the assistant. They
+// are not run by NewFnord, which sets up the assistant for them, but by the
+// caller.
+var AssistantSubCommands = map[string]bool{
+	"ask":   true,
+	"rpc":   true,
+	"serve": true,
+}
+
+// runSubCommand runs the sub-command named by the first positional argument,
+// if any, and exits.
+func runSubCommand(conf *config.Config, args []string) {
+	if len(args) == 0 || AssistantSubCommands[args[0]] {
+		return
+	}
+
+	// There is no log view to drain the logs
+	debug.Discard()
+
+	var err error
+
+	switch args[0] {
+	case "list-boxes":
+		console.ListBoxes()
+	case "list-projects":
+		console.ListProjects()
+	case "facts":
+		err = console.Facts(args[1:])
+	case "box":
+		err = console.Box(conf, args[1:])
+	case "export":
+		err = console.Export(conf, args[1:])
+	case "import":
+		err = console.Import(conf, args[1:])
+	default:
+		err = fmt.Errorf("unknown sub-command: %s (see --help)", args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+// SwitchBox selects another box. The assistant is set up again, since its
+// persona depends on the box, and the box's collections are opened. If any
+// step fails, the previous box remains selected.
+func (f *Fnord) SwitchBox(box string) error {
+	debug.Log("[fnord] Switching to box %s", box)
+
+	conf := *f.Config
+	conf.Box = box
+
+	// The conversation to resume belonged to the previous box
+	conf.Resume = ""
+
+	gptClient, err := gpt.NewClient(&conf)
+	if err != nil {
+		return err
+	}
+
+	if err := openBox(&conf); err != nil {
+		// Reopen the previous box's collections
+		if reopenErr := openBox(f.Config); reopenErr != nil {
+			debug.Log("[fnord] Error reopening box %s: %v", f.Config.Box, reopenErr)
+		}
+
+		return err
+	}
+
+	f.Config.Box = conf.Box
+	f.Config.Resume = conf.Resume
+	f.GptClient = gptClient
+
+	return nil
+}
+
+// openBox opens the collections of the box selected in conf.
+func openBox(conf *config.Config) error {
+	if err := storage.InitializeConversationsCollection(conf); err != nil {
+		return err
+	}
+
+	return storage.InitializeFactsCollection(conf)
+}
+
+// Close shuts down the MCP servers.
+func (f *Fnord) Close() {
+	for _, server := range f.MCPServers {
+		server.Close()
 	}
 }
@@ -1,24 +1,41 @@
 package gpt
 
 import (
+	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"net/url"
+	"os"
+	"path/filepath"
 
+	"github.com/sysread/fnord/pkg/config"
 	"github.com/sysread/fnord/pkg/debug"
 )
 
-const asstApiUri = apiBaseUri + "/assistants"
+const asstApiPath = "/assistants"
 const assistantName = "Fnord Prefect"
 
+// PersonasDir is the directory, relative to FNORD_HOME, containing persona
+// files. A box's persona is read from <box>.json.
+const PersonasDir = "personas"
+
+// Metadata keys identifying the assistants managed by fnord. The key
+// identifies which of fnord's assistants it is (the default assistant, or
+// the assistant for a box's persona), and the hash identifies the version of
+// its definition.
+const (
+	metaAssistantKey  = "fnord_assistant"
+	metaAssistantHash = "fnord_hash"
+)
+
 //go:embed assistant.json
 var assistantFiles embed.FS
-var assistantJSON []byte
-var desiredAssistantVersion = "1.0.1"
 
-var AssistantID string
-var AssistantVersion string
+var errAssistantNotFound = errors.New("assistant not found")
 
 type assistantInfo struct {
 	ID       string            `json:"id"`
@@ -26,115 +43,254 @@ type assistantInfo struct {
 	Metadata map[string]string `json:"metadata"`
 }
 
-type findAssistantResponse struct {
-	Data []assistantInfo `json:"data"`
+type listAssistantsResponse struct {
+	Data    []assistantInfo `json:"data"`
+	HasMore bool            `json:"has_more"`
+	LastID  string          `json:"last_id"`
 }
 
-func (c *OpenAIClient) initAssistant() error {
-	var err error
+// Persona overrides the assistant's definition for a box. Fields that are
+// empty are not overridden. For example, FNORD_HOME/personas/work.json might
+// contain:
+//
+//	{
+//	  "instructions": "You are a terse assistant for the payments team...",
+//	  "model": "gpt-4o-mini",
+//	  "tools": ["query_project_files", "search_facts", "save_fact"]
+//	}
+//
+// Tools lists the names of the tools the assistant may call. If it is empty,
+// all registered tools are available.
+type Persona struct {
+	Instructions string   `json:"instructions"`
+	Model        string   `json:"model"`
+	Tools        []string `json:"tools"`
+}
+
+// LoadPersona reads the persona for the selected box, returning nil if the
+// box does not have one.
+func LoadPersona(conf *config.Config) (*Persona, error) {
+	path := filepath.Join(conf.Home, PersonasDir, conf.Box+".json")
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
 
-	// Load the assistant JSON file
-	assistantJSON, err = assistantFiles.ReadFile("assistant.json")
 	if err != nil {
-		panic(fmt.Errorf("failed to read assistant JSON file: %v", err))
+		return nil, err
 	}
 
-	// Parse the assistant JSON file
-	var asst map[string]interface{}
-	if err := json.Unmarshal(assistantJSON, &asst); err != nil {
-		panic(fmt.Errorf("failed to parse assistant JSON: %v", err))
+	var persona Persona
+	if err := json.Unmarshal(buf, &persona); err != nil {
+		return nil, fmt.Errorf("invalid persona in %s: %w", path, err)
 	}
 
-	// Set the assistant's version from the JSON file
-	desiredAssistantVersion = asst["metadata"].(map[string]interface{})["version"].(string)
+	return &persona, nil
+}
 
-	if err := c.findAssistant(); err != nil {
-		return c.createAssistant()
+// assistantDefinition is the assistant as sent to the Assistants API,
+// rendered from assistant.json, the box's persona (if any), and the tool
+// registry. The Chat Completions backend uses the model, instructions, and
+// tools, which must be sent along with each request.
+type assistantDefinition struct {
+	Name         string            `json:"name"`
+	Description  string            `json:"description"`
+	Model        string            `json:"model"`
+	Instructions string            `json:"instructions"`
+	Tools        []json.RawMessage `json:"tools"`
+	Metadata     map[string]string `json:"metadata"`
+
+	// The tools the assistant may call
+	registry *ToolRegistry
+}
+
+// loadAssistantDefinition renders the assistant definition for the selected
+// box. Its metadata records a hash of the rest of the definition, so that any
+// change to it, including to the registered tools, is detected by
+// initAssistant.
+func loadAssistantDefinition(conf *config.Config, registry *ToolRegistry) (*assistantDefinition, error) {
+	buf, err := assistantFiles.ReadFile("assistant.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read assistant JSON file: %v", err)
 	}
 
-	debug.Log("Found Assistant: %s", AssistantID)
-	debug.Log("Assistant version: %s (current version: %s)", AssistantVersion, desiredAssistantVersion)
+	var def assistantDefinition
+	if err := json.Unmarshal(buf, &def); err != nil {
+		return nil, fmt.Errorf("failed to parse assistant JSON: %v", err)
+	}
 
-	if AssistantVersion == desiredAssistantVersion {
-		debug.Log("Assistant is up to date")
-	} else {
-		debug.Log("Updating Assistant to version %s", desiredAssistantVersion)
-		return c.updateAssistant()
+	key := "default"
+	def.registry = registry
+
+	persona, err := LoadPersona(conf)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
-}
+	// Each persona has its own assistant, so that switching between boxes
+	// does not require the assistant to be updated each time.
+	if persona != nil {
+		debug.Log("[gpt] Using the persona for box %s", conf.Box)
 
-func (c *OpenAIClient) findAssistant() error {
-	uri := asstApiUri + "?limit=100"
+		key = "box:" + conf.Box
+		def.Name = fmt.Sprintf("%s (%s)", assistantName, conf.Box)
 
-	// Build a request to list assistants
-	req, err := c.makeRequest("GET", uri, nil, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		if persona.Instructions != "" {
+			def.Instructions = persona.Instructions
+		}
+
+		if persona.Model != "" {
+			def.Model = persona.Model
+		}
+
+		if len(persona.Tools) > 0 {
+			def.registry = registry.Subset(persona.Tools)
+		}
 	}
 
-	// Perform the request
-	resp, err := c.http.Do(req)
+	if def.Model == "" {
+		def.Model = config.DefaultChatModel
+	}
+
+	// Built-in Assistants API tools, like code_interpreter, are declared in
+	// assistant.json, followed by the registered function tools.
+	def.Tools = append(def.Tools, def.registry.Definitions()...)
+
+	hash, err := def.hash()
 	if err != nil {
-		return fmt.Errorf("failed to make request: %v", err)
+		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		msg, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to list assistants: %v - %s", resp.Status, msg)
+
+	def.Metadata = map[string]string{
+		metaAssistantKey:  key,
+		metaAssistantHash: hash,
 	}
 
-	// Read the response body
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	return &def, nil
+}
+
+// hash returns a hash of the definition, excluding its metadata.
+func (d *assistantDefinition) hash() (string, error) {
+	unhashed := *d
+	unhashed.Metadata = nil
+
+	buf, err := json.Marshal(unhashed)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %v", err)
+		return "", fmt.Errorf("failed to serialize assistant definition: %v", err)
 	}
 
-	// Parse the response body
-	var asstResp findAssistantResponse
-	if err := json.Unmarshal(body, &asstResp); err != nil {
-		return fmt.Errorf("failed to parse response body: %v", err)
-	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
 
-	// Find our assistant's ID
-	for _, asst := range asstResp.Data {
-		if asst.Name == assistantName {
-			AssistantID = asst.ID
-			AssistantVersion = asst.Metadata["version"]
-			return nil
-		}
+// model returns the model to use for chat, which may be overridden in the
+// configuration.
+func (d *assistantDefinition) model(conf *config.Config) string {
+	if conf.ChatModel != "" {
+		return conf.ChatModel
 	}
 
-	return fmt.Errorf("assistant not found: %s", assistantName)
+	return d.Model
 }
 
-func (c *OpenAIClient) createAssistant() error {
-	uri := asstApiUri
+// Model returns the model used by the assistant.
+func (c *OpenAIClient) Model() string {
+	return c.assistant.model(c.config)
+}
+
+// initAssistant finds the managed assistant for the definition, creating it
+// if it does not exist yet, or updating it if its definition has changed.
+func (c *OpenAIClient) initAssistant() error {
+	key := c.assistant.Metadata[metaAssistantKey]
+	hash := c.assistant.Metadata[metaAssistantHash]
 
-	// Build a request to create an assistant
-	req, err := c.makeRequest("POST", uri, assistantJSON, nil)
+	existing, err := c.findAssistant(key)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		// Don't create a duplicate assistant just because the API was
+		// unreachable
+		if !errors.Is(err, errAssistantNotFound) {
+			return err
+		}
+
+		return c.createAssistant()
 	}
 
-	// Perform the request
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to make request: %v", err)
+	c.assistantID = existing.ID
+
+	debug.Log("Found Assistant: %s", c.assistantID)
+	debug.Log("Assistant hash: %s (current hash: %s)", existing.Metadata[metaAssistantHash], hash)
+
+	if existing.Metadata[metaAssistantHash] == hash {
+		debug.Log("Assistant is up to date")
+		return nil
+	}
+
+	debug.Log("Updating Assistant %s", c.assistantID)
+	return c.updateAssistant()
+}
+
+// findAssistant pages through all of the account's assistants to find the
+// managed assistant with the given key. Assistants created before they were
+// identified by key are found by name.
+func (c *OpenAIClient) findAssistant(key string) (*assistantInfo, error) {
+	var legacy *assistantInfo
+	after := ""
+
+	for {
+		query := url.Values{"limit": {"100"}}
+		if after != "" {
+			query.Set("after", after)
+		}
+
+		// Perform the request to list assistants
+		body, err := c.request(context.Background(), "GET", c.apiUri(asstApiPath+"?"+query.Encode()), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list assistants: %w", err)
+		}
+
+		// Parse the response body
+		var page listAssistantsResponse
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("failed to parse response body: %v", err)
+		}
+
+		for i, asst := range page.Data {
+			if asst.Metadata[metaAssistantKey] == key {
+				return &page.Data[i], nil
+			}
+
+			if legacy == nil && asst.Name == c.assistant.Name && asst.Metadata[metaAssistantKey] == "" {
+				legacy = &page.Data[i]
+			}
+		}
+
+		if !page.HasMore || page.LastID == "" {
+			break
+		}
+
+		after = page.LastID
 	}
-	if resp.StatusCode != 200 {
-		msg, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to create assistant: %v - %s", resp.Status, msg)
+
+	if legacy != nil {
+		return legacy, nil
 	}
 
-	// Ensure the response body is closed
-	defer resp.Body.Close()
+	return nil, fmt.Errorf("%w: %s", errAssistantNotFound, c.assistant.Name)
+}
+
+func (c *OpenAIClient) createAssistant() error {
+	uri := c.apiUri(asstApiPath)
 
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
+	jsonBody, err := json.Marshal(c.assistant)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %v", err)
+		return fmt.Errorf("failed to serialize assistant definition: %v", err)
+	}
+
+	// Perform the request to create the assistant
+	body, err := c.request(context.Background(), "POST", uri, jsonBody)
+	if err != nil {
+		return fmt.Errorf("failed to create assistant: %w", err)
 	}
 
 	// Parse the response body
@@ -144,37 +300,25 @@ func (c *OpenAIClient) createAssistant() error {
 	}
 
 	// Find our assistant's ID
-	AssistantID = assistant.ID
+	c.assistantID = assistant.ID
+
+	debug.Log("Created Assistant: %s", c.assistantID)
 
 	return nil
 }
 
 func (c *OpenAIClient) updateAssistant() error {
-	uri := asstApiUri + "/" + AssistantID
+	uri := c.apiUri(asstApiPath + "/" + c.assistantID)
 
-	// Build a request to update the assistant
-	req, err := c.makeRequest("POST", uri, assistantJSON, nil)
+	jsonBody, err := json.Marshal(c.assistant)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		return fmt.Errorf("failed to serialize assistant definition: %v", err)
 	}
 
-	// Perform the request
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to make request: %v", err)
-	}
-	if resp.StatusCode != 200 {
-		msg, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to update assistant: %v - %s", resp.Status, msg)
-	}
-
-	// Ensure the response body is closed
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
+	// Perform the request to update the assistant
+	body, err := c.request(context.Background(), "POST", uri, jsonBody)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %v", err)
+		return fmt.Errorf("failed to update assistant: %w", err)
 	}
 
 	// Parse the response body
@@ -0,0 +1,103 @@
+package gpt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/config"
+)
+
+func TestLoadAssistantDefinition(t *testing.T) {
+	conf := &config.Config{Home: t.TempDir(), Box: "default"}
+
+	def, err := loadAssistantDefinition(conf, Tools)
+	assert.NoError(t, err)
+
+	assert.Equal(t, assistantName, def.Name)
+	assert.Equal(t, "default", def.Metadata[metaAssistantKey])
+
+	// code_interpreter, followed by each registered tool
+	assert.Len(t, def.Tools, len(Tools.List())+1)
+
+	// Changing the registered tools changes the hash
+	registry := newBuiltinToolRegistry()
+	registry.Register(&FunctionTool{ToolName: "extra", Schema: json.RawMessage(`{"type":"object"}`)})
+
+	other, err := loadAssistantDefinition(conf, registry)
+	assert.NoError(t, err)
+	assert.NotEqual(t, def.Metadata[metaAssistantHash], other.Metadata[metaAssistantHash])
+}
+
+func TestLoadAssistantDefinitionPersona(t *testing.T) {
+	conf := &config.Config{Home: t.TempDir(), Box: "work"}
+
+	os.MkdirAll(filepath.Join(conf.Home, PersonasDir), 0700)
+	os.WriteFile(filepath.Join(conf.Home, PersonasDir, "work.json"), []byte(`{
+		"instructions": "Be terse.",
+		"model": "gpt-4o-mini",
+		"tools": ["search_facts", "no_such_tool"]
+	}`), 0600)
+
+	def, err := loadAssistantDefinition(conf, Tools)
+	assert.NoError(t, err)
+
+	assert.Equal(t, assistantName+" (work)", def.Name)
+	assert.Equal(t, "Be terse.", def.Instructions)
+	assert.Equal(t, "gpt-4o-mini", def.model(conf))
+	assert.Equal(t, "box:work", def.Metadata[metaAssistantKey])
+
+	// Only the persona's tools are available
+	assert.Len(t, def.registry.List(), 1)
+	_, ok := def.registry.Get("save_fact")
+	assert.False(t, ok)
+
+	// The configured model takes precedence over the persona's
+	conf.ChatModel = "gpt-4o"
+	assert.Equal(t, "gpt-4o", def.model(conf))
+}
+
+func TestInitAssistant(t *testing.T) {
+	conf := &config.Config{Home: t.TempDir(), Box: "default"}
+
+	def, err := loadAssistantDefinition(conf, Tools)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var updated []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		// The managed assistant is on the second page of results
+		case r.Method == "GET" && r.URL.Query().Get("after") == "":
+			w.Write([]byte(`{"data": [{"id": "asst_other", "name": "Someone else"}], "has_more": true, "last_id": "asst_other"}`))
+
+		case r.Method == "GET":
+			assert.Equal(t, "asst_other", r.URL.Query().Get("after"))
+			w.Write([]byte(`{"data": [{"id": "asst_fnord", "name": "Renamed", "metadata": {"fnord_assistant": "default", "fnord_hash": "stale"}}], "has_more": false}`))
+
+		case r.Method == "POST":
+			updated = append(updated, r.URL.Path)
+			w.Write([]byte(`{"id": "asst_fnord"}`))
+		}
+	}))
+
+	defer server.Close()
+
+	client := &OpenAIClient{
+		apiClient: newApiClient(&config.Config{APIBaseURL: server.URL}),
+		assistant: def,
+	}
+
+	assert.NoError(t, client.initAssistant())
+	assert.Equal(t, "asst_fnord", client.assistantID)
+
+	// The stale hash caused the assistant to be updated
+	assert.Equal(t, []string{"/assistants/asst_fnord"}, updated)
+}
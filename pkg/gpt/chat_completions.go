@@ -0,0 +1,369 @@
+package gpt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/debug"
+	"github.com/sysread/fnord/pkg/messages"
+)
+
+// ChatCompletionsClient is the Client backend for servers that implement the
+// Chat Completions API but not the Assistants API. Because the server does not
+// store threads, each thread's message history is kept locally and sent in
+// full with each request.
+type ChatCompletionsClient struct {
+	*apiClient
+
+	assistant *assistantDefinition
+
+	mutex   sync.Mutex
+	threads map[string][]chatMessage
+}
+
+type chatMessage struct {
+	Role       string         `json:"role"`
+	Content    string         `json:"content"`
+	ToolCalls  []chatToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+}
+
+type chatToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type chatCompletionRequest struct {
+	Model         string            `json:"model"`
+	Messages      []chatMessage     `json:"messages"`
+	Tools         []json.RawMessage `json:"tools,omitempty"`
+	Stream        bool              `json:"stream"`
+	StreamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+// Represents one chunk of the response body of a streaming request.
+type chatCompletionChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Type     string `json:"type"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"`
+}
+
+func NewChatCompletionsClient(conf *config.Config) (*ChatCompletionsClient, error) {
+	assistant, err := loadAssistantDefinition(conf, Tools)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChatCompletionsClient{
+		apiClient: newApiClient(conf),
+		assistant: assistant,
+		threads:   map[string][]chatMessage{},
+	}, nil
+}
+
+// Model returns the model used for chat.
+func (c *ChatCompletionsClient) Model() string {
+	return c.assistant.model(c.config)
+}
+
+// CreateThread creates a new, empty, local thread and returns its ID.
+func (c *ChatCompletionsClient) CreateThread() (string, error) {
+	threadID := uuid.New().String()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.threads[threadID] = []chatMessage{}
+
+	debug.Log("[gpt] [chat] Thread created: %s", threadID)
+	return threadID, nil
+}
+
+// ResumeThread recreates a local thread from the conversation's messages.
+// The tools called while writing each response are restored with their
+// outputs, ahead of the response's text. The conversation does not record
+// the calls' IDs, or where they fell within the text, so each is given a new
+// ID and they are all restored as if requested at once.
+func (c *ChatCompletionsClient) ResumeThread(threadID string, history []messages.Message) error {
+	debug.Log("[gpt] [chat] Resuming thread %s with %d messages", threadID, len(history))
+
+	thread := []chatMessage{}
+	calls := 0
+
+	for _, msg := range history {
+		switch msg.From {
+		case messages.You:
+			thread = append(thread, chatMessage{Role: "user", Content: msg.Content})
+		case messages.Assistant:
+			if len(msg.ToolCalls) > 0 {
+				request := chatMessage{Role: "assistant"}
+				var outputs []chatMessage
+
+				for _, call := range msg.ToolCalls {
+					calls++
+
+					restored := chatToolCall{ID: fmt.Sprintf("call_restored_%d", calls), Type: "function"}
+					restored.Function.Name = call.Name
+					restored.Function.Arguments = call.Arguments
+
+					request.ToolCalls = append(request.ToolCalls, restored)
+					outputs = append(outputs, chatMessage{Role: "tool", Content: call.Output, ToolCallID: restored.ID})
+				}
+
+				thread = append(thread, request)
+				thread = append(thread, outputs...)
+			}
+
+			// A response that failed before any text arrived has no
+			// text to restore
+			if msg.Content == "" {
+				continue
+			}
+
+			thread = append(thread, chatMessage{Role: "assistant", Content: msg.Content})
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.threads[threadID] = thread
+
+	return nil
+}
+
+// AddMessage adds a user message to a local thread.
+func (c *ChatCompletionsClient) AddMessage(threadID string, content string) error {
+	debug.Log("[gpt] [chat] Adding message to thread %s: %.100s", threadID, content)
+	return c.appendMessages(threadID, chatMessage{Role: "user", Content: content})
+}
+
+func (c *ChatCompletionsClient) appendMessages(threadID string, msgs ...chatMessage) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	history, ok := c.threads[threadID]
+	if !ok {
+		return fmt.Errorf("thread not found: %s", threadID)
+	}
+
+	c.threads[threadID] = append(history, msgs...)
+	return nil
+}
+
+func (c *ChatCompletionsClient) getMessages(threadID string) []chatMessage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	msgs := []chatMessage{{Role: "system", Content: c.assistant.Instructions}}
+	return append(msgs, c.threads[threadID]...)
+}
+
+// RunThread requests a completion for the thread's message history, streaming
+// the response to events. Tool calls requested by the model are
+// executed and their outputs are sent back to the model until it produces a
+// final response. The assistant's messages are added to the thread's history
+// as they are received, just as the Assistants API would do.
+func (c *ChatCompletionsClient) RunThread(ctx context.Context, threadID string, events chan<- Event) {
+	debug.Log("[gpt] [chat] Running thread %s", threadID)
+
+	s := &streamer{
+		done:   false,
+		events: events,
+		tools:  c.assistant.registry,
+	}
+
+	s.send(Event{Type: EventRunStarted})
+
+	for !s.done {
+		msg, err := c.streamCompletion(ctx, threadID, s)
+
+		// If cancelled, keep whatever was received so that the history
+		// matches what the user saw. Incomplete tool calls are dropped, since
+		// they will never have outputs.
+		if ctx.Err() != nil {
+			if msg.Content != "" {
+				c.appendMessages(threadID, chatMessage{Role: "assistant", Content: msg.Content})
+			}
+
+			break
+		}
+
+		if err != nil {
+			s.fail("Error requesting completion: %s", err)
+			return
+		}
+
+		if err := c.appendMessages(threadID, msg); err != nil {
+			s.fail("Error updating thread: %s", err)
+			return
+		}
+
+		// No tool calls means the response is complete
+		if len(msg.ToolCalls) == 0 {
+			break
+		}
+
+		var calls []toolCall
+		for _, call := range msg.ToolCalls {
+			calls = append(calls, toolCall{
+				ID:        call.ID,
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+			})
+		}
+
+		s.runToolCalls(ctx, calls)
+
+		var outputs []chatMessage
+		for _, output := range s.toolCallOutputs {
+			outputs = append(outputs, chatMessage{
+				Role:       "tool",
+				Content:    output.Output,
+				ToolCallID: output.ToolCallID,
+			})
+		}
+
+		// Clear tool call outputs so that they do not get re-submitted if the
+		// model requests further tool outputs.
+		s.toolCallOutputs = nil
+
+		if err := c.appendMessages(threadID, outputs...); err != nil {
+			s.fail("Error updating thread: %s", err)
+			return
+		}
+	}
+
+	s.finish()
+}
+
+// streamCompletion performs a single streaming completion request, sending
+// content deltas to the streamer as they arrive. It returns the complete
+// assistant message, including any tool calls requested by the model.
+func (c *ChatCompletionsClient) streamCompletion(ctx context.Context, threadID string, s *streamer) (chatMessage, error) {
+	msg := chatMessage{Role: "assistant"}
+
+	body := chatCompletionRequest{
+		Model:    c.assistant.model(c.config),
+		Messages: c.getMessages(threadID),
+		Tools:    c.assistant.registry.Definitions(),
+		Stream:   true,
+	}
+
+	// Ask for a final chunk reporting the response's token usage
+	body.StreamOptions.IncludeUsage = true
+
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return msg, fmt.Errorf("body could not be serialized as json: %v", err)
+	}
+
+	stream, err := c.stream(ctx, "POST", c.apiUri(completionsApiPath), jsonBody)
+	if err != nil {
+		return msg, err
+	}
+
+	defer stream.Close()
+
+	var content strings.Builder
+	toolCalls := map[int]*chatToolCall{}
+
+	reader := newSSEReader(stream)
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			msg.Content = content.String()
+			return msg, fmt.Errorf("error reading completion stream: %w", err)
+		}
+
+		if event.Data == "[DONE]" {
+			break
+		}
+
+		var chunk chatCompletionChunk
+		if err := json.Unmarshal([]byte(event.Data), &chunk); err != nil {
+			return msg, fmt.Errorf("error unmarshalling completion chunk: %v", err)
+		}
+
+		if chunk.Usage != nil {
+			s.send(Event{Type: EventUsage, Usage: chunk.Usage})
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				content.WriteString(choice.Delta.Content)
+				s.sendText(choice.Delta.Content)
+			}
+
+			// Tool calls are streamed in fragments, identified by their
+			// index. The first fragment carries the ID and name; the rest
+			// carry pieces of the arguments.
+			for _, delta := range choice.Delta.ToolCalls {
+				toolCall, ok := toolCalls[delta.Index]
+				if !ok {
+					toolCall = &chatToolCall{Type: "function"}
+					toolCalls[delta.Index] = toolCall
+				}
+
+				if delta.ID != "" {
+					toolCall.ID = delta.ID
+				}
+
+				toolCall.Function.Name += delta.Function.Name
+				toolCall.Function.Arguments += delta.Function.Arguments
+			}
+		}
+	}
+
+	msg.Content = content.String()
+
+	indexes := make([]int, 0, len(toolCalls))
+	for idx := range toolCalls {
+		indexes = append(indexes, idx)
+	}
+
+	sort.Ints(indexes)
+
+	for _, idx := range indexes {
+		msg.ToolCalls = append(msg.ToolCalls, *toolCalls[idx])
+	}
+
+	return msg, nil
+}
+
+// CancelRun is a no-op for this backend. Completions are generated only while
+// the request is open, so cancelling RunThread's context is sufficient.
+func (c *ChatCompletionsClient) CancelRun(threadID string) error {
+	return nil
+}
@@ -4,13 +4,38 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"strings"
+
+	"github.com/sysread/fnord/pkg/config"
 )
 
-const apiBaseUri = "https://api.openai.com/v1"
+// apiClient holds the configuration and HTTP client shared by each of the API
+// backends.
+type apiClient struct {
+	config *config.Config
+	http   *http.Client
+
+	// Headers required by the backend, sent with every request
+	headers map[string]string
+}
+
+func newApiClient(conf *config.Config) *apiClient {
+	return &apiClient{
+		config:  conf,
+		http:    &http.Client{},
+		headers: map[string]string{},
+	}
+}
+
+// apiUri returns the full URI for an API path (e.g. "/threads"), relative to
+// the configured API base URL.
+func (c *apiClient) apiUri(path string) string {
+	return strings.TrimRight(c.config.APIBaseURL, "/") + path
+}
 
 // makeRequest creates an HTTP request with the given method, URI, body, and
 // headers.
-func (c *OpenAIClient) makeRequest(method string, uri string, body []byte, headers map[string]string) (*http.Request, error) {
+func (c *apiClient) makeRequest(method string, uri string, body []byte, headers map[string]string) (*http.Request, error) {
 	req, err := http.NewRequest(method, uri, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
@@ -18,8 +43,29 @@ func (c *OpenAIClient) makeRequest(method string, uri string, body []byte, heade
 
 	// Set common headers
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.config.OpenAIApiKey)
-	req.Header.Set("OpenAI-Beta", "assistants=v2")
+
+	// Local servers often do not require an API key
+	if c.config.OpenAIApiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.OpenAIApiKey)
+	}
+
+	if c.config.OpenAIOrganization != "" {
+		req.Header.Set("OpenAI-Organization", c.config.OpenAIOrganization)
+	}
+
+	if c.config.OpenAIProject != "" {
+		req.Header.Set("OpenAI-Project", c.config.OpenAIProject)
+	}
+
+	// Set backend headers
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
+
+	// Set configured headers
+	for key, value := range c.config.APIHeaders {
+		req.Header.Set(key, value)
+	}
 
 	// Set user headers
 	for key, value := range headers {
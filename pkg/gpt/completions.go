@@ -1,13 +1,12 @@
 package gpt
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
 )
 
-const completionsApiUri = apiBaseUri + "/chat/completions"
-const completionModel = "gpt-4o-mini"
+const completionsApiPath = "/chat/completions"
 
 type completionMessage struct {
 	Role    string `json:"role"`
@@ -27,12 +26,12 @@ type completionResponse struct {
 	} `json:"choices"`
 }
 
-func (c *OpenAIClient) GetCompletion(systemPrompt string, userPrompt string) (string, error) {
-	endpoint := completionsApiUri
+func (c *apiClient) GetCompletion(systemPrompt string, userPrompt string) (string, error) {
+	endpoint := c.apiUri(completionsApiPath)
 
 	// Build the request body
 	body := completionRequest{
-		Model:    completionModel,
+		Model: c.config.CompletionModel,
 		Messages: []completionMessage{
 			{Role: "system", Content: systemPrompt},
 			{Role: "user", Content: userPrompt},
@@ -44,32 +43,23 @@ func (c *OpenAIClient) GetCompletion(systemPrompt string, userPrompt string) (st
 		return "", fmt.Errorf("body could not be serialized as json: %v", err)
 	}
 
-	// Build a request to get the completion
-	req, err := c.makeRequest("POST", endpoint, jsonBody, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
-	}
-
 	// Perform the request
-	resp, err := c.http.Do(req)
+	respBody, err := c.request(context.Background(), "POST", endpoint, jsonBody)
 	if err != nil {
-		return "", fmt.Errorf("failed to make request: %v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, resp.Status)
+		return "", err
 	}
 
-	// Ensure the response body is closed
-	defer resp.Body.Close()
-
-	// Read and parse the body of the response. We only care about the completion
+	// Parse the body of the response. We only care about the completion
 	// "content" field.
 	var response completionResponse
-	err = json.NewDecoder(resp.Body).Decode(&response)
+	err = json.Unmarshal(respBody, &response)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse response body: %v", err)
 	}
 
+	if len(response.Choices) == 0 {
+		return "", fmt.Errorf("response did not contain any choices")
+	}
+
 	return response.Choices[0].Message.Content, nil
 }
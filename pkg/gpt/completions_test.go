@@ -0,0 +1,55 @@
+package gpt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/config"
+)
+
+func TestGetCompletion(t *testing.T) {
+	var received completionRequest
+	var headers http.Header
+	var path string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		headers = r.Header.Clone()
+
+		err := json.NewDecoder(r.Body).Decode(&received)
+		assert.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices": [{"message": {"content": "pong"}}]}`))
+	}))
+
+	defer server.Close()
+
+	client := newApiClient(&config.Config{
+		APIBaseURL:         server.URL + "/v1/",
+		CompletionModel:    "local-model",
+		OpenAIOrganization: "org-123",
+		APIHeaders:         map[string]string{"X-Proxy-Token": "secret"},
+	})
+
+	content, err := client.GetCompletion("system prompt", "ping")
+	assert.NoError(t, err)
+	assert.Equal(t, "pong", content)
+
+	assert.Equal(t, "/v1/chat/completions", path)
+	assert.Equal(t, "local-model", received.Model)
+	assert.Len(t, received.Messages, 2)
+	assert.Equal(t, "ping", received.Messages[1].Content)
+
+	assert.Equal(t, "org-123", headers.Get("OpenAI-Organization"))
+	assert.Equal(t, "secret", headers.Get("X-Proxy-Token"))
+
+	// No API key is configured, and only the Assistants API needs the beta
+	// header.
+	assert.Empty(t, headers.Get("Authorization"))
+	assert.Empty(t, headers.Get("OpenAI-Beta"))
+}
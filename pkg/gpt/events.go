@@ -0,0 +1,103 @@
+package gpt
+
+import (
+	"fmt"
+)
+
+// EventType identifies the kind of an Event.
+type EventType string
+
+const (
+	// EventRunStarted is sent when the backend has started generating a
+	// response. RunID identifies the run, if the backend has run IDs.
+	EventRunStarted EventType = "run_started"
+
+	// EventTextDelta carries the next chunk of the assistant's response text.
+	EventTextDelta EventType = "text_delta"
+
+	// EventToolStarted is sent when the assistant has requested a tool call,
+	// before the tool is executed.
+	EventToolStarted EventType = "tool_started"
+
+	// EventToolFinished is sent with the tool's output once it completes.
+	EventToolFinished EventType = "tool_finished"
+
+	// EventUsage reports the number of tokens used by the response.
+	EventUsage EventType = "usage"
+
+	// EventError reports an error that ended the response.
+	EventError EventType = "error"
+
+	// EventDone is always the last event sent before the channel is closed.
+	EventDone EventType = "done"
+)
+
+// Event is sent by Client.RunThread to report the progress of the assistant's
+// response.
+type Event struct {
+	Type  EventType  `json:"type"`
+	RunID string     `json:"run_id,omitempty"`
+	Text  string     `json:"text,omitempty"`
+	Tool  *ToolEvent `json:"tool,omitempty"`
+	Usage *Usage     `json:"usage,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// ToolEvent describes a tool call requested by the assistant.
+type ToolEvent struct {
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+
+	// A human-readable description of what the tool is doing
+	Status string `json:"status"`
+
+	// Set once the tool has finished
+	Output string `json:"output,omitempty"`
+	Failed bool   `json:"failed,omitempty"`
+
+	// Tool calls requested together run concurrently. Total is the number of
+	// calls in the batch and, once this call has finished, Done is the
+	// number of calls in the batch that have finished so far.
+	Total int `json:"total"`
+	Done  int `json:"done,omitempty"`
+}
+
+// Progress describes how many of the tool calls in the batch have finished,
+// e.g. "2/4 tools done".
+func (t *ToolEvent) Progress() string {
+	return fmt.Sprintf("%d/%d tools done", t.Done, t.Total)
+}
+
+// Usage reports the number of tokens used by a response.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// String returns a short description of the event, suitable for logging.
+func (e Event) String() string {
+	switch e.Type {
+	case EventRunStarted:
+		return fmt.Sprintf("%s %s", e.Type, e.RunID)
+
+	case EventTextDelta:
+		return fmt.Sprintf("%s (%d bytes)", e.Type, len(e.Text))
+
+	case EventToolStarted:
+		return fmt.Sprintf("%s %s %s", e.Type, e.Tool.Name, e.Tool.Arguments)
+
+	case EventToolFinished:
+		return fmt.Sprintf("%s %s (%d bytes, failed: %t)", e.Type, e.Tool.Name, len(e.Tool.Output), e.Tool.Failed)
+
+	case EventUsage:
+		return fmt.Sprintf("%s prompt=%d completion=%d total=%d", e.Type, e.Usage.PromptTokens, e.Usage.CompletionTokens, e.Usage.TotalTokens)
+
+	case EventError:
+		return fmt.Sprintf("%s %s", e.Type, e.Error)
+
+	default:
+		return string(e.Type)
+	}
+}
@@ -1,34 +1,91 @@
 package gpt
 
 import (
-	"net/http"
+	"context"
+	"errors"
+	"sync"
 
 	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/messages"
 )
 
+// ErrThreadNotFound is returned by ResumeThread when the thread no longer
+// exists on the server, for example because it has expired.
+var ErrThreadNotFound = errors.New("thread not found")
+
+// Client is the interface implemented by each of the supported API backends.
+// A "thread" is a conversation with the assistant. Depending on the backend,
+// the thread's message history may be stored remotely (as with the Assistants
+// API) or locally (as with the Chat Completions API).
 type Client interface {
 	GetCompletion(systemPrompt string, userPrompt string) (string, error)
-	GetEmbedding(text string) ([]float32, error)
 	CreateThread() (string, error)
 	AddMessage(threadID string, content string) error
-	RunThread(threadID string) (chan string, error)
+
+	// ResumeThread prepares a previously created thread to continue the
+	// conversation, given the conversation's messages so far. Backends that
+	// store threads remotely return ErrThreadNotFound if the thread no
+	// longer exists.
+	ResumeThread(threadID string, history []messages.Message) error
+
+	// RunThread streams events describing the assistant's response, ending
+	// with an EventDone, after which the channel is closed. The response
+	// stops early if ctx is cancelled.
+	RunThread(ctx context.Context, threadID string, events chan<- Event)
+
+	// Model returns the name of the model used for chat.
+	Model() string
+
+	// CancelRun stops the assistant from generating the thread's current
+	// response on the server, if the backend supports it.
+	CancelRun(threadID string) error
 }
 
+// OpenAIClient is the Client backend for OpenAI's Assistants API.
 type OpenAIClient struct {
-	config *config.Config
-	http   *http.Client
+	*apiClient
+
+	assistant *assistantDefinition
+
+	// The ID of the assistant, found or created by initAssistant
+	assistantID string
+
+	// The active run of each thread, so that it may be cancelled. A thread
+	// whose run is being created, but whose ID is not yet known, maps to "".
+	mutex sync.Mutex
+	runs  map[string]string
 }
 
-func NewOpenAIClient(conf *config.Config) *OpenAIClient {
-	c := &OpenAIClient{
-		config: conf,
-		http:   &http.Client{},
+// NewClient returns a Client for the backend selected in the configuration.
+// It fails if the box's persona cannot be loaded or, for backends that store
+// the assistant remotely, the assistant cannot be set up.
+func NewClient(conf *config.Config) (Client, error) {
+	switch conf.Backend {
+	case config.BackendChat:
+		return NewChatCompletionsClient(conf)
+	default:
+		return NewOpenAIClient(conf)
 	}
+}
 
-	err := c.initAssistant()
+func NewOpenAIClient(conf *config.Config) (*OpenAIClient, error) {
+	assistant, err := loadAssistantDefinition(conf, Tools)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	c := &OpenAIClient{
+		apiClient: newApiClient(conf),
+		assistant: assistant,
+		runs:      map[string]string{},
+	}
+
+	// The Assistants API requires the version to be selected with a header
+	c.headers["OpenAI-Beta"] = "assistants=v2"
+
+	if err := c.initAssistant(); err != nil {
+		return nil, err
 	}
 
-	return c
+	return c, nil
 }
@@ -0,0 +1,132 @@
+package gpt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/debug"
+	"github.com/sysread/fnord/pkg/mcp"
+)
+
+// Characters not allowed in tool names by the API
+var invalidToolNameRe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// MCPTool is a Tool provided by an MCP server. Its name is prefixed with the
+// server's name to avoid collisions with the built-in tools and with tools
+// of the same name on other servers.
+type MCPTool struct {
+	server *mcp.Client
+	tool   mcp.Tool
+	name   string
+}
+
+func NewMCPTool(server *mcp.Client, tool mcp.Tool) *MCPTool {
+	name := invalidToolNameRe.ReplaceAllString(server.Name+"__"+tool.Name, "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return &MCPTool{
+		server: server,
+		tool:   tool,
+		name:   name,
+	}
+}
+
+func (t *MCPTool) Name() string {
+	return t.name
+}
+
+func (t *MCPTool) Description() string {
+	return t.tool.Description
+}
+
+func (t *MCPTool) Parameters() json.RawMessage {
+	if len(t.tool.InputSchema) == 0 {
+		return json.RawMessage(`{"type": "object", "properties": {}}`)
+	}
+
+	return t.tool.InputSchema
+}
+
+// DefaultPolicy requires the user's approval for MCP tools, since fnord
+// cannot know what they do.
+func (t *MCPTool) DefaultPolicy() string {
+	return config.ToolPolicyAsk
+}
+
+func (t *MCPTool) StatusLine() string {
+	return fmt.Sprintf("Calling %s on %s...", t.tool.Name, t.server.Name)
+}
+
+// Call calls the tool on its server. If the server has crashed, the call
+// fails with the reason it exited.
+func (t *MCPTool) Call(ctx context.Context, argsJSON string) (string, error) {
+	debug.Log("[gpt] [%s] %s", t.name, argsJSON)
+	return t.server.CallTool(ctx, t.tool.Name, json.RawMessage(argsJSON))
+}
+
+// StartMCPServers starts the MCP servers listed in FNORD_HOME/mcp.json and
+// adds their tools to the registry. A server that fails to start is logged
+// and skipped, so that one broken server does not prevent fnord from
+// starting. The caller is responsible for closing the returned servers.
+func StartMCPServers(conf *config.Config, registry *ToolRegistry) ([]*mcp.Client, error) {
+	servers, err := mcp.LoadConfig(conf.Home)
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers are started in order of name, so that their tools are always
+	// registered in the same order and the assistant's definition does not
+	// change between runs.
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var clients []*mcp.Client
+
+	for _, name := range names {
+		client, err := startMCPServer(name, servers[name], registry)
+		if err != nil {
+			debug.Log("[mcp] [%s] %s", name, err)
+			continue
+		}
+
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+func startMCPServer(name string, conf mcp.ServerConfig, registry *ToolRegistry) (*mcp.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mcp.DefaultStartTimeout)
+	defer cancel()
+
+	client, err := mcp.Start(ctx, name, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	tools, err := client.ListTools(ctx)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error listing tools: %w", err)
+	}
+
+	for _, tool := range tools {
+		if err := registry.Register(NewMCPTool(client, tool)); err != nil {
+			debug.Log("[mcp] [%s] skipping tool %s: %s", name, tool.Name, err)
+		}
+	}
+
+	debug.Log("[mcp] [%s] started with %d tools", name, len(tools))
+
+	return client, nil
+}
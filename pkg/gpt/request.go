@@ -0,0 +1,341 @@
+package gpt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sysread/fnord/pkg/debug"
+)
+
+// Bounds for the delay between retries. The actual delay is randomized
+// ("jittered") between zero and an exponentially increasing cap, so that
+// concurrent clients do not retry in lockstep. A longer delay asked for by
+// the server is also capped at retryMaxDelay.
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// APIError is returned when the API responds with an error status. The
+// message is taken from the API's error response, when available.
+type APIError struct {
+	StatusCode int
+	Status     string
+	Type       string
+	Code       string
+	Message    string
+
+	// RetryAfter is how long the API asked us to wait before retrying, if it
+	// said.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = e.Status
+	}
+
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("API error %d: %s (retry after %s)", e.StatusCode, msg, e.RetryAfter)
+	}
+
+	return fmt.Sprintf("API error %d: %s", e.StatusCode, msg)
+}
+
+// IsRateLimit returns true if the request was refused due to rate limiting.
+func (e *APIError) IsRateLimit() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// IsRetryable returns true if the error is transient and the same request
+// might succeed if retried.
+func (e *APIError) IsRetryable() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests:
+		// Exceeding your quota is not going to resolve itself in a few seconds
+		return e.Code != "insufficient_quota"
+
+	case http.StatusRequestTimeout,
+		http.StatusConflict,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// RequestError is returned when a request could not be completed at all, such
+// as when the network is down or the request timed out, after all retries
+// have been exhausted.
+type RequestError struct {
+	Method   string
+	URI      string
+	Attempts int
+	Err      error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s %s failed after %d attempt(s): %v", e.Method, e.URI, e.Attempts, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// request performs a non-streaming API request and returns the response body.
+// Transient failures are retried, and each attempt is subject to the
+// configured request timeout.
+func (c *apiClient) request(ctx context.Context, method string, uri string, body []byte) ([]byte, error) {
+	var respBody []byte
+
+	err := c.withRetries(ctx, method, uri, func(ctx context.Context) error {
+		ctx, cancel := c.withTimeout(ctx)
+		defer cancel()
+
+		resp, err := c.send(ctx, method, uri, body)
+		if err != nil {
+			return err
+		}
+
+		defer resp.Body.Close()
+
+		respBody, err = io.ReadAll(resp.Body)
+		return err
+	})
+
+	return respBody, err
+}
+
+// stream performs a streaming API request and returns the response body, which
+// the caller must close. Transient failures are retried until the response
+// headers have been received. The request timeout applies only to receiving
+// the headers, since a streaming response may take much longer to complete.
+func (c *apiClient) stream(ctx context.Context, method string, uri string, body []byte) (io.ReadCloser, error) {
+	var respBody io.ReadCloser
+
+	err := c.withRetries(ctx, method, uri, func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+
+		timer := time.AfterFunc(c.requestTimeout(), cancel)
+		defer timer.Stop()
+
+		resp, err := c.send(ctx, method, uri, body)
+		if err != nil {
+			cancel()
+			return err
+		}
+
+		if !timer.Stop() {
+			// The timer fired just as the headers arrived
+			resp.Body.Close()
+			cancel()
+			return context.DeadlineExceeded
+		}
+
+		respBody = &cancelingReadCloser{ReadCloser: resp.Body, cancel: cancel}
+		return nil
+	})
+
+	return respBody, err
+}
+
+// send performs a single attempt of a request, returning an *APIError if the
+// response status is not a success.
+func (c *apiClient) send(ctx context.Context, method string, uri string, body []byte) (*http.Response, error) {
+	req, err := c.makeRequest(method, uri, body, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, newAPIError(resp)
+	}
+
+	return resp, nil
+}
+
+// withRetries calls attempt until it succeeds, fails with an error that is not
+// transient, or the maximum number of retries is reached. Requests that are
+// not idempotent, like creating a message or a run, are only retried when
+// the failure proves that the server did not act on them (see wasNotSent).
+func (c *apiClient) withRetries(ctx context.Context, method string, uri string, attempt func(context.Context) error) error {
+	maxAttempts := c.config.APIMaxRetries + 1
+
+	for i := 1; ; i++ {
+		err := attempt(ctx)
+		if err == nil {
+			return nil
+		}
+
+		// The caller gave up; do not retry
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var apiErr *APIError
+		isAPIError := errors.As(err, &apiErr)
+
+		if isAPIError && !apiErr.IsRetryable() {
+			return apiErr
+		}
+
+		retry := i < maxAttempts
+		if method == http.MethodPost && !wasNotSent(err) {
+			retry = false
+		}
+
+		if !retry {
+			if isAPIError {
+				return apiErr
+			}
+
+			return &RequestError{Method: method, URI: uri, Attempts: i, Err: err}
+		}
+
+		delay := backoff(i)
+		if isAPIError && apiErr.RetryAfter > delay {
+			delay = min(apiErr.RetryAfter, retryMaxDelay)
+		}
+
+		debug.Log("[gpt] %s %s failed (attempt %d of %d); retrying in %s: %v", method, uri, i, maxAttempts, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *apiClient) requestTimeout() time.Duration {
+	if c.config.APITimeout <= 0 {
+		return 60 * time.Second
+	}
+
+	return c.config.APITimeout
+}
+
+func (c *apiClient) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, c.requestTimeout())
+}
+
+// wasNotSent returns true if err shows that the server did not process the
+// request: it was rate limited, or the connection failed before any of the
+// request was sent.
+func wasNotSent(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.IsRateLimit()
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// backoff returns a randomized delay before the given retry attempt.
+func backoff(attempt int) time.Duration {
+	ceiling := retryBaseDelay << (attempt - 1)
+	if ceiling <= 0 || ceiling > retryMaxDelay {
+		ceiling = retryMaxDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling))) + retryBaseDelay
+}
+
+// newAPIError builds an APIError from an error response, including the
+// message from the response body and any rate limiting headers.
+func newAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: retryAfter(resp.StatusCode, resp.Header),
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+
+	var errResp struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    any    `json:"code"`
+		} `json:"error"`
+	}
+
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error.Message != "" {
+		apiErr.Message = errResp.Error.Message
+		apiErr.Type = errResp.Error.Type
+		if errResp.Error.Code != nil {
+			apiErr.Code = fmt.Sprint(errResp.Error.Code)
+		}
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+
+	return apiErr
+}
+
+// retryAfter determines how long the server asked us to wait before retrying,
+// using the standard Retry-After header or, when rate limited, OpenAI's rate
+// limit headers. The rate limit headers are sent with every response, so
+// they say nothing about when to retry after other errors.
+func retryAfter(status int, header http.Header) time.Duration {
+	if ms, err := strconv.Atoi(header.Get("Retry-After-Ms")); err == nil {
+		return time.Duration(ms) * time.Millisecond
+	}
+
+	if value := header.Get("Retry-After"); value != "" {
+		if secs, err := strconv.Atoi(value); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+
+		if at, err := http.ParseTime(value); err == nil {
+			return time.Until(at)
+		}
+	}
+
+	if status != http.StatusTooManyRequests {
+		return 0
+	}
+
+	// OpenAI reports when each rate limit resets as a duration, like "6m0s".
+	// We need to wait for whichever limit resets last.
+	var wait time.Duration
+	for _, name := range []string{"X-Ratelimit-Reset-Requests", "X-Ratelimit-Reset-Tokens"} {
+		if d, err := time.ParseDuration(header.Get(name)); err == nil && d > wait {
+			wait = d
+		}
+	}
+
+	return wait
+}
+
+// cancelingReadCloser releases a streaming request's context when its body is
+// closed.
+type cancelingReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReadCloser) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,126 @@
+package gpt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/config"
+)
+
+func TestRequestRetriesTransientErrors(t *testing.T) {
+	attempts := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+
+		if attempts == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error": {"message": "Rate limit reached", "type": "requests", "code": "rate_limit_exceeded"}}`))
+			return
+		}
+
+		w.Write([]byte(`{"id": "thread_abc"}`))
+	}))
+
+	defer server.Close()
+
+	client := newApiClient(&config.Config{APIBaseURL: server.URL, APIMaxRetries: 2})
+
+	body, err := client.request(context.Background(), "POST", client.apiUri("/threads"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id": "thread_abc"}`, string(body))
+	assert.Equal(t, 2, attempts)
+}
+
+func TestRequestDoesNotRetryClientErrors(t *testing.T) {
+	attempts := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": {"message": "Invalid thread", "type": "invalid_request_error"}}`))
+	}))
+
+	defer server.Close()
+
+	client := newApiClient(&config.Config{APIBaseURL: server.URL, APIMaxRetries: 2})
+
+	_, err := client.request(context.Background(), "POST", client.apiUri("/threads"), nil)
+	assert.Equal(t, 1, attempts)
+
+	var apiErr *APIError
+	assert.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Equal(t, "Invalid thread", apiErr.Message)
+	assert.False(t, apiErr.IsRetryable())
+}
+
+func TestRequestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+
+	defer server.Close()
+
+	client := newApiClient(&config.Config{APIBaseURL: server.URL, APITimeout: 10 * time.Millisecond})
+
+	_, err := client.request(context.Background(), "GET", client.apiUri("/assistants"), nil)
+
+	var reqErr *RequestError
+	assert.ErrorAs(t, err, &reqErr)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRequestDoesNotRetryProcessedPosts(t *testing.T) {
+	attempts := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	defer server.Close()
+
+	client := newApiClient(&config.Config{APIBaseURL: server.URL, APIMaxRetries: 2})
+
+	// The server may have created the message before failing
+	_, err := client.request(context.Background(), "POST", client.apiUri("/threads/thread_abc/messages"), nil)
+	assert.Equal(t, 1, attempts)
+
+	var apiErr *APIError
+	assert.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusInternalServerError, apiErr.StatusCode)
+
+	// Reading is safe to retry
+	attempts = 0
+	_, err = client.request(context.Background(), "GET", client.apiUri("/threads/thread_abc"), nil)
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRetryAfter(t *testing.T) {
+	header := http.Header{}
+	assert.Equal(t, time.Duration(0), retryAfter(http.StatusTooManyRequests, header))
+
+	header.Set("X-Ratelimit-Reset-Requests", "1s")
+	header.Set("X-Ratelimit-Reset-Tokens", "6m0s")
+	assert.Equal(t, 6*time.Minute, retryAfter(http.StatusTooManyRequests, header))
+
+	// The rate limit headers are sent with every response
+	assert.Equal(t, time.Duration(0), retryAfter(http.StatusInternalServerError, header))
+
+	header.Set("Retry-After", "20")
+	assert.Equal(t, 20*time.Second, retryAfter(http.StatusTooManyRequests, header))
+
+	header.Set("Retry-After-Ms", "150")
+	assert.Equal(t, 150*time.Millisecond, retryAfter(http.StatusTooManyRequests, header))
+}
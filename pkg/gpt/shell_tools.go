@@ -0,0 +1,344 @@
+package gpt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/debug"
+)
+
+// ShellToolsDir is the directory, relative to FNORD_HOME, containing the
+// definitions of user-defined shell tools. Each tool is defined in its own
+// .json file.
+const ShellToolsDir = "tools"
+
+// How long to wait for a command's output once it has been killed, after
+// which its pipes are closed, even if processes it started hold them open
+const shellToolWaitDelay = 5 * time.Second
+
+// DefaultShellToolMaxOutput limits how much of a shell tool's output is sent
+// to the assistant, unless the tool specifies its own limit.
+const DefaultShellToolMaxOutput = 64 * 1024
+
+// The API's restrictions on function names
+var toolNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// ShellTool is a Tool that runs a command defined by the user. For example,
+// FNORD_HOME/tools/lint.json might contain:
+//
+//	{
+//	  "name": "lint",
+//	  "description": "Runs the linter on a package and reports any problems",
+//	  "parameters": {
+//	    "type": "object",
+//	    "properties": {
+//	      "package": {"type": "string", "description": "The package to lint"}
+//	    },
+//	    "required": ["package"]
+//	  },
+//	  "command": ["make", "lint", "PKG={{.package}}"],
+//	  "status": "Running the linter...",
+//	  "timeout": "5m"
+//	}
+//
+// Each element of the command is a text/template, rendered with the arguments
+// provided by the assistant. Parameters in the schema that the assistant omits
+// render as empty strings, so that optional parameters may be templated with
+// {{with}}, e.g. "{{with .path}}--path={{.}}{{end}}"; referring to a name that
+// is not a parameter is an error. Note that an element that renders empty is
+// still passed to the command, as an empty argument. The command is executed
+// directly, without a shell, so arguments cannot inject additional commands.
+// The arguments are also available to the command as JSON on stdin and in the
+// FNORD_ARGS environment variable, and individually as FNORD_ARG_<NAME>
+// environment variables. Scripts that need a shell should read their arguments
+// from the environment rather than templating them into the script.
+//
+// Because shell tools may do anything, the user is asked to approve each
+// call, unless the tool's "policy" is set to "allow" (or "deny"), or a policy
+// for the tool is configured with --tool-policy.
+//
+// The command runs in the project directory, if one is selected, unless the
+// tool specifies its own working directory. Its combined stdout and stderr
+// are returned as the tool's output, truncated to max_output_bytes. Where
+// the platform allows, the command runs in its own process group, all of
+// which is killed if the call times out or is cancelled.
+type ShellTool struct {
+	ToolName        string          `json:"name"`
+	ToolDescription string          `json:"description"`
+	Schema          json.RawMessage `json:"parameters"`
+	Command         []string        `json:"command"`
+	WorkingDir      string          `json:"working_dir"`
+	Status          string          `json:"status"`
+	TimeLimit       string          `json:"timeout"`
+	MaxOutputBytes  int             `json:"max_output_bytes"`
+	Policy          string          `json:"policy"`
+
+	timeout    time.Duration
+	templates  []*template.Template
+	properties []string
+}
+
+func (t *ShellTool) Name() string                { return t.ToolName }
+func (t *ShellTool) Description() string         { return t.ToolDescription }
+func (t *ShellTool) Parameters() json.RawMessage { return t.Schema }
+func (t *ShellTool) Timeout() time.Duration      { return t.timeout }
+func (t *ShellTool) DefaultPolicy() string       { return t.Policy }
+
+func (t *ShellTool) StatusLine() string {
+	if t.Status == "" {
+		return "Running " + t.ToolName + "..."
+	}
+
+	return t.Status
+}
+
+// LoadShellTools reads the shell tool definitions in FNORD_HOME/tools. The
+// working directory of each tool defaults to the selected project.
+func LoadShellTools(conf *config.Config) ([]*ShellTool, error) {
+	dir := filepath.Join(conf.Home, ShellToolsDir)
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var tools []*ShellTool
+
+	for _, path := range paths {
+		tool, err := loadShellTool(path, conf.ProjectPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tool definition in %s: %w", path, err)
+		}
+
+		debug.Log("[gpt] [tools] loaded shell tool %s from %s", tool.ToolName, path)
+		tools = append(tools, tool)
+	}
+
+	return tools, nil
+}
+
+// RegisterShellTools loads the user's shell tools and adds them to the
+// registry.
+func RegisterShellTools(conf *config.Config, registry *ToolRegistry) error {
+	tools, err := LoadShellTools(conf)
+	if err != nil {
+		return err
+	}
+
+	for _, tool := range tools {
+		if err := registry.Register(tool); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadShellTool(path string, projectPath string) (*ShellTool, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tool ShellTool
+	if err := json.Unmarshal(buf, &tool); err != nil {
+		return nil, err
+	}
+
+	if !toolNameRe.MatchString(tool.ToolName) {
+		return nil, fmt.Errorf("name must be 1-64 letters, digits, underscores, or dashes: %q", tool.ToolName)
+	}
+
+	if len(tool.Command) == 0 {
+		return nil, fmt.Errorf("command is required")
+	}
+
+	// Tools that take no arguments may omit the schema
+	if len(tool.Schema) == 0 {
+		tool.Schema = json.RawMessage(`{"type": "object", "properties": {}}`)
+	}
+
+	var schema struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+
+	if err := json.Unmarshal(tool.Schema, &schema); err != nil {
+		return nil, fmt.Errorf("invalid parameters: %w", err)
+	}
+
+	for name := range schema.Properties {
+		tool.properties = append(tool.properties, name)
+	}
+
+	if tool.TimeLimit != "" {
+		tool.timeout, err = time.ParseDuration(tool.TimeLimit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+
+	switch tool.Policy {
+	case "":
+		tool.Policy = config.ToolPolicyAsk
+	case config.ToolPolicyAllow, config.ToolPolicyAsk, config.ToolPolicyDeny:
+	default:
+		return nil, fmt.Errorf("policy must be one of 'allow', 'ask', or 'deny': %q", tool.Policy)
+	}
+
+	if tool.MaxOutputBytes <= 0 {
+		tool.MaxOutputBytes = DefaultShellToolMaxOutput
+	}
+
+	// Relative working directories are relative to the project
+	if tool.WorkingDir == "" {
+		tool.WorkingDir = projectPath
+	} else if !filepath.IsAbs(tool.WorkingDir) && projectPath != "" {
+		tool.WorkingDir = filepath.Join(projectPath, tool.WorkingDir)
+	}
+
+	for i, arg := range tool.Command {
+		tmpl, err := template.New(fmt.Sprintf("command[%d]", i)).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command template: %w", err)
+		}
+
+		tool.templates = append(tool.templates, tmpl)
+	}
+
+	return &tool, nil
+}
+
+// Call runs the tool's command. If the command fails, its output is included
+// in the error so that the assistant can see what went wrong.
+func (t *ShellTool) Call(ctx context.Context, argsJSON string) (string, error) {
+	debug.Log("[gpt] [%s] %s", t.ToolName, argsJSON)
+
+	if strings.TrimSpace(argsJSON) == "" {
+		argsJSON = "{}"
+	}
+
+	var args map[string]interface{}
+	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
+		return "", fmt.Errorf("%s: error unmarshalling args: %s", t.ToolName, err)
+	}
+
+	// Render the command, with omitted parameters as empty strings
+	data := make(map[string]interface{}, len(args))
+	for _, name := range t.properties {
+		data[name] = ""
+	}
+
+	for name, value := range args {
+		data[name] = value
+	}
+
+	argv := make([]string, len(t.templates))
+	for i, tmpl := range t.templates {
+		var buf strings.Builder
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return "", fmt.Errorf("%s: error rendering command: %s", t.ToolName, err)
+		}
+
+		argv[i] = buf.String()
+	}
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = t.WorkingDir
+	cmd.Stdin = strings.NewReader(argsJSON)
+	cmd.Env = append(os.Environ(), shellToolEnv(argsJSON, args)...)
+
+	// Processes started by the command may outlive it, holding its output
+	// open, so the whole process group is killed, and the output is not
+	// waited for indefinitely.
+	killProcessGroup(cmd)
+	cmd.WaitDelay = shellToolWaitDelay
+
+	output := &limitedBuffer{limit: t.MaxOutputBytes}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err := cmd.Run()
+
+	result := output.String()
+	if output.truncated {
+		result += fmt.Sprintf("\n[output truncated to %d bytes]", t.MaxOutputBytes)
+	}
+
+	if err != nil {
+		debug.Log("[gpt] [%s] command failed: %s", t.ToolName, err)
+		return "", fmt.Errorf("%s: command failed (%s):\n%s", t.ToolName, err, result)
+	}
+
+	debug.Log("[gpt] [%s] returning %d bytes", t.ToolName, len(result))
+	return result, nil
+}
+
+// shellToolEnv returns the environment variables through which a shell tool
+// receives its arguments. String arguments are passed as-is; others are
+// passed as JSON.
+func shellToolEnv(argsJSON string, args map[string]interface{}) []string {
+	env := []string{"FNORD_ARGS=" + argsJSON}
+
+	for name, value := range args {
+		var str string
+
+		if s, ok := value.(string); ok {
+			str = s
+		} else {
+			buf, _ := json.Marshal(value)
+			str = string(buf)
+		}
+
+		env = append(env, "FNORD_ARG_"+envName(name)+"="+str)
+	}
+
+	return env
+}
+
+// envName converts an argument name to an environment variable name.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// limitedBuffer collects up to limit bytes, discarding the rest.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - b.buf.Len(); remaining < len(p) {
+		b.buf.Write(p[:max(remaining, 0)])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+
+	// Report the full write, so that the command is not killed by a broken
+	// pipe once the limit is reached.
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
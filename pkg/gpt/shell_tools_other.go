@@ -0,0 +1,9 @@
+//go:build !unix
+
+package gpt
+
+import "os/exec"
+
+// killProcessGroup does nothing where process groups are not supported. Only
+// the command itself is killed when its context is done.
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,150 @@
+package gpt
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/config"
+)
+
+func writeShellTool(t *testing.T, home string, name string, definition string) {
+	dir := filepath.Join(home, ShellToolsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), []byte(definition), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShellTools(t *testing.T) {
+	home := t.TempDir()
+	project := t.TempDir()
+
+	writeShellTool(t, home, "greet", `{
+		"name": "greet",
+		"description": "Greets someone",
+		"parameters": {
+			"type": "object",
+			"properties": {"name": {"type": "string"}, "times": {"type": "integer"}},
+			"required": ["name"]
+		},
+		"command": ["sh", "-c", "echo \"$1 $FNORD_ARG_NAME x$FNORD_ARG_TIMES in $(basename $PWD)\"; cat", "sh", "Hello,{{.name}}"]
+	}`)
+
+	writeShellTool(t, home, "noisy", `{
+		"name": "noisy",
+		"description": "Says too much",
+		"command": ["sh", "-c", "yes | head -c 1000"],
+		"max_output_bytes": 10
+	}`)
+
+	writeShellTool(t, home, "broken", `{
+		"name": "broken",
+		"description": "Always fails",
+		"command": ["sh", "-c", "echo oops >&2; exit 3"]
+	}`)
+
+	conf := &config.Config{Home: home, ProjectPath: project}
+
+	registry := NewToolRegistry()
+	assert.NoError(t, RegisterShellTools(conf, registry))
+	assert.Len(t, registry.List(), 3)
+
+	// Shell tools require approval by default
+	assert.Equal(t, config.ToolPolicyAsk, registry.Policy("greet"))
+	registry.SetPolicies(map[string]string{"*": config.ToolPolicyAllow})
+
+	// Arguments reach the command through the template, the environment,
+	// and stdin. Shell metacharacters in arguments are not interpreted.
+	output, failed := registry.Call(context.Background(), "greet", `{"name": "$(rm -rf /)", "times": 2}`)
+	assert.False(t, failed)
+	assert.Equal(t, "Hello,$(rm -rf /) $(rm -rf /) x2 in "+filepath.Base(project)+"\n"+`{"name": "$(rm -rf /)", "times": 2}`, output)
+
+	output, failed = registry.Call(context.Background(), "noisy", `{}`)
+	assert.False(t, failed)
+	assert.Equal(t, "y\ny\ny\ny\ny\n\n[output truncated to 10 bytes]", output)
+
+	output, failed = registry.Call(context.Background(), "broken", `{}`)
+	assert.True(t, failed)
+	assert.True(t, strings.HasPrefix(output, "Error: broken: command failed (exit status 3):\noops"), output)
+}
+
+func TestShellToolsInvalidDefinition(t *testing.T) {
+	home := t.TempDir()
+
+	writeShellTool(t, home, "bad", `{"name": "not a valid name", "command": ["true"]}`)
+
+	_, err := LoadShellTools(&config.Config{Home: home})
+	assert.ErrorContains(t, err, "name must be")
+
+	writeShellTool(t, home, "bad", `{"name": "empty"}`)
+
+	_, err = LoadShellTools(&config.Config{Home: home})
+	assert.ErrorContains(t, err, "command is required")
+}
+
+func TestShellToolsOptionalParameters(t *testing.T) {
+	home := t.TempDir()
+
+	writeShellTool(t, home, "list", `{
+		"name": "list",
+		"description": "Lists files",
+		"parameters": {
+			"type": "object",
+			"properties": {"path": {"type": "string"}, "all": {"type": "boolean"}}
+		},
+		"command": ["echo", "ls{{if .all}} -a{{end}}{{with .path}} {{.}}{{end}}"]
+	}`)
+
+	writeShellTool(t, home, "typo", `{
+		"name": "typo",
+		"description": "Refers to a parameter that does not exist",
+		"parameters": {"type": "object", "properties": {"path": {"type": "string"}}},
+		"command": ["echo", "{{.pth}}"]
+	}`)
+
+	registry := NewToolRegistry()
+	assert.NoError(t, RegisterShellTools(&config.Config{Home: home}, registry))
+	registry.SetPolicies(map[string]string{"*": config.ToolPolicyAllow})
+
+	output, failed := registry.Call(context.Background(), "list", `{}`)
+	assert.False(t, failed)
+	assert.Equal(t, "ls\n", output)
+
+	output, failed = registry.Call(context.Background(), "list", `{"path": "src", "all": true}`)
+	assert.False(t, failed)
+	assert.Equal(t, "ls -a src\n", output)
+
+	output, failed = registry.Call(context.Background(), "typo", `{"path": "src"}`)
+	assert.True(t, failed)
+	assert.Contains(t, output, "error rendering command")
+}
+
+func TestShellToolsTimeoutKillsChildren(t *testing.T) {
+	home := t.TempDir()
+
+	// The sleep holds the command's output open after the shell is killed
+	writeShellTool(t, home, "slow", `{
+		"name": "slow",
+		"description": "Takes too long",
+		"command": ["sh", "-c", "sleep 30 | cat"],
+		"timeout": "100ms"
+	}`)
+
+	registry := NewToolRegistry()
+	assert.NoError(t, RegisterShellTools(&config.Config{Home: home}, registry))
+	registry.SetPolicies(map[string]string{"*": config.ToolPolicyAllow})
+
+	start := time.Now()
+	_, failed := registry.Call(context.Background(), "slow", `{}`)
+	assert.True(t, failed)
+	assert.Less(t, time.Since(start), shellToolWaitDelay)
+}
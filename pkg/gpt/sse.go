@@ -0,0 +1,87 @@
+package gpt
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// sseEvent is a single server-sent event. Event is empty for streams that do
+// not name their events, like the Chat Completions API.
+type sseEvent struct {
+	Event string
+	Data  string
+}
+
+// sseReader reads server-sent events from a stream. Unlike bufio.Scanner, it
+// has no limit on the length of a line, since a single event may carry a
+// large tool call or message payload.
+type sseReader struct {
+	reader *bufio.Reader
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{reader: bufio.NewReader(r)}
+}
+
+// Next returns the next event in the stream. It returns io.EOF once the
+// stream has ended, and io.ErrUnexpectedEOF if the stream ended partway
+// through an event.
+func (r *sseReader) Next() (sseEvent, error) {
+	var event sseEvent
+	var data []string
+	var started bool
+
+	for {
+		line, err := r.reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return sseEvent{}, err
+		}
+
+		// The final line of a stream may not be terminated with a newline
+		if err == io.EOF && line == "" {
+			if started {
+				// The last event must be followed by a blank line, but be
+				// lenient with servers that simply close the connection.
+				if len(data) > 0 {
+					event.Data = strings.Join(data, "\n")
+					return event, nil
+				}
+
+				return sseEvent{}, io.ErrUnexpectedEOF
+			}
+
+			return sseEvent{}, io.EOF
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		// A blank line dispatches the event, if there is one
+		if line == "" {
+			if !started {
+				continue
+			}
+
+			event.Data = strings.Join(data, "\n")
+			return event, nil
+		}
+
+		// Lines beginning with a colon are comments, used as keep-alives
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "event":
+			event.Event = value
+			started = true
+
+		case "data":
+			data = append(data, value)
+			started = true
+		}
+	}
+}
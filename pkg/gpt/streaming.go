@@ -1,17 +1,19 @@
 package gpt
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
-	"strings"
+	"io"
 
 	"github.com/sysread/fnord/pkg/debug"
 )
 
+// streamer sends events from a single RunThread call to the caller.
 type streamer struct {
 	done            bool
-	msgOutputChan   chan<- string
+	events          chan<- Event
+	tools           *ToolRegistry
 	toolCallOutputs []toolOutput
 }
 
@@ -25,6 +27,39 @@ type threadMessageDelta struct {
 	} `json:"delta"`
 }
 
+// threadRunList is the response listing a thread's runs.
+type threadRunList struct {
+	Data []threadRun `json:"data"`
+}
+
+type threadRun struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Usage  *Usage `json:"usage"`
+
+	// Set when the run has failed
+	LastError *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"last_error"`
+
+	// Set when the run has ended early without failing
+	IncompleteDetails *struct {
+		Reason string `json:"reason"`
+	} `json:"incomplete_details"`
+}
+
+// streamError is the payload of an "error" event. Depending on where it came
+// from, the error details may or may not be wrapped in an "error" field.
+type streamError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Error   *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
 type threadRequiredAction struct {
 	RunID          string `json:"id"`
 	RequiredAction struct {
@@ -45,94 +80,202 @@ type toolOutput struct {
 	Output     string `json:"output"`
 }
 
-func (c *OpenAIClient) RunThread(threadID string, responseChan chan<- string) {
+func (c *OpenAIClient) RunThread(ctx context.Context, threadID string, events chan<- Event) {
 	debug.Log("[gpt] Creating thread run %s", threadID)
 
 	s := &streamer{
-		done:          false,
-		msgOutputChan: responseChan,
+		done:   false,
+		events: events,
+		tools:  c.assistant.registry,
 	}
 
-	run, err := c.CreateRun(threadID)
+	c.beginRun(threadID)
+
+	run, err := c.CreateRun(ctx, threadID)
 	if err != nil {
+		// No run was created, so there is none to cancel
+		c.endRun(threadID, "")
 		s.fail("Error creating run: %s", err)
 		return
 	}
 
-	var event string
+	// Each time the assistant requests tool outputs, the run continues in the
+	// stream returned when the outputs are submitted.
+	for run != nil {
+		next, err := c.consumeRunStream(ctx, threadID, s, run)
+		run.Close()
+
+		if err != nil {
+			// Errors caused by the user cancelling the response are expected
+			if ctx.Err() != nil {
+				debug.Log("[gpt] Run for thread %s cancelled: %v", threadID, err)
+			} else {
+				s.fail("%s", err)
+			}
 
-LINE:
-	for scanner := bufio.NewScanner(run); scanner.Scan(); {
-		line := scanner.Text()
+			break
+		}
+
+		run = next
+	}
 
-		// New event
-		if strings.HasPrefix(line, "event: ") {
-			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
-			continue LINE
+	s.finish()
+}
+
+// consumeRunStream processes the events in a run's stream. If the run
+// requires tool outputs, they are submitted and the stream that continues the
+// run is returned. Otherwise, nil is returned once the run has ended.
+func (c *OpenAIClient) consumeRunStream(ctx context.Context, threadID string, s *streamer, run io.Reader) (io.ReadCloser, error) {
+	reader := newSSEReader(run)
+
+	// Whether the run has reached a terminal state
+	ended := false
+
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			if !ended {
+				return nil, fmt.Errorf("stream ended before the run finished")
+			}
+
+			return nil, nil
 		}
 
-		// Data recevied
-		if strings.HasPrefix(line, "data: ") {
-			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
-
-			switch event {
-			case "done":
-				if data == "[DONE]" {
-					break LINE
-				}
-
-			case "thread.message.delta":
-				var delta threadMessageDelta
-
-				if err := json.Unmarshal([]byte(data), &delta); err != nil {
-					s.fail("Error unmarshalling thread message delta: %s", err)
-					return
-				}
-
-				for _, message := range delta.Delta.Content {
-					s.send(message.Text.Value)
-				}
-
-			case "thread.run.requires_action":
-				var action threadRequiredAction
-
-				if err := json.Unmarshal([]byte(data), &action); err != nil {
-					s.fail("Error unmarshalling thread required action: %s", err)
-					return
-				}
-
-				// Collect tool call outputs
-				for _, toolCall := range action.RequiredAction.SubmitToolOutputs.ToolCalls {
-					responseChan <- fmt.Sprintf("STATUS: %s", getToolStatusLine(toolCall.Function.Name))
-					s.addToolCallOutput(
-						toolCall.ID,
-						toolCall.Function.Name,
-						toolCall.Function.Arguments,
-					)
-				}
-
-				// Submit tool call outputs
-				newRun, err := c.submitToolOutputs(threadID, action.RunID, s.toolCallOutputs)
-				if err != nil {
-					s.fail("Error submitting tool outputs: %s", err)
-					return
-				}
-
-				// Clear tool call outputs so that they do not get re-submitted
-				// if the assistant requests further tool outputs.
-				s.toolCallOutputs = nil
-
-				// Replace `run` with the response body reader returned by
-				// `SubmitToolOutputs`, which will continue streaming the
-				// response. Then, jump back to the beginning so that our
-				// scanner is reinitialized with the new reader.
-				run = newRun
-				goto LINE
+		if err != nil {
+			return nil, fmt.Errorf("error reading run stream: %w", err)
+		}
+
+		switch event.Event {
+		case "done":
+			if event.Data == "[DONE]" {
+				return nil, nil
+			}
+
+		case "error":
+			var streamErr streamError
+
+			if err := json.Unmarshal([]byte(event.Data), &streamErr); err != nil {
+				return nil, fmt.Errorf("error in run stream: %s", event.Data)
+			}
+
+			return nil, streamErr.toError()
+
+		case "thread.run.created":
+			var created threadRun
+
+			if err := json.Unmarshal([]byte(event.Data), &created); err != nil {
+				return nil, fmt.Errorf("error unmarshalling thread run: %w", err)
+			}
+
+			c.setRunID(threadID, created.ID)
+			s.send(Event{Type: EventRunStarted, RunID: created.ID})
+
+		case "thread.run.completed", "thread.run.cancelled", "thread.run.failed", "thread.run.incomplete", "thread.run.expired":
+			var finished threadRun
+
+			if err := json.Unmarshal([]byte(event.Data), &finished); err != nil {
+				return nil, fmt.Errorf("error unmarshalling thread run: %w", err)
+			}
+
+			debug.Log("[gpt] Run %s is %s", finished.ID, finished.Status)
+			c.endRun(threadID, finished.ID)
+
+			if finished.Usage != nil {
+				s.send(Event{Type: EventUsage, RunID: finished.ID, Usage: finished.Usage})
+			}
+
+			if err := finished.toError(); err != nil {
+				return nil, err
+			}
+
+			ended = true
+
+		case "thread.message.delta":
+			var delta threadMessageDelta
+
+			if err := json.Unmarshal([]byte(event.Data), &delta); err != nil {
+				return nil, fmt.Errorf("error unmarshalling thread message delta: %w", err)
+			}
+
+			for _, message := range delta.Delta.Content {
+				s.sendText(message.Text.Value)
+			}
+
+		case "thread.run.requires_action":
+			var action threadRequiredAction
+
+			if err := json.Unmarshal([]byte(event.Data), &action); err != nil {
+				return nil, fmt.Errorf("error unmarshalling thread required action: %w", err)
+			}
+
+			// Collect tool call outputs
+			var calls []toolCall
+			for _, call := range action.RequiredAction.SubmitToolOutputs.ToolCalls {
+				calls = append(calls, toolCall{
+					ID:        call.ID,
+					Name:      call.Function.Name,
+					Arguments: call.Function.Arguments,
+				})
 			}
+
+			s.runToolCalls(ctx, calls)
+
+			// Submit tool call outputs
+			next, err := c.submitToolOutputs(ctx, threadID, action.RunID, s.toolCallOutputs)
+			if err != nil {
+				return nil, fmt.Errorf("error submitting tool outputs: %w", err)
+			}
+
+			// Clear tool call outputs so that they do not get re-submitted
+			// if the assistant requests further tool outputs.
+			s.toolCallOutputs = nil
+
+			return next, nil
+
+		default:
+			// The remaining events (thread.created, thread.run.queued,
+			// thread.run.step.*, thread.message.created, etc.) do not affect
+			// the response.
 		}
 	}
+}
 
-	s.finish()
+// toError returns an error describing why the run did not complete, or nil
+// if it completed or was cancelled.
+func (r threadRun) toError() error {
+	switch r.Status {
+	case "failed":
+		if r.LastError != nil {
+			return fmt.Errorf("run failed: %s (%s)", r.LastError.Message, r.LastError.Code)
+		}
+
+		return fmt.Errorf("run failed")
+
+	case "incomplete":
+		if r.IncompleteDetails != nil {
+			return fmt.Errorf("run incomplete: %s", r.IncompleteDetails.Reason)
+		}
+
+		return fmt.Errorf("run incomplete")
+
+	case "expired":
+		return fmt.Errorf("run expired before it could complete")
+	}
+
+	return nil
+}
+
+func (e streamError) toError() error {
+	code, message := e.Code, e.Message
+	if e.Error != nil {
+		code, message = e.Error.Code, e.Error.Message
+	}
+
+	if code == "" {
+		return fmt.Errorf("error in run stream: %s", message)
+	}
+
+	return fmt.Errorf("error in run stream: %s (%s)", message, code)
 }
 
 func (s *streamer) finish() {
@@ -140,18 +283,27 @@ func (s *streamer) finish() {
 		return
 	}
 
+	s.send(Event{Type: EventDone})
 	s.done = true
-	close(s.msgOutputChan)
+	close(s.events)
 
 	debug.Log("[gpt] Finished run")
 }
 
-func (s *streamer) send(msg string) {
+func (s *streamer) send(event Event) {
 	if s.done {
 		return
 	}
 
-	s.msgOutputChan <- msg
+	s.events <- event
+}
+
+func (s *streamer) sendText(text string) {
+	if text == "" {
+		return
+	}
+
+	s.send(Event{Type: EventTextDelta, Text: text})
 }
 
 func (s *streamer) fail(msg string, args ...interface{}) {
@@ -163,46 +315,69 @@ func (s *streamer) fail(msg string, args ...interface{}) {
 
 	debug.Log("[gpt] error: %s", errorMsg)
 
-	s.send(errorMsg)
+	s.send(Event{Type: EventError, Error: errorMsg})
 	s.finish()
 }
 
-func (s *streamer) addToolCallOutput(toolCallID, tool, argsJSON string) {
-	var toolOutputString string
-	var err error
-
-	switch tool {
-	case "query_conversations":
-		toolOutputString, err = queryConversations(argsJSON)
+// toolCall is a tool call requested by the assistant.
+type toolCall struct {
+	ID        string
+	Name      string
+	Arguments string
+}
 
-	case "query_project_files":
-		toolOutputString, err = queryProjectFiles(argsJSON)
+// toolResult is the outcome of a single tool call, identified by its position
+// in the list of requested calls.
+type toolResult struct {
+	index  int
+	output string
+	failed bool
+}
 
-	case "curl":
-		toolOutputString, err = curl(argsJSON)
+// runToolCalls runs the tool calls requested by the assistant concurrently
+// and collects their outputs, in the order in which they were requested, to
+// be submitted. A failed tool call does not end the response; the error is
+// sent to the assistant as the tool's output instead.
+func (s *streamer) runToolCalls(ctx context.Context, calls []toolCall) {
+	total := len(calls)
+	toolEvents := make([]*ToolEvent, total)
+	results := make(chan toolResult, total)
+
+	for i, call := range calls {
+		toolEvents[i] = &ToolEvent{
+			CallID:    call.ID,
+			Name:      call.Name,
+			Arguments: call.Arguments,
+			Status:    s.tools.StatusLine(call.Name),
+			Total:     total,
+		}
 
-	case "save_fact":
-		toolOutputString, err = saveFact(argsJSON)
+		s.send(Event{Type: EventToolStarted, Tool: toolEvents[i]})
 
-	case "delete_fact":
-		toolOutputString, err = deleteFact(argsJSON)
+		go func(i int, call toolCall) {
+			output, failed := s.tools.Call(ctx, call.Name, call.Arguments)
+			results <- toolResult{index: i, output: output, failed: failed}
+		}(i, call)
+	}
 
-	case "update_fact":
-		toolOutputString, err = updateFact(argsJSON)
+	// Report each tool as it finishes, so that the caller can display
+	// progress while the slower tools are still running.
+	outputs := make([]toolOutput, total)
 
-	case "search_facts":
-		toolOutputString, err = searchFacts(argsJSON)
+	for done := 1; done <= total; done++ {
+		result := <-results
 
-	default:
-		s.fail("unhandled function call: %s", tool)
-	}
+		finished := *toolEvents[result.index]
+		finished.Output = result.output
+		finished.Failed = result.failed
+		finished.Done = done
+		s.send(Event{Type: EventToolFinished, Tool: &finished})
 
-	if err != nil {
-		s.fail("%s: %s", tool, err)
+		outputs[result.index] = toolOutput{
+			ToolCallID: finished.CallID,
+			Output:     result.output,
+		}
 	}
 
-	s.toolCallOutputs = append(s.toolCallOutputs, toolOutput{
-		ToolCallID: toolCallID,
-		Output:     toolOutputString,
-	})
+	s.toolCallOutputs = append(s.toolCallOutputs, outputs...)
 }
@@ -0,0 +1,255 @@
+package gpt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/config"
+)
+
+// runFixture runs a thread against a server that responds with the recorded
+// stream in testdata/runs/<name>.sse. If the run requires tool outputs, the
+// server continues the run with the stream in <name>.submit.sse. Returns the
+// events sent by RunThread and the tool outputs submitted to the server.
+func runFixture(t *testing.T, name string) ([]Event, []toolOutput) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "runs", name+".sse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not every fixture requires tool outputs
+	submitFixture, _ := os.ReadFile(filepath.Join("testdata", "runs", name+".submit.sse"))
+
+	return runStream(t, string(fixture), string(submitFixture))
+}
+
+func runStream(t *testing.T, stream string, submitStream string) ([]Event, []toolOutput) {
+	var submitted []toolOutput
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		switch r.URL.Path {
+		case "/threads/thread_1/runs":
+			io.WriteString(w, stream)
+
+		case "/threads/thread_1/runs/run_1/submit_tool_outputs":
+			var body struct {
+				ToolOutputs []toolOutput `json:"tool_outputs"`
+			}
+
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			submitted = append(submitted, body.ToolOutputs...)
+
+			io.WriteString(w, submitStream)
+
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	defer server.Close()
+
+	client := &OpenAIClient{
+		apiClient: newApiClient(&config.Config{APIBaseURL: server.URL}),
+		assistant: &assistantDefinition{registry: Tools},
+		runs:      map[string]string{},
+	}
+
+	events := make(chan Event)
+	go client.RunThread(context.Background(), "thread_1", events)
+
+	var received []Event
+	for event := range events {
+		received = append(received, event)
+	}
+
+	return received, submitted
+}
+
+// responseText returns the text of all EventTextDelta events.
+func responseText(events []Event) string {
+	var text strings.Builder
+	for _, event := range events {
+		if event.Type == EventTextDelta {
+			text.WriteString(event.Text)
+		}
+	}
+
+	return text.String()
+}
+
+// lastError returns the message of the last EventError, if any.
+func lastError(events []Event) string {
+	var msg string
+	for _, event := range events {
+		if event.Type == EventError {
+			msg = event.Error
+		}
+	}
+
+	return msg
+}
+
+func TestRunThreadFixtures(t *testing.T) {
+	tests := []struct {
+		fixture string
+		text    string
+		err     string
+		usage   *Usage
+	}{
+		{
+			fixture: "completed",
+			text:    "Hello, world",
+			usage:   &Usage{PromptTokens: 120, CompletionTokens: 4, TotalTokens: 124},
+		},
+		{
+			fixture: "failed",
+			text:    "Let me",
+			err:     "run failed: You exceeded your current quota. (rate_limit_exceeded)",
+		},
+		{
+			fixture: "incomplete",
+			text:    "The answer is",
+			err:     "run incomplete: max_completion_tokens",
+			usage:   &Usage{PromptTokens: 50, CompletionTokens: 3, TotalTokens: 53},
+		},
+		{
+			fixture: "expired",
+			err:     "run expired before it could complete",
+		},
+		{
+			fixture: "error",
+			err:     "error in run stream: The server had an error while processing your request. (server_error)",
+		},
+		{
+			fixture: "truncated",
+			text:    "Partial",
+			err:     "stream ended before the run finished",
+		},
+		{
+			// Tool errors are sent to the assistant rather than ending the run
+			fixture: "unknown_tool",
+			text:    "That tool does not exist.",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			events, _ := runFixture(t, test.fixture)
+
+			assert.Equal(t, Event{Type: EventRunStarted, RunID: "run_1"}, events[0])
+			assert.Equal(t, EventDone, events[len(events)-1].Type)
+			assert.Equal(t, test.text, responseText(events))
+			assert.Equal(t, test.err, lastError(events))
+
+			var usage *Usage
+			for _, event := range events {
+				if event.Type == EventUsage {
+					usage = event.Usage
+				}
+			}
+
+			assert.Equal(t, test.usage, usage)
+		})
+	}
+}
+
+func TestRunThreadToolError(t *testing.T) {
+	events, submitted := runFixture(t, "unknown_tool")
+
+	assert.Equal(t, []toolOutput{{ToolCallID: "call_1", Output: "Error: unknown tool: no_such_tool"}}, submitted)
+
+	var finished *ToolEvent
+	for _, event := range events {
+		if event.Type == EventToolFinished {
+			finished = event.Tool
+		}
+	}
+
+	if assert.NotNil(t, finished) {
+		assert.Equal(t, "no_such_tool", finished.Name)
+		assert.True(t, finished.Failed)
+	}
+}
+
+func TestRunThreadLongLines(t *testing.T) {
+	// Longer than bufio.Scanner's default limit of 64KB
+	long := strings.Repeat("x", 100*1024)
+
+	stream := fmt.Sprintf(`event: thread.run.created
+data: {"id":"run_1","status":"queued"}
+
+event: thread.message.delta
+data: {"delta":{"content":[{"text":{"value":"%s"}}]}}
+
+event: thread.run.completed
+data: {"id":"run_1","status":"completed"}
+
+event: done
+data: [DONE]
+
+`, long)
+
+	events, _ := runStream(t, stream, "")
+	assert.Equal(t, "", lastError(events))
+	assert.Equal(t, long, responseText(events))
+}
+
+func TestSSEReader(t *testing.T) {
+	reader := newSSEReader(strings.NewReader(": comment\r\n\r\nevent: first\r\ndata: a\r\ndata: b\r\n\r\ndata:c\n\nevent: last\ndata: d"))
+
+	event, err := reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, sseEvent{Event: "first", Data: "a\nb"}, event)
+
+	event, err = reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, sseEvent{Data: "c"}, event)
+
+	// The last event is not followed by a blank line
+	event, err = reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, sseEvent{Event: "last", Data: "d"}, event)
+
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRunThreadForgetsRunThatFailedToStart(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": {"message": "Thread is busy", "type": "invalid_request_error"}}`))
+	}))
+	defer server.Close()
+
+	client := &OpenAIClient{
+		apiClient: newApiClient(&config.Config{APIBaseURL: server.URL}),
+		assistant: &assistantDefinition{registry: Tools},
+		runs:      map[string]string{},
+	}
+
+	events := make(chan Event)
+	go client.RunThread(context.Background(), "thread_1", events)
+
+	failed := false
+	for event := range events {
+		failed = failed || event.Type == EventError
+	}
+
+	assert.True(t, failed)
+
+	_, active := client.getRunID("thread_1")
+	assert.False(t, active)
+}
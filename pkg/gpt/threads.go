@@ -1,15 +1,25 @@
 package gpt
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"time"
 
 	"github.com/sysread/fnord/pkg/debug"
+	"github.com/sysread/fnord/pkg/messages"
 )
 
-const threadsApiUri = apiBaseUri + "/threads"
-const threadModel = "gpt-4o"
+const threadsApiPath = "/threads"
+
+// How long CancelRun waits for a run to finish cancelling
+const (
+	cancelPollAttempts = 20
+	cancelPollInterval = 500 * time.Millisecond
+)
 
 // Represents one chunk of the response body of a streaming request.
 type threadStreamingResponseDelta struct {
@@ -27,28 +37,19 @@ type threadStreamingResponseDelta struct {
 func (c *OpenAIClient) CreateThread() (string, error) {
 	debug.Log("[gpt] Starting new thread")
 
-	endpoint := threadsApiUri
-
-	// Build a request to create new thread
-	req, err := c.makeRequest("POST", endpoint, nil, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %#v", err)
-	}
+	endpoint := c.apiUri(threadsApiPath)
 
 	// Perform the request
-	resp, err := c.http.Do(req)
+	body, err := c.request(context.Background(), "POST", endpoint, nil)
 	if err != nil {
-		debug.Log("[gpt] Failed to make request: %#v", err)
-		return "", fmt.Errorf("failed to make request: %#v", err)
+		debug.Log("[gpt] Failed to create thread: %v", err)
+		return "", err
 	}
 
-	// Ensure the response body is closed
-	defer resp.Body.Close()
-
-	// Read and parse the body of the response. We only care about the thread
-	// "id" field.
+	// Parse the body of the response. We only care about the thread "id"
+	// field.
 	var response map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&response)
+	err = json.Unmarshal(body, &response)
 	if err != nil {
 		debug.Log("[gpt] Failed to parse response body: %#v", err)
 		return "", fmt.Errorf("failed to parse response body: %#v", err)
@@ -65,13 +66,36 @@ func (c *OpenAIClient) CreateThread() (string, error) {
 	return threadId, nil
 }
 
+// ResumeThread verifies that the thread still exists in the OpenAI API. The
+// thread already holds the conversation's messages, so history is not used.
+func (c *OpenAIClient) ResumeThread(threadID string, history []messages.Message) error {
+	debug.Log("[gpt] Resuming thread %s", threadID)
+
+	endpoint := c.apiUri(threadsApiPath + "/" + threadID)
+
+	if _, err := c.request(context.Background(), "GET", endpoint, nil); err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			debug.Log("[gpt] Thread %s no longer exists", threadID)
+			return fmt.Errorf("%w: %s", ErrThreadNotFound, threadID)
+		}
+
+		debug.Log("[gpt] Failed to retrieve thread %s: %v", threadID, err)
+		return err
+	}
+
+	debug.Log("[gpt] Thread %s resumed", threadID)
+
+	return nil
+}
+
 // AddMessage adds a message to a previously created thread in the OpenAI API.
 func (c *OpenAIClient) AddMessage(threadID string, content string) error {
 	// Truncate the content for logging, and handle the case where the content
 	// is fewer than 100 characters.
 	debug.Log("[gpt] Adding message to thread %s: %.100s", threadID, content)
 
-	endpoint := threadsApiUri + "/" + threadID + "/messages"
+	endpoint := c.apiUri(threadsApiPath + "/" + threadID + "/messages")
 
 	// Build our request body
 	body := map[string]string{
@@ -85,42 +109,33 @@ func (c *OpenAIClient) AddMessage(threadID string, content string) error {
 		return fmt.Errorf("body could not be serialized as json: %#v", err)
 	}
 
-	// Build a request to add a message to the thread
-	req, err := c.makeRequest("POST", endpoint, jsonBody, nil)
-	if err != nil {
-		debug.Log("[gpt] Failed to create request: %#v", err)
-		return fmt.Errorf("failed to create request: %#v", err)
-	}
-
 	// Perform the request
-	resp, err := c.http.Do(req)
-	if err != nil {
-		debug.Log("[gpt] Failed to make request: %#v", err)
-		return fmt.Errorf("failed to make request: %#v", err)
+	if _, err := c.request(context.Background(), "POST", endpoint, jsonBody); err != nil {
+		debug.Log("[gpt] Failed to add message to thread %s: %v", threadID, err)
+		return err
 	}
 
-	// Ensure the response body is closed
-	defer resp.Body.Close()
-
 	debug.Log("[gpt] Message added to thread %s", threadID)
 
 	return nil
 }
 
 // CreateRun starts a new run in a previously created thread in the OpenAI API,
-// and returns a channel that will receive the response content in string
-// chunks.
-func (c *OpenAIClient) CreateRun(threadID string) (io.ReadCloser, error) {
+// and returns the streaming response body.
+func (c *OpenAIClient) CreateRun(ctx context.Context, threadID string) (io.ReadCloser, error) {
 	debug.Log("[gpt] Creating thread run %s", threadID)
 
-	endpoint := threadsApiUri + "/" + threadID + "/runs"
+	endpoint := c.apiUri(threadsApiPath + "/" + threadID + "/runs")
 
-	// Build our request body
+	// Build our request body. The model is only sent if it has been
+	// overridden in the configuration; otherwise the assistant's is used.
 	body := struct {
 		AssistantID string `json:"assistant_id"`
+		Model       string `json:"model,omitempty"`
 		Stream      bool   `json:"stream"`
 	}{
-		AssistantID: AssistantID,
+		AssistantID: c.assistantID,
+		Model:       c.config.ChatModel,
 		Stream:      true,
 	}
 
@@ -130,33 +145,21 @@ func (c *OpenAIClient) CreateRun(threadID string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("body could not be serialized as json: %#v", err)
 	}
 
-	// Build a request to create a new run
-	req, err := c.makeRequest("POST", endpoint, jsonBody, nil)
-	if err != nil {
-		debug.Log("[gpt] Failed to create request: %#v", err)
-		return nil, fmt.Errorf("failed to create request: %#v", err)
-	}
-
 	// Perform the request
-	resp, err := c.http.Do(req)
+	run, err := c.stream(ctx, "POST", endpoint, jsonBody)
 	if err != nil {
-		debug.Log("[gpt] Failed to make request: %#v", err)
-		return nil, fmt.Errorf("failed to make request: %#v", err)
-	}
-	if resp.StatusCode != 200 {
-		msg, _ := io.ReadAll(resp.Body)
-		debug.Log("[gpt] Failed to start thread run: %#v - %s", resp.Status, msg)
-		return nil, fmt.Errorf("failed to start thread run: %#v - %s", resp.Status, msg)
+		debug.Log("[gpt] Failed to start thread run: %v", err)
+		return nil, err
 	}
 
 	debug.Log("[gpt] Thread run created for thread %s", threadID)
-	return resp.Body, nil
+	return run, nil
 }
 
-func (c *OpenAIClient) submitToolOutputs(threadID string, runID string, outputs []toolOutput) (io.ReadCloser, error) {
+func (c *OpenAIClient) submitToolOutputs(ctx context.Context, threadID string, runID string, outputs []toolOutput) (io.ReadCloser, error) {
 	debug.Log("[gpt] Submitting tool outputs for thread %s run %s", threadID, runID)
 
-	endpoint := threadsApiUri + "/" + threadID + "/runs/" + runID + "/submit_tool_outputs"
+	endpoint := c.apiUri(threadsApiPath + "/" + threadID + "/runs/" + runID + "/submit_tool_outputs")
 
 	// Build the request body
 	body := struct {
@@ -174,25 +177,147 @@ func (c *OpenAIClient) submitToolOutputs(threadID string, runID string, outputs
 		return nil, fmt.Errorf("body could not be serialized as json: %#v", err)
 	}
 
-	// Build a request to submit tool outputs
-	req, err := c.makeRequest("POST", endpoint, jsonBody, nil)
+	// Perform the request
+	run, err := c.stream(ctx, "POST", endpoint, jsonBody)
 	if err != nil {
-		debug.Log("[gpt] Failed to create request: %#v", err)
-		return nil, fmt.Errorf("failed to create request: %#v", err)
+		debug.Log("[gpt] Failed to submit tool outputs: %v", err)
+		return nil, err
 	}
 
-	// Perform the request
-	resp, err := c.http.Do(req)
+	debug.Log("[gpt] Tool outputs submitted for thread %s run %s", threadID, runID)
+	return run, nil
+}
+
+// CancelRun cancels the thread's active run and waits for the cancellation to
+// complete, since the API will not accept new messages for the thread while
+// a run is still active. If the response was cancelled before the API
+// reported the run's ID, the run may or may not have been created, so the
+// thread's most recent run is cancelled if it is still active.
+func (c *OpenAIClient) CancelRun(threadID string) error {
+	runID, active := c.getRunID(threadID)
+	if !active {
+		return nil
+	}
+
+	if runID == "" {
+		var err error
+		if runID, err = c.latestActiveRun(threadID); err != nil {
+			return err
+		}
+
+		if runID == "" {
+			debug.Log("[gpt] Thread %s has no active run to cancel", threadID)
+			c.endRun(threadID, "")
+			return nil
+		}
+	}
+
+	debug.Log("[gpt] Cancelling thread %s run %s", threadID, runID)
+
+	endpoint := c.apiUri(threadsApiPath + "/" + threadID + "/runs/" + runID)
+
+	if _, err := c.request(context.Background(), "POST", endpoint+"/cancel", nil); err != nil {
+		// The run may have finished on its own before we got here
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest {
+			debug.Log("[gpt] Run %s could not be cancelled: %v", runID, err)
+			c.endRun(threadID, runID)
+			return nil
+		}
+
+		debug.Log("[gpt] Failed to cancel run %s: %v", runID, err)
+		return err
+	}
+
+	// Poll the run until it is no longer active
+	for i := 0; i < cancelPollAttempts; i++ {
+		body, err := c.request(context.Background(), "GET", endpoint, nil)
+		if err != nil {
+			return err
+		}
+
+		var run threadRun
+		if err := json.Unmarshal(body, &run); err != nil {
+			return fmt.Errorf("failed to parse response body: %v", err)
+		}
+
+		if run.isTerminal() {
+			debug.Log("[gpt] Run %s is %s", runID, run.Status)
+			c.endRun(threadID, runID)
+			return nil
+		}
+
+		time.Sleep(cancelPollInterval)
+	}
+
+	return fmt.Errorf("timed out waiting for run %s to be cancelled", runID)
+}
+
+// latestActiveRun returns the ID of the thread's most recent run, if it is
+// still active, or "".
+func (c *OpenAIClient) latestActiveRun(threadID string) (string, error) {
+	endpoint := c.apiUri(threadsApiPath + "/" + threadID + "/runs?limit=1&order=desc")
+
+	body, err := c.request(context.Background(), "GET", endpoint, nil)
 	if err != nil {
-		debug.Log("[gpt] Failed to make request: %#v", err)
-		return nil, fmt.Errorf("failed to make request: %#v", err)
+		debug.Log("[gpt] Failed to list runs of thread %s: %v", threadID, err)
+		return "", err
+	}
+
+	var runs threadRunList
+	if err := json.Unmarshal(body, &runs); err != nil {
+		return "", fmt.Errorf("failed to parse response body: %v", err)
 	}
-	if resp.StatusCode != 200 {
-		msg, _ := io.ReadAll(resp.Body)
-		debug.Log("[gpt] Failed to submit tool outputs: %#v - %s", resp.Status, msg)
-		return nil, fmt.Errorf("failed to submit tool outputs: %#v - %s", resp.Status, msg)
+
+	if len(runs.Data) == 0 || runs.Data[0].isTerminal() {
+		return "", nil
 	}
 
-	debug.Log("[gpt] Tool outputs submitted for thread %s run %s", threadID, runID)
-	return resp.Body, nil
+	return runs.Data[0].ID, nil
+}
+
+// isTerminal reports whether the run has ended, one way or another.
+func (r *threadRun) isTerminal() bool {
+	switch r.Status {
+	case "cancelled", "completed", "failed", "expired", "incomplete":
+		return true
+	}
+
+	return false
+}
+
+// beginRun records that a run is being created for the thread.
+func (c *OpenAIClient) beginRun(threadID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.runs[threadID] = ""
+}
+
+func (c *OpenAIClient) setRunID(threadID string, runID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.runs[threadID] = runID
+}
+
+// endRun forgets the thread's run once it has ended, unless another run has
+// since been started.
+func (c *OpenAIClient) endRun(threadID string, runID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if current, ok := c.runs[threadID]; ok && (current == runID || current == "") {
+		delete(c.runs, threadID)
+	}
+}
+
+// getRunID returns the ID of the thread's active run, and whether it has one.
+// The ID is "" if the run is still being created.
+func (c *OpenAIClient) getRunID(threadID string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	runID, ok := c.runs[threadID]
+	return runID, ok
 }
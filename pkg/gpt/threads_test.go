@@ -0,0 +1,133 @@
+package gpt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/messages"
+)
+
+func TestResumeThread(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/threads/thread_1":
+			w.Write([]byte(`{"id": "thread_1", "object": "thread"}`))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"message": "No thread found", "type": "invalid_request_error"}}`))
+		}
+	}))
+	defer server.Close()
+
+	client := &OpenAIClient{
+		apiClient: newApiClient(&config.Config{APIBaseURL: server.URL}),
+		assistant: &assistantDefinition{registry: Tools},
+		runs:      map[string]string{},
+	}
+
+	assert.NoError(t, client.ResumeThread("thread_1", nil))
+	assert.ErrorIs(t, client.ResumeThread("thread_expired", nil), ErrThreadNotFound)
+}
+
+func TestChatCompletionsResumeThread(t *testing.T) {
+	client := &ChatCompletionsClient{
+		assistant: &assistantDefinition{Instructions: "Be helpful", registry: Tools},
+		threads:   map[string][]chatMessage{},
+	}
+
+	err := client.ResumeThread("thread_1", []messages.Message{
+		{From: messages.You, Content: "Hello"},
+		{From: messages.System, Content: "Not sent"},
+		{From: messages.Assistant, Content: "Hi!", IsIncomplete: true},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, client.AddMessage("thread_1", "How are you?"))
+
+	assert.Equal(t, []chatMessage{
+		{Role: "system", Content: "Be helpful"},
+		{Role: "user", Content: "Hello"},
+		{Role: "assistant", Content: "Hi!"},
+		{Role: "user", Content: "How are you?"},
+	}, client.getMessages("thread_1"))
+}
+
+func TestChatCompletionsResumeThreadWithToolCalls(t *testing.T) {
+	client := &ChatCompletionsClient{
+		assistant: &assistantDefinition{Instructions: "Be helpful", registry: Tools},
+		threads:   map[string][]chatMessage{},
+	}
+
+	err := client.ResumeThread("thread_1", []messages.Message{
+		{From: messages.You, Content: "When?"},
+		{From: messages.Assistant, Content: "Nightly.", ToolCalls: []messages.ToolCall{
+			{Name: "search_notes", Arguments: `{"query": "when"}`, Output: "nightly builds"},
+		}},
+	})
+	assert.NoError(t, err)
+
+	thread := client.getMessages("thread_1")
+	if assert.Len(t, thread, 5) {
+		assert.Equal(t, chatMessage{Role: "user", Content: "When?"}, thread[1])
+
+		if assert.Len(t, thread[2].ToolCalls, 1) {
+			call := thread[2].ToolCalls[0]
+			assert.Equal(t, "assistant", thread[2].Role)
+			assert.Equal(t, "search_notes", call.Function.Name)
+			assert.Equal(t, `{"query": "when"}`, call.Function.Arguments)
+			assert.Equal(t, chatMessage{Role: "tool", Content: "nightly builds", ToolCallID: call.ID}, thread[3])
+		}
+
+		assert.Equal(t, chatMessage{Role: "assistant", Content: "Nightly."}, thread[4])
+	}
+}
+
+func TestCancelRun(t *testing.T) {
+	var requests []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+
+		switch r.Method + " " + r.URL.Path {
+		case "GET /threads/thread_1/runs":
+			w.Write([]byte(`{"data": [{"id": "run_2", "status": "in_progress"}]}`))
+
+		case "POST /threads/thread_1/runs/run_2/cancel":
+			w.Write([]byte(`{"id": "run_2", "status": "cancelling"}`))
+
+		case "GET /threads/thread_1/runs/run_2":
+			w.Write([]byte(`{"id": "run_2", "status": "cancelled"}`))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := &OpenAIClient{
+		apiClient: newApiClient(&config.Config{APIBaseURL: server.URL}),
+		assistant: &assistantDefinition{registry: Tools},
+		runs:      map[string]string{},
+	}
+
+	// No run is active, so there is nothing to cancel
+	assert.NoError(t, client.CancelRun("thread_1"))
+	assert.Empty(t, requests)
+
+	// The run's ID is not yet known, so the thread's latest run is cancelled
+	client.beginRun("thread_1")
+	assert.NoError(t, client.CancelRun("thread_1"))
+	assert.Equal(t, []string{
+		"GET /threads/thread_1/runs",
+		"POST /threads/thread_1/runs/run_2/cancel",
+		"GET /threads/thread_1/runs/run_2",
+	}, requests)
+
+	_, active := client.getRunID("thread_1")
+	assert.False(t, active)
+}
@@ -1,38 +1,542 @@
 package gpt
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/sysread/fnord/pkg/config"
 	"github.com/sysread/fnord/pkg/debug"
 	"github.com/sysread/fnord/pkg/storage"
 	"github.com/sysread/fnord/pkg/util"
 )
 
-func getToolStatusLine(toolName string) string {
-	switch toolName {
-	case "query_conversations":
-		return "Checking past conversations..."
-	case "query_project_files":
-		return "Searching project files..."
-	case "curl":
-		return "Downloading content from the web..."
-	case "save_fact":
-		return "Saving a new fact..."
-	case "update_fact":
-		return "Updating a saved fact..."
-	case "delete_fact":
-		return "Deleting a saved fact..."
-	case "search_facts":
-		return "Searching saved facts..."
-	default:
-		return "Executing " + toolName + "..."
-	}
-}
-
-func queryConversations(argsJSON string) (string, error) {
+// DefaultToolTimeout is how long a tool may run before its call fails, unless
+// the tool specifies its own timeout.
+const DefaultToolTimeout = 2 * time.Minute
+
+// Tool is a function that the assistant may call. Tools are registered with
+// a ToolRegistry, which generates the tool definitions sent to the API.
+type Tool interface {
+	Name() string
+	Description() string
+
+	// Parameters returns the JSON schema of the tool's arguments
+	Parameters() json.RawMessage
+
+	// StatusLine returns a short description of what the tool is doing, to
+	// display while it runs.
+	StatusLine() string
+
+	// Call runs the tool with the JSON-encoded arguments provided by the
+	// assistant and returns its output.
+	Call(ctx context.Context, argsJSON string) (string, error)
+}
+
+// FunctionTool is a Tool implemented by a Go function.
+type FunctionTool struct {
+	ToolName        string
+	ToolDescription string
+	Schema          json.RawMessage
+	Status          string
+	Handler         func(ctx context.Context, argsJSON string) (string, error)
+
+	// Whether the API should enforce the schema exactly. This requires the
+	// schema to list every property as required and disallow additional
+	// properties.
+	StrictSchema bool
+
+	// How long the tool may run. Defaults to DefaultToolTimeout.
+	TimeLimit time.Duration
+
+	// The tool's policy, unless overridden in the configuration. Defaults
+	// to config.ToolPolicyAllow.
+	Policy string
+}
+
+func (t *FunctionTool) Name() string                { return t.ToolName }
+func (t *FunctionTool) Description() string         { return t.ToolDescription }
+func (t *FunctionTool) Parameters() json.RawMessage { return t.Schema }
+func (t *FunctionTool) Strict() bool                { return t.StrictSchema }
+func (t *FunctionTool) Timeout() time.Duration      { return t.TimeLimit }
+func (t *FunctionTool) DefaultPolicy() string       { return t.Policy }
+
+func (t *FunctionTool) StatusLine() string {
+	if t.Status == "" {
+		return "Executing " + t.ToolName + "..."
+	}
+
+	return t.Status
+}
+
+func (t *FunctionTool) Call(ctx context.Context, argsJSON string) (string, error) {
+	return t.Handler(ctx, argsJSON)
+}
+
+// strictTool is implemented by tools whose schema may be enforced in strict
+// mode.
+type strictTool interface {
+	Strict() bool
+}
+
+// timedTool is implemented by tools that specify how long they may run.
+type timedTool interface {
+	Timeout() time.Duration
+}
+
+// policyTool is implemented by tools that specify their own default policy,
+// like tools with side effects that should not run without the user's
+// approval.
+type policyTool interface {
+	DefaultPolicy() string
+}
+
+// ToolApproval is the user's decision on a tool call that requires approval.
+// The user may edit the arguments before approving the call.
+type ToolApproval struct {
+	Approved  bool
+	Arguments string
+}
+
+// ToolApprover asks the user whether the assistant may call a tool. It may be
+// called concurrently, and should give up if ctx is cancelled.
+type ToolApprover func(ctx context.Context, tool Tool, argsJSON string) ToolApproval
+
+// ToolRegistry holds the tools available to the assistant.
+type ToolRegistry struct {
+	mutex sync.RWMutex
+	tools map[string]Tool
+
+	// Registration order, so that the generated definitions are stable
+	order []string
+
+	// Shared with any subsets of the registry
+	settings *toolSettings
+}
+
+// toolSettings control how the tools in a registry may be called.
+type toolSettings struct {
+	mutex sync.RWMutex
+
+	// Policies from the configuration, which override the tools' defaults
+	policies map[string]string
+
+	// Asks the user to approve tool calls under the "ask" policy. If nil,
+	// those calls are denied.
+	approver ToolApprover
+}
+
+// toolDefinition is the API's representation of a function tool.
+type toolDefinition struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters"`
+		Strict      bool            `json:"strict,omitempty"`
+	} `json:"function"`
+}
+
+// Tools is the registry of tools available to the assistant. The built-in
+// tools are registered here; others may be added at startup.
+var Tools = newBuiltinToolRegistry()
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{
+		tools:    map[string]Tool{},
+		settings: &toolSettings{},
+	}
+}
+
+// Subset returns a registry containing only the named tools, in the given
+// order. Names that are not registered are skipped. The subset shares the
+// registry's policies and approver, including any set later.
+func (r *ToolRegistry) Subset(names []string) *ToolRegistry {
+	subset := &ToolRegistry{
+		tools:    map[string]Tool{},
+		settings: r.settings,
+	}
+
+	for _, name := range names {
+		tool, ok := r.Get(name)
+		if !ok {
+			debug.Log("[gpt] [tools] skipping unknown tool %s", name)
+			continue
+		}
+
+		if err := subset.Register(tool); err != nil {
+			debug.Log("[gpt] [tools] %s", err)
+		}
+	}
+
+	return subset
+}
+
+// Register adds a tool to the registry. Tool names must be unique.
+func (r *ToolRegistry) Register(tool Tool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.tools[tool.Name()]; exists {
+		return fmt.Errorf("tool already registered: %s", tool.Name())
+	}
+
+	r.tools[tool.Name()] = tool
+	r.order = append(r.order, tool.Name())
+
+	return nil
+}
+
+// SetPolicies sets the tool policies from the configuration.
+func (r *ToolRegistry) SetPolicies(policies map[string]string) {
+	r.settings.mutex.Lock()
+	defer r.settings.mutex.Unlock()
+
+	r.settings.policies = policies
+}
+
+// SetApprover sets the function used to ask the user to approve tool calls.
+func (r *ToolRegistry) SetApprover(approver ToolApprover) {
+	r.settings.mutex.Lock()
+	defer r.settings.mutex.Unlock()
+
+	r.settings.approver = approver
+}
+
+// Policy returns the policy of the named tool. A policy for the tool in the
+// configuration takes precedence, followed by a policy for "*", followed by
+// the tool's own default.
+func (r *ToolRegistry) Policy(name string) string {
+	r.settings.mutex.RLock()
+	policy, ok := r.settings.policies[name]
+	if !ok {
+		policy, ok = r.settings.policies["*"]
+	}
+	r.settings.mutex.RUnlock()
+
+	if ok {
+		return policy
+	}
+
+	if tool, ok := r.Get(name); ok {
+		if tool, ok := tool.(policyTool); ok && tool.DefaultPolicy() != "" {
+			return tool.DefaultPolicy()
+		}
+	}
+
+	return config.ToolPolicyAllow
+}
+
+// Get returns the named tool, if it is registered.
+func (r *ToolRegistry) Get(name string) (Tool, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	tool, ok := r.tools[name]
+	return tool, ok
+}
+
+// List returns the registered tools in the order they were registered.
+func (r *ToolRegistry) List() []Tool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	tools := make([]Tool, 0, len(r.order))
+	for _, name := range r.order {
+		tools = append(tools, r.tools[name])
+	}
+
+	return tools
+}
+
+// Definitions returns the API tool definitions for the registered tools.
+func (r *ToolRegistry) Definitions() []json.RawMessage {
+	var defs []json.RawMessage
+
+	for _, tool := range r.List() {
+		var def toolDefinition
+		def.Type = "function"
+		def.Function.Name = tool.Name()
+		def.Function.Description = tool.Description()
+		def.Function.Parameters = tool.Parameters()
+
+		if strict, ok := tool.(strictTool); ok {
+			def.Function.Strict = strict.Strict()
+		}
+
+		buf, err := json.Marshal(def)
+		if err != nil {
+			debug.Log("[gpt] [tools] error serializing definition of %s: %s", tool.Name(), err)
+			continue
+		}
+
+		defs = append(defs, buf)
+	}
+
+	return defs
+}
+
+// Call runs the named tool. Errors are returned as the tool's output so that
+// the assistant can see what went wrong and decide how to proceed, rather
+// than ending the response. The second return value reports whether the call
+// failed.
+//
+// If the tool's policy is "deny", or is "ask" and the user does not approve
+// the call, the tool is not run, and the assistant is told so.
+//
+// The call fails if the tool does not finish within its timeout, or if ctx
+// is cancelled. Tools that do not respond to the cancellation of their
+// context are left to finish in the background, and their output is
+// discarded.
+func (r *ToolRegistry) Call(ctx context.Context, name string, argsJSON string) (string, bool) {
+	tool, ok := r.Get(name)
+	if !ok {
+		debug.Log("[gpt] [tools] unknown tool requested: %s", name)
+		return fmt.Sprintf("Error: unknown tool: %s", name), true
+	}
+
+	argsJSON, denial := r.approve(ctx, tool, argsJSON)
+	if denial != "" {
+		debug.Log("[gpt] [tools] %s was not run: %s", name, denial)
+		return denial, true
+	}
+
+	timeout := DefaultToolTimeout
+	if timed, ok := tool.(timedTool); ok && timed.Timeout() > 0 {
+		timeout = timed.Timeout()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		output string
+		err    error
+	}
+
+	// Buffered so that a tool that finishes after timing out does not block
+	done := make(chan result, 1)
+
+	go func() {
+		output, err := tool.Call(ctx, argsJSON)
+		done <- result{output, err}
+	}()
+
+	var output string
+	var err error
+
+	select {
+	case res := <-done:
+		output, err = res.output, res.err
+
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%s timed out after %s", name, timeout)
+		} else {
+			err = fmt.Errorf("%s was cancelled", name)
+		}
+	}
+
+	if err != nil {
+		debug.Log("[gpt] [tools] %s failed: %s", name, err)
+		return fmt.Sprintf("Error: %s", err), true
+	}
+
+	return output, false
+}
+
+// approve applies the tool's policy to a call. It returns the arguments to
+// call the tool with, which the user may have edited, or the message to send
+// to the assistant if the call is not allowed.
+func (r *ToolRegistry) approve(ctx context.Context, tool Tool, argsJSON string) (string, string) {
+	switch r.Policy(tool.Name()) {
+	case config.ToolPolicyAllow:
+		return argsJSON, ""
+
+	case config.ToolPolicyDeny:
+		return argsJSON, fmt.Sprintf("The user does not allow the %s tool to be used.", tool.Name())
+	}
+
+	r.settings.mutex.RLock()
+	approver := r.settings.approver
+	r.settings.mutex.RUnlock()
+
+	if approver == nil {
+		return argsJSON, fmt.Sprintf("The %s tool requires the user's approval, but the user is not available to approve it.", tool.Name())
+	}
+
+	approval := approver(ctx, tool, argsJSON)
+	if !approval.Approved {
+		return argsJSON, fmt.Sprintf("The user denied permission to call the %s tool with these arguments.", tool.Name())
+	}
+
+	return approval.Arguments, ""
+}
+
+// StatusLine returns the status line of the named tool.
+func (r *ToolRegistry) StatusLine(name string) string {
+	if tool, ok := r.Get(name); ok {
+		return tool.StatusLine()
+	}
+
+	return "Executing " + name + "..."
+}
+
+func newBuiltinToolRegistry() *ToolRegistry {
+	registry := NewToolRegistry()
+
+	builtins := []*FunctionTool{
+		{
+			ToolName:        "query_conversations",
+			ToolDescription: "Query the local vector database for information related to a specific topic that you discussed in a previous conversation with the user.",
+			Status:          "Checking past conversations...",
+			Handler:         queryConversations,
+			StrictSchema:    true,
+			Schema: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"query_text": {
+						"type": "string",
+						"description": "The text or topic to search for in the vector database."
+					}
+				},
+				"required": ["query_text"],
+				"additionalProperties": false
+			}`),
+		},
+		{
+			ToolName:        "query_project_files",
+			ToolDescription: "Query the local vector database containing project files to find code related to the user's prompt. Results are excerpts of files, identified by path and line range (e.g. `/path/to/main.go:L10-L58`); cite them in the same form.",
+			Status:          "Searching project files...",
+			Handler:         queryProjectFiles,
+			StrictSchema:    true,
+			Schema: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"query_text": {
+						"type": "string",
+						"description": "The text or topic to search for in the local project files vector database."
+					}
+				},
+				"required": ["query_text"],
+				"additionalProperties": false
+			}`),
+		},
+		{
+			ToolName:        "curl",
+			ToolDescription: "Retrieve the contents of multiple URLs using the curl command.",
+			Status:          "Downloading content from the web...",
+			Handler:         curl,
+			StrictSchema:    true,
+			Policy:          config.ToolPolicyAsk,
+			Schema: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"urls": {
+						"type": "array",
+						"items": {
+							"type": "string",
+							"description": "A URL to retrieve the contents from."
+						},
+						"description": "A list of URLs to retrieve contents from."
+					}
+				},
+				"required": ["urls"],
+				"additionalProperties": false
+			}`),
+		},
+		{
+			ToolName:        "save_fact",
+			ToolDescription: "Save a fact from your conversation in the vector database for future reference.",
+			Status:          "Saving a new fact...",
+			Handler:         saveFact,
+			StrictSchema:    true,
+			Schema: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"content": {
+						"type": "string",
+						"description": "The information to save as a fact in the vector database."
+					}
+				},
+				"required": ["content"],
+				"additionalProperties": false
+			}`),
+		},
+		{
+			ToolName:        "update_fact",
+			ToolDescription: "Update a fact in the vector database with new information.",
+			Status:          "Updating a saved fact...",
+			Handler:         updateFact,
+			StrictSchema:    true,
+			Schema: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"id": {
+						"type": "string",
+						"description": "The ID of the fact to update. You may need to use ` + "`search_facts`" + ` to find the ID if you do not already have it."
+					},
+					"content": {
+						"type": "string",
+						"description": "The new information to update the fact with."
+					}
+				},
+				"required": ["id", "content"],
+				"additionalProperties": false
+			}`),
+		},
+		{
+			ToolName:        "delete_fact",
+			ToolDescription: "Delete a fact from the vector database.",
+			Status:          "Deleting a saved fact...",
+			Handler:         deleteFact,
+			StrictSchema:    true,
+			Schema: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"id": {
+						"type": "string",
+						"description": "The ID of the fact to delete. You may need to use ` + "`search_facts`" + ` to find the ID if you do not already have it."
+					}
+				},
+				"required": ["id"],
+				"additionalProperties": false
+			}`),
+		},
+		{
+			ToolName:        "search_facts",
+			ToolDescription: "Search the vector database for facts that match a specific query.",
+			Status:          "Searching saved facts...",
+			Handler:         searchFacts,
+			StrictSchema:    true,
+			Schema: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"query_text": {
+						"type": "string",
+						"description": "The text or topic to search for in the vector database."
+					}
+				},
+				"required": ["query_text"],
+				"additionalProperties": false
+			}`),
+		},
+	}
+
+	for _, tool := range builtins {
+		if err := registry.Register(tool); err != nil {
+			panic(err)
+		}
+	}
+
+	return registry
+}
+
+func queryConversations(ctx context.Context, argsJSON string) (string, error) {
 	debug.Log("[gpt] [query_conversations] %s", argsJSON)
 
 	var query struct {
@@ -59,7 +563,7 @@ func queryConversations(argsJSON string) (string, error) {
 	return output.String(), nil
 }
 
-func queryProjectFiles(argsJSON string) (string, error) {
+func queryProjectFiles(ctx context.Context, argsJSON string) (string, error) {
 	debug.Log("[gpt] [query_project_files] %s", argsJSON)
 
 	var query struct {
@@ -86,7 +590,7 @@ func queryProjectFiles(argsJSON string) (string, error) {
 	return output.String(), nil
 }
 
-func curl(argsJSON string) (string, error) {
+func curl(ctx context.Context, argsJSON string) (string, error) {
 	debug.Log("[gpt] [curl] %s", argsJSON)
 
 	var args struct {
@@ -101,11 +605,15 @@ func curl(argsJSON string) (string, error) {
 	// Retrieve the contents of each URL. We'll spin each off into a
 	// goroutine and wait for all of them to finish before continuing.
 	var outputs = make(map[string]string)
+	var mutex sync.Mutex
 	var condvar sync.WaitGroup
 
 	for _, url := range args.URLs {
 		condvar.Add(1)
+
+		mutex.Lock()
 		outputs[url] = "<not yet downloaded>"
+		mutex.Unlock()
 
 		go func(url string) {
 			defer condvar.Done()
@@ -113,10 +621,13 @@ func curl(argsJSON string) (string, error) {
 			output, err := util.HttpGetText(url)
 			if err != nil {
 				debug.Log("[gpt] [curl] error making HTTP request: %s", err)
-				outputs[url] = fmt.Sprintf("Error making HTTP request: %s", err)
+				output = fmt.Sprintf("Error making HTTP request: %s", err)
 			}
 
+			// Maps are not safe for concurrent writes
+			mutex.Lock()
 			outputs[url] = output
+			mutex.Unlock()
 		}(url)
 	}
 
@@ -133,7 +644,7 @@ func curl(argsJSON string) (string, error) {
 	return buf.String(), nil
 }
 
-func saveFact(argsJSON string) (string, error) {
+func saveFact(ctx context.Context, argsJSON string) (string, error) {
 	debug.Log("[gpt] [save_fact] %s", argsJSON)
 
 	var info struct {
@@ -155,7 +666,7 @@ func saveFact(argsJSON string) (string, error) {
 	return fmt.Sprintf("Saved fact with ID %s", id), nil
 }
 
-func updateFact(argsJSON string) (string, error) {
+func updateFact(ctx context.Context, argsJSON string) (string, error) {
 	debug.Log("[gpt] [update_fact] %s", argsJSON)
 
 	var info struct {
@@ -177,7 +688,7 @@ func updateFact(argsJSON string) (string, error) {
 	return fmt.Sprintf("Updated fact with ID %s", info.ID), nil
 }
 
-func deleteFact(argsJSON string) (string, error) {
+func deleteFact(ctx context.Context, argsJSON string) (string, error) {
 	debug.Log("[gpt] [delete_fact] %s", argsJSON)
 
 	var info struct {
@@ -198,7 +709,7 @@ func deleteFact(argsJSON string) (string, error) {
 	return fmt.Sprintf("Deleted fact with ID %s", info.ID), nil
 }
 
-func searchFacts(argsJSON string) (string, error) {
+func searchFacts(ctx context.Context, argsJSON string) (string, error) {
 	debug.Log("[gpt] [search_facts] %s", argsJSON)
 
 	var query struct {
@@ -0,0 +1,186 @@
+package gpt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/config"
+)
+
+func TestToolRegistry(t *testing.T) {
+	registry := NewToolRegistry()
+
+	echo := &FunctionTool{
+		ToolName:        "echo",
+		ToolDescription: "Echoes its input",
+		Schema:          json.RawMessage(`{"type":"object","properties":{"text":{"type":"string"}}}`),
+		Handler: func(ctx context.Context, argsJSON string) (string, error) {
+			return argsJSON, nil
+		},
+	}
+
+	broken := &FunctionTool{
+		ToolName:     "broken",
+		Status:       "Breaking things...",
+		Schema:       json.RawMessage(`{"type":"object","properties":{},"required":[],"additionalProperties":false}`),
+		StrictSchema: true,
+		Handler: func(ctx context.Context, argsJSON string) (string, error) {
+			return "", errors.New("it broke")
+		},
+	}
+
+	assert.NoError(t, registry.Register(echo))
+	assert.NoError(t, registry.Register(broken))
+	assert.Error(t, registry.Register(echo))
+
+	assert.Equal(t, "Executing echo...", registry.StatusLine("echo"))
+	assert.Equal(t, "Breaking things...", registry.StatusLine("broken"))
+
+	defs := registry.Definitions()
+	if assert.Len(t, defs, 2) {
+		assert.JSONEq(t, `{
+			"type": "function",
+			"function": {
+				"name": "echo",
+				"description": "Echoes its input",
+				"parameters": {"type": "object", "properties": {"text": {"type": "string"}}}
+			}
+		}`, string(defs[0]))
+
+		var def toolDefinition
+		assert.NoError(t, json.Unmarshal(defs[1], &def))
+		assert.True(t, def.Function.Strict)
+	}
+
+	output, failed := registry.Call(context.Background(), "echo", `{"text":"hi"}`)
+	assert.Equal(t, `{"text":"hi"}`, output)
+	assert.False(t, failed)
+
+	output, failed = registry.Call(context.Background(), "broken", `{}`)
+	assert.Equal(t, "Error: it broke", output)
+	assert.True(t, failed)
+}
+
+func TestToolRegistryTimeout(t *testing.T) {
+	registry := NewToolRegistry()
+
+	registry.Register(&FunctionTool{
+		ToolName:  "slow",
+		TimeLimit: 10 * time.Millisecond,
+		Handler: func(ctx context.Context, argsJSON string) (string, error) {
+			// Ignores ctx, like most of the built-in tools
+			time.Sleep(time.Second)
+			return "too late", nil
+		},
+	})
+
+	start := time.Now()
+	output, failed := registry.Call(context.Background(), "slow", `{}`)
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, "Error: slow timed out after 10ms", output)
+	assert.True(t, failed)
+}
+
+func TestRunToolCallsConcurrently(t *testing.T) {
+	registry := NewToolRegistry()
+
+	// Each tool waits until all of them have started, so the test only
+	// completes if they run concurrently.
+	started := make(chan struct{}, 3)
+	sleeper := func(delay time.Duration) func(context.Context, string) (string, error) {
+		return func(ctx context.Context, argsJSON string) (string, error) {
+			started <- struct{}{}
+			for len(started) < cap(started) {
+				time.Sleep(time.Millisecond)
+			}
+
+			time.Sleep(delay)
+			return argsJSON, nil
+		}
+	}
+
+	registry.Register(&FunctionTool{ToolName: "slow", Handler: sleeper(50 * time.Millisecond)})
+	registry.Register(&FunctionTool{ToolName: "fast", Handler: sleeper(0)})
+
+	events := make(chan Event, 10)
+	s := &streamer{events: events, tools: registry}
+
+	s.runToolCalls(context.Background(), []toolCall{
+		{ID: "call_1", Name: "slow", Arguments: "1"},
+		{ID: "call_2", Name: "fast", Arguments: "2"},
+		{ID: "call_3", Name: "fast", Arguments: "3"},
+	})
+
+	close(events)
+
+	// Outputs are submitted in the order the calls were requested
+	assert.Equal(t, []toolOutput{
+		{ToolCallID: "call_1", Output: "1"},
+		{ToolCallID: "call_2", Output: "2"},
+		{ToolCallID: "call_3", Output: "3"},
+	}, s.toolCallOutputs)
+
+	var progress []string
+	var lastFinished string
+	for event := range events {
+		if event.Type == EventToolFinished {
+			progress = append(progress, event.Tool.Progress())
+			lastFinished = event.Tool.CallID
+		}
+	}
+
+	assert.Equal(t, []string{"1/3 tools done", "2/3 tools done", "3/3 tools done"}, progress)
+	assert.Equal(t, "call_1", lastFinished)
+}
+
+func TestToolRegistryPolicies(t *testing.T) {
+	registry := NewToolRegistry()
+
+	echo := func(ctx context.Context, argsJSON string) (string, error) {
+		return argsJSON, nil
+	}
+
+	registry.Register(&FunctionTool{ToolName: "safe", Handler: echo})
+	registry.Register(&FunctionTool{ToolName: "risky", Handler: echo, Policy: config.ToolPolicyAsk})
+
+	assert.Equal(t, config.ToolPolicyAllow, registry.Policy("safe"))
+	assert.Equal(t, config.ToolPolicyAsk, registry.Policy("risky"))
+
+	// Without an approver, calls that require approval are denied
+	output, failed := registry.Call(context.Background(), "risky", `{}`)
+	assert.True(t, failed)
+	assert.Contains(t, output, "requires the user's approval")
+
+	// The user may edit the arguments before approving the call
+	var asked []string
+	registry.SetApprover(func(ctx context.Context, tool Tool, argsJSON string) ToolApproval {
+		asked = append(asked, tool.Name())
+		return ToolApproval{Approved: argsJSON != `"no"`, Arguments: `"edited"`}
+	})
+
+	output, failed = registry.Call(context.Background(), "risky", `"yes"`)
+	assert.False(t, failed)
+	assert.Equal(t, `"edited"`, output)
+
+	output, failed = registry.Call(context.Background(), "risky", `"no"`)
+	assert.True(t, failed)
+	assert.Equal(t, "The user denied permission to call the risky tool with these arguments.", output)
+
+	// Configured policies override the tools' defaults
+	registry.SetPolicies(map[string]string{"risky": config.ToolPolicyAllow, "*": config.ToolPolicyDeny})
+	assert.Equal(t, config.ToolPolicyAllow, registry.Policy("risky"))
+	assert.Equal(t, config.ToolPolicyDeny, registry.Policy("safe"))
+
+	output, failed = registry.Call(context.Background(), "safe", `{}`)
+	assert.True(t, failed)
+	assert.Equal(t, "The user does not allow the safe tool to be used.", output)
+
+	// Only the calls under the "ask" policy were sent to the approver
+	assert.Equal(t, []string{"risky", "risky"}, asked)
+}
@@ -0,0 +1,262 @@
+// Package headless runs the assistant without the UI, for use from scripts,
+// hooks, and editors.
+package headless
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/sysread/fnord/pkg/chat_manager"
+	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/debug"
+	"github.com/sysread/fnord/pkg/fnord"
+	"github.com/sysread/fnord/pkg/gpt"
+	"github.com/sysread/fnord/pkg/markdown"
+)
+
+// Exit statuses of Ask
+const (
+	ExitOK          = 0
+	ExitFailed      = 1   // The assistant's response failed or was incomplete
+	ExitUsage       = 2   // The question could not be asked
+	ExitInterrupted = 130 // The user interrupted the response
+)
+
+// Ask sends a question to the assistant and writes its response to stdout,
+// in the format selected by Config.Output. Input piped to stdin is attached
+// to the question. The question may attach files and command output with the
+// same slash commands as the chat. If Config.Resume is set, the question
+// continues that conversation. Ask returns the process's exit status.
+func Ask(f *fnord.Fnord, args []string) int {
+	// There is no log view to drain the logs
+	debug.Discard()
+
+	format := f.Config.Output
+	if format == "" {
+		format = config.OutputText
+		if isTerminal(os.Stdout) {
+			format = config.OutputANSI
+		}
+	}
+
+	question := joinQuestion(args)
+
+	msgs, err := chat_manager.ParseMessage(question)
+	if err != nil {
+		return fail(ExitUsage, err)
+	}
+
+	if !isTerminal(os.Stdin) {
+		input, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fail(ExitUsage, fmt.Errorf("error reading stdin: %w", err))
+		}
+
+		if strings.TrimSpace(string(input)) != "" {
+			msgs = append(msgs, chat_manager.AttachInput("stdin", string(input))...)
+		}
+	}
+
+	if len(msgs) == 0 {
+		return fail(ExitUsage, errors.New(`usage: fnord ask "question"`))
+	}
+
+	cm, err := newChatManager(f)
+	if err != nil {
+		return fail(ExitFailed, err)
+	}
+
+	for _, msg := range msgs {
+		if err := cm.AddMessage(msg); err != nil {
+			return fail(ExitFailed, err)
+		}
+	}
+
+	// The first interrupt cancels the response; the response so far is still
+	// written and stored.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	interrupted := make(chan bool, 1)
+	go func() {
+		if _, ok := <-interrupts; ok {
+			interrupted <- true
+			cm.CancelResponse()
+		}
+	}()
+
+	w := newAskWriter(format, os.Stdout, os.Stderr, cm.ThreadID())
+	err = cm.RequestResponse(w.event)
+	w.finish()
+
+	select {
+	case <-interrupted:
+		return ExitInterrupted
+	default:
+	}
+
+	if err != nil {
+		return fail(ExitFailed, err)
+	}
+
+	if last := cm.LastMessage(); last == nil || last.IsIncomplete || last.IsFailed() {
+		return fail(ExitFailed, errors.New("the response is incomplete"))
+	}
+
+	return ExitOK
+}
+
+// joinQuestion joins the words of the question with spaces. Arguments that
+// are slash commands, such as `\f main.go`, are put on their own lines so that
+// ParseMessage recognizes them.
+func joinQuestion(args []string) string {
+	var question strings.Builder
+	var afterCommand bool
+
+	for i, arg := range args {
+		isCommand := strings.HasPrefix(arg, "\\f ") || strings.HasPrefix(arg, "\\x ")
+
+		if i > 0 {
+			if isCommand || afterCommand {
+				question.WriteString("\n")
+			} else {
+				question.WriteString(" ")
+			}
+		}
+
+		question.WriteString(arg)
+		afterCommand = isCommand
+	}
+
+	return strings.TrimSpace(question.String())
+}
+
+// newChatManager starts a new conversation, or continues the one selected
+// with --resume. If the resumed conversation's thread has expired on the
+// server, it is continued locally; there is no one to ask first.
+func newChatManager(f *fnord.Fnord) (*chat_manager.ChatManager, error) {
+	if f.Config.Resume == "" {
+		return chat_manager.NewChatManager(f), nil
+	}
+
+	cm, err := chat_manager.LoadChatManager(f, f.Config.Resume)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cm.ResumeThread()
+	if errors.Is(err, gpt.ErrThreadNotFound) {
+		fmt.Fprintln(os.Stderr, "The conversation's thread has expired on the server; continuing it locally.")
+		err = cm.ContinueLocally()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cm, nil
+}
+
+// askWriter writes the assistant's response in one of the output formats.
+type askWriter struct {
+	format   string
+	out      io.Writer
+	status   io.Writer
+	threadID string
+
+	// ANSI output is rendered once the response is complete, since markdown
+	// cannot be rendered a piece at a time.
+	buf strings.Builder
+
+	// Set once any of the response's text has been received
+	hasText bool
+}
+
+// askEvent is an event as written in the JSON format, one per line.
+type askEvent struct {
+	ThreadID string `json:"thread_id"`
+	gpt.Event
+}
+
+// newAskWriter creates a writer for the response, in the given format, to
+// out. Tool status lines are written to status, if it is a terminal.
+func newAskWriter(format string, out io.Writer, status io.Writer, threadID string) *askWriter {
+	w := &askWriter{
+		format:   format,
+		out:      out,
+		threadID: threadID,
+	}
+
+	if f, ok := status.(*os.File); ok && isTerminal(f) {
+		w.status = status
+	}
+
+	return w
+}
+
+func (w *askWriter) event(event gpt.Event) {
+	if w.format == config.OutputJSON {
+		buf, err := json.Marshal(askEvent{ThreadID: w.threadID, Event: event})
+		if err != nil {
+			debug.Log("[headless] Error serializing event %s: %v", event, err)
+			return
+		}
+
+		w.out.Write(append(buf, '\n'))
+		return
+	}
+
+	switch event.Type {
+	case gpt.EventTextDelta:
+		w.hasText = true
+
+		if w.format == config.OutputANSI {
+			w.buf.WriteString(event.Text)
+		} else {
+			io.WriteString(w.out, event.Text)
+		}
+
+	case gpt.EventToolStarted:
+		if w.status != nil {
+			fmt.Fprintf(w.status, "[%s]\n", event.Tool.Status)
+		}
+	}
+}
+
+// finish writes anything left of the response once it is complete.
+func (w *askWriter) finish() {
+	if !w.hasText {
+		return
+	}
+
+	switch w.format {
+	case config.OutputANSI:
+		io.WriteString(w.out, strings.TrimSpace(markdown.RenderANSI(w.buf.String()))+"\n")
+
+	case config.OutputText:
+		io.WriteString(w.out, "\n")
+	}
+}
+
+// fail reports an error on stderr and returns the exit status.
+func fail(status int, err error) int {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	return status
+}
+
+// isTerminal reports whether the file is a terminal rather than a pipe or
+// regular file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,49 @@
+package headless
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/gpt"
+)
+
+func TestJoinQuestion(t *testing.T) {
+	assert.Equal(t, "what does this do", joinQuestion([]string{"what", "does", "this", "do"}))
+	assert.Equal(t, "explain\n\\f main.go\nbriefly", joinQuestion([]string{"explain", "\\f main.go", "briefly"}))
+	assert.Equal(t, "", joinQuestion(nil))
+}
+
+func TestAskWriter(t *testing.T) {
+	events := []gpt.Event{
+		{Type: gpt.EventRunStarted, RunID: "run_1"},
+		{Type: gpt.EventTextDelta, Text: "Hello, "},
+		{Type: gpt.EventToolStarted, Tool: &gpt.ToolEvent{Name: "search_facts", Status: "Searching facts", Total: 1}},
+		{Type: gpt.EventTextDelta, Text: "world"},
+		{Type: gpt.EventDone},
+	}
+
+	var text bytes.Buffer
+	w := newAskWriter(config.OutputText, &text, &bytes.Buffer{}, "thread_1")
+	for _, event := range events {
+		w.event(event)
+	}
+	w.finish()
+
+	assert.Equal(t, "Hello, world\n", text.String())
+
+	var jsonOut bytes.Buffer
+	w = newAskWriter(config.OutputJSON, &jsonOut, &bytes.Buffer{}, "thread_1")
+	for _, event := range events {
+		w.event(event)
+	}
+	w.finish()
+
+	lines := bytes.Split(bytes.TrimSpace(jsonOut.Bytes()), []byte("\n"))
+	if assert.Len(t, lines, len(events)) {
+		assert.JSONEq(t, `{"thread_id": "thread_1", "type": "text_delta", "text": "Hello, "}`, string(lines[1]))
+		assert.JSONEq(t, `{"thread_id": "thread_1", "type": "done"}`, string(lines[4]))
+	}
+}
@@ -0,0 +1,113 @@
+package markdown
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Style tags as written by the renderer and tview.TranslateANSI, e.g.
+// "[#ff0000::b]" or "[-:-:-]". Tags that begin with a letter are left alone,
+// since they are more likely to be text in brackets than color names.
+var styleTagRe = regexp.MustCompile(`\[([#:-][#0-9a-zA-Z:-]*)\]`)
+
+// Brackets escaped by tview.Escape, e.g. "[foo[]"
+var escapedTagRe = regexp.MustCompile(`\[([^\[\]]*)\[\]`)
+
+// RenderANSI renders markdown for display in a terminal, using ANSI escape
+// codes rather than tview's style tags.
+func RenderANSI(md string) string {
+	return TviewToANSI(Render(md))
+}
+
+// TviewToANSI converts tview style tags into ANSI escape codes.
+func TviewToANSI(tagged string) string {
+	var fg, bg, attrs string
+
+	converted := styleTagRe.ReplaceAllStringFunc(tagged, func(tag string) string {
+		fields := strings.SplitN(tag[1:len(tag)-1], ":", 3)
+
+		update := func(current *string, field string) {
+			switch field {
+			case "":
+				// Unchanged
+			case "-":
+				*current = ""
+			default:
+				*current = field
+			}
+		}
+
+		update(&fg, fields[0])
+
+		if len(fields) > 1 {
+			update(&bg, fields[1])
+		}
+
+		if len(fields) > 2 {
+			update(&attrs, fields[2])
+		}
+
+		return sgr(fg, bg, attrs)
+	})
+
+	converted = escapedTagRe.ReplaceAllString(converted, "[$1]")
+
+	// Don't let the style bleed into whatever is printed next
+	if fg != "" || bg != "" || attrs != "" {
+		converted += sgr("", "", "")
+	}
+
+	return converted
+}
+
+// sgr returns the escape code selecting the given colors and attributes.
+func sgr(fg, bg, attrs string) string {
+	codes := []string{"0"}
+
+	for _, attr := range attrs {
+		switch attr {
+		case 'b':
+			codes = append(codes, "1")
+		case 'd':
+			codes = append(codes, "2")
+		case 'i':
+			codes = append(codes, "3")
+		case 'u':
+			codes = append(codes, "4")
+		case 'r':
+			codes = append(codes, "7")
+		case 's':
+			codes = append(codes, "9")
+		}
+	}
+
+	if code := colorCode(fg, 38); code != "" {
+		codes = append(codes, code)
+	}
+
+	if code := colorCode(bg, 48); code != "" {
+		codes = append(codes, code)
+	}
+
+	return "\x1b[" + strings.Join(codes, ";") + "m"
+}
+
+// colorCode returns the 24-bit color parameters for a tview color, or an empty
+// string if it is unset or unknown. The base is 38 for foreground colors and
+// 48 for background colors.
+func colorCode(color string, base int) string {
+	if color == "" {
+		return ""
+	}
+
+	c := tcell.GetColor(color)
+	if c == tcell.ColorDefault {
+		return ""
+	}
+
+	r, g, b := c.RGB()
+	return fmt.Sprintf("%d;2;%d;%d;%d", base, r, g, b)
+}
@@ -0,0 +1,22 @@
+package markdown
+
+import "testing"
+
+func TestTviewToANSI(t *testing.T) {
+	tests := []struct {
+		tagged   string
+		expected string
+	}{
+		{"plain text", "plain text"},
+		{"[::b]bold[-:-:-] text", "\x1b[0;1mbold\x1b[0m text"},
+		{"[#ff0000]red", "\x1b[0;38;2;255;0;0mred\x1b[0m"},
+		{"[#ff0000::u]red[::-] still red[-]", "\x1b[0;4;38;2;255;0;0mred\x1b[0;38;2;255;0;0m still red\x1b[0m"},
+		{"a [link] and an escaped [tag[]", "a [link] and an escaped [tag]"},
+	}
+
+	for _, test := range tests {
+		if actual := TviewToANSI(test.tagged); actual != test.expected {
+			t.Errorf("TviewToANSI(%q) = %q, expected %q", test.tagged, actual, test.expected)
+		}
+	}
+}
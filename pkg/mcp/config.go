@@ -0,0 +1,62 @@
+package mcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ConfigFile is the file, relative to FNORD_HOME, listing the MCP servers to
+// start. It uses the same format as other MCP clients:
+//
+//	{
+//	  "mcpServers": {
+//	    "tickets": {
+//	      "command": "ticket-mcp",
+//	      "args": ["--readonly"],
+//	      "env": {"TICKETS_TOKEN": "..."}
+//	    }
+//	  }
+//	}
+const ConfigFile = "mcp.json"
+
+// ServerConfig describes how to start an MCP server.
+type ServerConfig struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args"`
+	Env     map[string]string `json:"env"`
+	Dir     string            `json:"cwd"`
+}
+
+// LoadConfig reads the MCP server configuration in the given FNORD_HOME. If
+// the file does not exist, no servers are configured.
+func LoadConfig(home string) (map[string]ServerConfig, error) {
+	path := filepath.Join(home, ConfigFile)
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Servers map[string]ServerConfig `json:"mcpServers"`
+	}
+
+	if err := json.Unmarshal(buf, &file); err != nil {
+		return nil, fmt.Errorf("invalid MCP configuration in %s: %w", path, err)
+	}
+
+	for name, server := range file.Servers {
+		if server.Command == "" {
+			return nil, fmt.Errorf("invalid MCP configuration in %s: server %s has no command", path, name)
+		}
+	}
+
+	return file.Servers, nil
+}
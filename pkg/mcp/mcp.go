@@ -0,0 +1,460 @@
+// Package mcp implements a client for Model Context Protocol servers using
+// the stdio transport, allowing the tools they provide to be offered to the
+// assistant.
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sysread/fnord/pkg/debug"
+)
+
+// ProtocolVersion is the version of the MCP specification implemented by the
+// client.
+const ProtocolVersion = "2024-11-05"
+
+// DefaultStartTimeout limits how long a server may take to start and
+// complete the initialization handshake.
+const DefaultStartTimeout = 30 * time.Second
+
+// How long Close waits for a server to exit after closing its stdin, before
+// killing it
+const closeTimeout = 2 * time.Second
+
+// JSON-RPC error code for methods the client does not implement
+const methodNotFound = -32601
+
+// Tool is a tool advertised by an MCP server.
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+// RPCError is an error returned by the server in response to a request.
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+type rpcRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      *int64      `json:"id,omitempty"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// rpcMessage is any message received from the server: a response to one of
+// our requests, a request from the server, or a notification.
+type rpcMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// Client is a connection to an MCP server running as a subprocess.
+type Client struct {
+	Name string
+
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	// Serializes writes to stdin
+	writeMutex sync.Mutex
+
+	// Requests awaiting a response, by ID
+	mutex   sync.Mutex
+	nextID  int64
+	pending map[int64]chan rpcMessage
+
+	// Closed once the server's stderr has been fully read
+	stderrDone chan struct{}
+
+	// Closed once the server has exited, after which err explains why
+	exited chan struct{}
+	err    error
+}
+
+// Start starts the server and performs the initialization handshake.
+func Start(ctx context.Context, name string, conf ServerConfig) (*Client, error) {
+	cmd := exec.Command(conf.Command, conf.Args...)
+	cmd.Dir = conf.Dir
+	cmd.Env = os.Environ()
+	for key, value := range conf.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting MCP server %s: %w", name, err)
+	}
+
+	c := &Client{
+		Name:       name,
+		cmd:        cmd,
+		stdin:      stdin,
+		pending:    map[int64]chan rpcMessage{},
+		stderrDone: make(chan struct{}),
+		exited:     make(chan struct{}),
+	}
+
+	go c.logStderr(stderr)
+	go c.readMessages(stdout)
+
+	if err := c.initialize(ctx); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error initializing MCP server %s: %w", name, err)
+	}
+
+	return c, nil
+}
+
+func (c *Client) initialize(ctx context.Context) error {
+	params := map[string]interface{}{
+		"protocolVersion": ProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo": map[string]string{
+			"name":    "fnord",
+			"version": "1.0.0",
+		},
+	}
+
+	result, err := c.call(ctx, "initialize", params)
+	if err != nil {
+		return err
+	}
+
+	var info struct {
+		ProtocolVersion string `json:"protocolVersion"`
+		ServerInfo      struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"serverInfo"`
+	}
+
+	if err := json.Unmarshal(result, &info); err != nil {
+		return fmt.Errorf("invalid initialize response: %w", err)
+	}
+
+	debug.Log("[mcp] [%s] connected to %s %s (protocol %s)", c.Name, info.ServerInfo.Name, info.ServerInfo.Version, info.ProtocolVersion)
+
+	return c.notify("notifications/initialized", nil)
+}
+
+// ListTools returns the tools advertised by the server.
+func (c *Client) ListTools(ctx context.Context) ([]Tool, error) {
+	var tools []Tool
+	var cursor string
+
+	for {
+		params := map[string]string{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+
+		result, err := c.call(ctx, "tools/list", params)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Tools      []Tool `json:"tools"`
+			NextCursor string `json:"nextCursor"`
+		}
+
+		if err := json.Unmarshal(result, &page); err != nil {
+			return nil, fmt.Errorf("invalid tools/list response: %w", err)
+		}
+
+		tools = append(tools, page.Tools...)
+
+		if page.NextCursor == "" {
+			return tools, nil
+		}
+
+		cursor = page.NextCursor
+	}
+}
+
+// CallTool calls one of the server's tools and returns its text output. If
+// the tool reports an error, the output is returned as the error.
+func (c *Client) CallTool(ctx context.Context, name string, args json.RawMessage) (string, error) {
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+
+	params := map[string]interface{}{
+		"name":      name,
+		"arguments": args,
+	}
+
+	result, err := c.call(ctx, "tools/call", params)
+	if err != nil {
+		return "", err
+	}
+
+	var response struct {
+		Content []struct {
+			Type     string `json:"type"`
+			Text     string `json:"text"`
+			MimeType string `json:"mimeType"`
+			Resource struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"resource"`
+		} `json:"content"`
+		IsError bool `json:"isError"`
+	}
+
+	if err := json.Unmarshal(result, &response); err != nil {
+		return "", fmt.Errorf("invalid tools/call response: %w", err)
+	}
+
+	// Only text can be passed on to the assistant, so other content is
+	// described instead.
+	var parts []string
+	for _, content := range response.Content {
+		switch content.Type {
+		case "text":
+			parts = append(parts, content.Text)
+
+		case "resource":
+			if content.Resource.Text != "" {
+				parts = append(parts, fmt.Sprintf("Contents of %s:\n\n%s", content.Resource.URI, content.Resource.Text))
+			} else {
+				parts = append(parts, fmt.Sprintf("[binary resource %s]", content.Resource.URI))
+			}
+
+		default:
+			parts = append(parts, fmt.Sprintf("[%s content (%s) omitted]", content.Type, content.MimeType))
+		}
+	}
+
+	output := strings.Join(parts, "\n")
+
+	if response.IsError {
+		return "", errors.New(output)
+	}
+
+	return output, nil
+}
+
+// Err returns the reason the server exited, or nil if it is still running.
+func (c *Client) Err() error {
+	select {
+	case <-c.exited:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close shuts down the server, killing it if it does not exit promptly.
+func (c *Client) Close() error {
+	c.stdin.Close()
+
+	select {
+	case <-c.exited:
+	case <-time.After(closeTimeout):
+		debug.Log("[mcp] [%s] did not exit; killing it", c.Name)
+		c.cmd.Process.Kill()
+		<-c.exited
+	}
+
+	return nil
+}
+
+// call sends a request and waits for the response.
+func (c *Client) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	respChan := make(chan rpcMessage, 1)
+
+	c.mutex.Lock()
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = respChan
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+	}()
+
+	if err := c.write(rpcRequest{JSONRPC: "2.0", ID: &id, Method: method, Params: params}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-respChan:
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+
+		return resp.Result, nil
+
+	case <-c.exited:
+		return nil, c.err
+
+	case <-ctx.Done():
+		// Let the server know that it can stop working on the request
+		c.notify("notifications/cancelled", map[string]interface{}{
+			"requestId": id,
+			"reason":    ctx.Err().Error(),
+		})
+
+		return nil, ctx.Err()
+	}
+}
+
+// notify sends a notification, which has no response.
+func (c *Client) notify(method string, params interface{}) error {
+	return c.write(rpcRequest{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (c *Client) write(msg interface{}) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	// Messages are delimited by newlines, which JSON encoding escapes
+	if _, err := c.stdin.Write(append(buf, '\n')); err != nil {
+		return fmt.Errorf("error writing to MCP server %s: %w", c.Name, err)
+	}
+
+	return nil
+}
+
+// readMessages dispatches messages from the server until it exits.
+func (c *Client) readMessages(stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if len(strings.TrimSpace(string(line))) > 0 {
+			c.dispatch(line)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	// The server has closed its stdout, which means it has exited or is
+	// about to. Wait closes the pipes, so let the rest of stderr be logged
+	// first.
+	<-c.stderrDone
+	waitErr := c.cmd.Wait()
+	if waitErr != nil {
+		c.err = fmt.Errorf("MCP server %s exited: %w", c.Name, waitErr)
+	} else {
+		c.err = fmt.Errorf("MCP server %s exited", c.Name)
+	}
+
+	debug.Log("[mcp] [%s] %s", c.Name, c.err)
+	close(c.exited)
+}
+
+func (c *Client) dispatch(line []byte) {
+	var msg rpcMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		debug.Log("[mcp] [%s] invalid message: %s", c.Name, err)
+		return
+	}
+
+	switch {
+	// A request from the server
+	case msg.Method != "" && len(msg.ID) > 0:
+		resp := rpcResponse{JSONRPC: "2.0", ID: msg.ID}
+
+		if msg.Method == "ping" {
+			resp.Result = map[string]interface{}{}
+		} else {
+			resp.Error = &RPCError{Code: methodNotFound, Message: "method not found: " + msg.Method}
+		}
+
+		if err := c.write(resp); err != nil {
+			debug.Log("[mcp] [%s] %s", c.Name, err)
+		}
+
+	// A notification from the server
+	case msg.Method != "":
+		debug.Log("[mcp] [%s] notification: %s", c.Name, msg.Method)
+
+	// A response to one of our requests
+	default:
+		var id int64
+		if err := json.Unmarshal(msg.ID, &id); err != nil {
+			debug.Log("[mcp] [%s] response with unexpected ID: %s", c.Name, msg.ID)
+			return
+		}
+
+		c.mutex.Lock()
+		respChan, ok := c.pending[id]
+		c.mutex.Unlock()
+
+		// Ignore duplicate responses rather than blocking
+		if ok {
+			select {
+			case respChan <- msg:
+			default:
+			}
+		}
+	}
+}
+
+// logStderr sends the server's stderr, where servers write their logs, to
+// the logs view.
+func (c *Client) logStderr(stderr io.Reader) {
+	defer close(c.stderrDone)
+
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		debug.Log("[mcp] [%s] %s", c.Name, scanner.Text())
+	}
+}
@@ -0,0 +1,178 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/debug"
+)
+
+// When FNORD_MCP_STUB is set, the test binary acts as a stub MCP server
+func TestMain(m *testing.M) {
+	if os.Getenv("FNORD_MCP_STUB") != "" {
+		runStubServer()
+		os.Exit(0)
+	}
+
+	// Nothing displays the logs during tests
+	go func() {
+		for range debug.LogChannel {
+		}
+	}()
+
+	os.Exit(m.Run())
+}
+
+// runStubServer implements just enough of an MCP server to test the client.
+// It provides an "echo" tool, a "fail" tool that reports an error, and a
+// "crash" tool that exits without responding.
+func runStubServer() {
+	scanner := bufio.NewScanner(os.Stdin)
+	encoder := json.NewEncoder(os.Stdout)
+
+	for scanner.Scan() {
+		var req struct {
+			ID     *int64          `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintf(os.Stderr, "bad request: %s\n", err)
+			continue
+		}
+
+		// Notifications need no response
+		if req.ID == nil {
+			continue
+		}
+
+		var result interface{}
+
+		switch req.Method {
+		case "initialize":
+			fmt.Fprintln(os.Stderr, "stub server starting")
+
+			result = map[string]interface{}{
+				"protocolVersion": ProtocolVersion,
+				"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+				"serverInfo":      map[string]string{"name": "stub", "version": "0.1"},
+			}
+
+		case "tools/list":
+			result = map[string]interface{}{
+				"tools": []map[string]interface{}{
+					{"name": "echo", "description": "Echoes its input", "inputSchema": map[string]interface{}{"type": "object"}},
+					{"name": "fail", "description": "Always fails"},
+					{"name": "crash", "description": "Crashes the server"},
+				},
+			}
+
+		case "tools/call":
+			var call struct {
+				Name      string          `json:"name"`
+				Arguments json.RawMessage `json:"arguments"`
+			}
+
+			json.Unmarshal(req.Params, &call)
+
+			switch call.Name {
+			case "echo":
+				result = map[string]interface{}{
+					"content": []map[string]string{{"type": "text", "text": string(call.Arguments)}},
+				}
+
+			case "fail":
+				result = map[string]interface{}{
+					"content": []map[string]string{{"type": "text", "text": "something went wrong"}},
+					"isError": true,
+				}
+
+			case "crash":
+				fmt.Fprintln(os.Stderr, "crashing")
+				os.Exit(2)
+			}
+		}
+
+		encoder.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+	}
+}
+
+func startStub(t *testing.T) *Client {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := Start(ctx, "stub", ServerConfig{
+		Command: executable,
+		Env:     map[string]string{"FNORD_MCP_STUB": "1"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestClient(t *testing.T) {
+	client := startStub(t)
+	ctx := context.Background()
+
+	tools, err := client.ListTools(ctx)
+	assert.NoError(t, err)
+
+	if assert.Len(t, tools, 3) {
+		assert.Equal(t, "echo", tools[0].Name)
+		assert.JSONEq(t, `{"type": "object"}`, string(tools[0].InputSchema))
+	}
+
+	output, err := client.CallTool(ctx, "echo", json.RawMessage(`{"text":"hello"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"text":"hello"}`, output)
+
+	_, err = client.CallTool(ctx, "fail", nil)
+	assert.EqualError(t, err, "something went wrong")
+
+	assert.NoError(t, client.Err())
+}
+
+func TestClientServerCrash(t *testing.T) {
+	client := startStub(t)
+	ctx := context.Background()
+
+	_, err := client.CallTool(ctx, "crash", nil)
+	assert.ErrorContains(t, err, "MCP server stub exited: exit status 2")
+
+	// Later calls fail immediately
+	_, err = client.CallTool(ctx, "echo", nil)
+	assert.ErrorContains(t, err, "MCP server stub exited")
+	assert.Error(t, client.Err())
+}
+
+func TestLoadConfig(t *testing.T) {
+	home := t.TempDir()
+
+	servers, err := LoadConfig(home)
+	assert.NoError(t, err)
+	assert.Empty(t, servers)
+
+	os.WriteFile(home+"/"+ConfigFile, []byte(`{"mcpServers": {"tickets": {"command": "ticket-mcp", "args": ["--readonly"]}}}`), 0644)
+
+	servers, err = LoadConfig(home)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]ServerConfig{"tickets": {Command: "ticket-mcp", Args: []string{"--readonly"}}}, servers)
+}
@@ -2,7 +2,9 @@ package messages
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/sysread/fnord/pkg/util"
 )
@@ -50,13 +52,41 @@ type Message struct {
 	// A message's raw, unformatted content, as it was entered by the user or
 	// returned from the assistant.
 	Content string `json:"content"`
+
+	// Indicates that an *assistant* message was cut short because the user
+	// cancelled the response.
+	IsIncomplete bool `json:"is_incomplete"`
+
+	// The error that ended an *assistant* message's response, if the
+	// response failed. A failed response may have no content at all.
+	Error string `json:"error,omitempty"`
+
+	// When the message was added to the conversation.
+	Timestamp time.Time `json:"timestamp"`
+
+	// The file attached with `\f`, or the command whose output was attached
+	// with `\x`, if the message is part of an attachment.
+	Attachment string `json:"attachment,omitempty"`
+
+	// The tools called by the assistant while writing an *assistant*
+	// message.
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// ToolCall records a tool called by the assistant.
+type ToolCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Output    string `json:"output"`
+	Failed    bool   `json:"failed,omitempty"`
 }
 
 func NewMessage(from Sender, content string, isHidden bool) Message {
 	return Message{
-		From:     from,
-		Content:  util.TrimMessage(content),
-		IsHidden: isHidden,
+		From:      from,
+		Content:   util.TrimMessage(content),
+		IsHidden:  isHidden,
+		Timestamp: time.Now(),
 	}
 }
 
@@ -64,6 +94,12 @@ func (m *Message) IsUserMessage() bool {
 	return m.From == You
 }
 
+// IsFailed reports whether an *assistant* message's response ended in an
+// error.
+func (m *Message) IsFailed() bool {
+	return m.Error != ""
+}
+
 //------------------------------------------------------------------------------
 // Conversation
 //------------------------------------------------------------------------------
@@ -100,10 +136,59 @@ func (c *Conversation) ChatTranscript() string {
 	var buf strings.Builder
 
 	for _, message := range c.Messages {
-		if message.From != System {
+		if message.From == System {
+			continue
+		}
+
+		if message.IsIncomplete {
+			buf.WriteString(fmt.Sprintf("%s (incomplete): %s\n\n", message.From, message.Content))
+		} else if message.IsFailed() {
+			buf.WriteString(fmt.Sprintf("%s (failed): %s\n\n", message.From, message.Content))
+		} else {
 			buf.WriteString(fmt.Sprintf("%s: %s\n\n", message.From, message.Content))
 		}
 	}
 
 	return buf.String()
 }
+
+// Matches the start of each message in a chat transcript
+var transcriptMessageRe = regexp.MustCompile(`(?m)^(You|Assistant)( \((incomplete|failed)\))?: `)
+
+// ParseTranscript rebuilds a conversation from a transcript produced by
+// ChatTranscript. Transcripts are lossy: system messages are not included,
+// hidden messages cannot be distinguished from visible ones, and a line
+// within a message that happens to begin with a sender's name will be read as
+// the start of a new message. A failed response's error is not included, so
+// it is restored with a generic one. It is only used for conversations stored
+// before their messages were stored individually.
+func ParseTranscript(transcript string) *Conversation {
+	conversation := NewConversation()
+
+	matches := transcriptMessageRe.FindAllStringSubmatchIndex(transcript, -1)
+
+	for i, match := range matches {
+		end := len(transcript)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+
+		msg := Message{
+			From:    Sender(transcript[match[2]:match[3]]),
+			Content: strings.TrimSpace(transcript[match[1]:end]),
+		}
+
+		if match[6] != -1 {
+			switch transcript[match[6]:match[7]] {
+			case "incomplete":
+				msg.IsIncomplete = true
+			case "failed":
+				msg.Error = "the response failed"
+			}
+		}
+
+		conversation.AddMessage(msg)
+	}
+
+	return conversation
+}
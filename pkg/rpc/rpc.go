@@ -0,0 +1,630 @@
+// Package rpc drives the assistant with JSON-RPC 2.0 over stdin and stdout,
+// so that editor extensions can use the chat without the UI. Each message is
+// a single line of JSON.
+//
+// Methods:
+//
+//	status                               box, project, backend, and model
+//	newConversation                      start a conversation
+//	sendMessage {conversationId, ...}    send a message, and receive the response
+//	cancel {conversationId}              cancel the response being received
+//	listConversations                    list the box's conversations
+//	getConversation {conversationId}     read a conversation
+//	searchConversations {query, limit}   search the box's conversations
+//	searchFacts {query, limit}           search the box's facts
+//	searchProject {query, limit}         search the project's files
+//
+// sendMessage takes the message's content, and any of: files, a list of
+// paths to attach; selections, a list of {path, startLine, endLine, text}
+// attaching the text selected in an editor; and attachments, a list of
+// {name, content}. If conversationId is empty, a new conversation is
+// started. While the response is received, each gpt.Event is sent as an
+// "event" notification, with the conversationId added to its fields. Once
+// the response has finished, the result is {conversationId, message}.
+//
+// Requests are handled concurrently, so that a response may be cancelled
+// while it is received. A stored conversation is resumed the first time it
+// is used.
+//
+// Tools under the "ask" policy are approved by the client: fnord sends an
+// approveToolCall request with {tool, arguments}, to which the client
+// responds with {approved, arguments}. The arguments may be edited before
+// they are approved.
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sysread/fnord/pkg/chat_manager"
+	"github.com/sysread/fnord/pkg/debug"
+	"github.com/sysread/fnord/pkg/fnord"
+	"github.com/sysread/fnord/pkg/gpt"
+	"github.com/sysread/fnord/pkg/messages"
+	"github.com/sysread/fnord/pkg/sessions"
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+const protocolVersion = "2.0"
+
+// Error codes. The codes from -32000 down are fnord's own.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	CodeNotFound       = -32000 // The conversation or project does not exist
+	CodeBusy           = -32001 // The conversation is already receiving a response
+	CodeBackend        = -32002 // The assistant could not be reached
+)
+
+// Error is a JSON-RPC error.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(code int, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// incoming is a request, notification, or response received from the
+// client.
+type incoming struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Result  json.RawMessage `json:"result"`
+	Error   *Error          `json:"error"`
+}
+
+type request struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      any    `json:"id,omitempty"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result"`
+}
+
+type errorResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   *Error          `json:"error"`
+}
+
+// Server handles requests read from the client.
+type Server struct {
+	fnord *fnord.Fnord
+
+	out      io.Writer
+	outMutex sync.Mutex
+
+	// Conversations used since the server started
+	sessions *sessions.Manager
+
+	// Requests sent to the client that are awaiting its response, by ID
+	mutex   sync.Mutex
+	pending map[string]chan incoming
+	lastID  int
+
+	// Closed once the client has closed stdin
+	closed chan struct{}
+
+	// Requests being handled
+	running sync.WaitGroup
+}
+
+// Serve handles requests from stdin until it is closed. It returns the
+// process's exit status.
+func Serve(f *fnord.Fnord) int {
+	// There is no log view to drain the logs, and stdout is reserved for
+	// the protocol.
+	debug.Discard()
+
+	s := New(f, os.Stdout)
+	gpt.Tools.SetApprover(s.ApproveToolCall)
+
+	if err := s.Run(os.Stdin); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// New creates a Server writing to out.
+func New(f *fnord.Fnord, out io.Writer) *Server {
+	return &Server{
+		fnord:    f,
+		out:      out,
+		sessions: sessions.NewManager(f),
+		pending:  map[string]chan incoming{},
+		closed:   make(chan struct{}),
+	}
+}
+
+// Run reads messages from in until it is closed, handling each request in
+// its own goroutine. Once in is closed, any responses being received are
+// cancelled, and Run returns when their requests have finished.
+func (s *Server) Run(in io.Reader) error {
+	reader := bufio.NewReader(in)
+
+	var err error
+	for err == nil {
+		var line []byte
+
+		// Lines are not limited in length, since they may hold attachments
+		line, err = reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			s.receive(line)
+		}
+	}
+
+	close(s.closed)
+
+	s.sessions.CancelAll()
+
+	s.running.Wait()
+
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
+
+// receive handles a line read from the client.
+func (s *Server) receive(line []byte) {
+	var msg incoming
+	if err := json.Unmarshal(line, &msg); err != nil {
+		s.writeError(json.RawMessage("null"), newError(CodeParseError, "invalid JSON: %v", err))
+		return
+	}
+
+	if msg.JSONRPC != protocolVersion {
+		s.writeError(msg.ID, newError(CodeInvalidRequest, `jsonrpc must be "%s"`, protocolVersion))
+		return
+	}
+
+	// A response to a request sent to the client
+	if msg.Method == "" {
+		s.deliver(msg)
+		return
+	}
+
+	s.running.Add(1)
+
+	go func() {
+		defer s.running.Done()
+
+		debug.Log("[rpc] %s", msg.Method)
+
+		result, err := s.call(msg.Method, msg.Params)
+
+		// Notifications are not answered
+		if msg.ID == nil {
+			if err != nil {
+				debug.Log("[rpc] Error in notification %s: %v", msg.Method, err)
+			}
+
+			return
+		}
+
+		if err != nil {
+			var rpcErr *Error
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &Error{Code: errorCode(err), Message: err.Error()}
+			}
+
+			s.writeError(msg.ID, rpcErr)
+			return
+		}
+
+		s.write(response{JSONRPC: protocolVersion, ID: msg.ID, Result: result})
+	}()
+}
+
+// call runs the method.
+func (s *Server) call(method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "status":
+		return s.status()
+	case "newConversation":
+		return s.newConversation()
+	case "sendMessage":
+		return s.sendMessage(params)
+	case "cancel":
+		return s.cancel(params)
+	case "listConversations":
+		return s.listConversations()
+	case "getConversation":
+		return s.getConversation(params)
+	case "searchConversations":
+		return s.search(params, storage.SearchConversations)
+	case "searchFacts":
+		return s.search(params, storage.SearchFacts)
+	case "searchProject":
+		if s.fnord.Config.ProjectPath == "" {
+			return nil, newError(CodeNotFound, "no project is selected (see --project)")
+		}
+
+		return s.search(params, storage.SearchProject)
+	default:
+		return nil, newError(CodeMethodNotFound, "unknown method: %s", method)
+	}
+}
+
+//------------------------------------------------------------------------------
+// Methods
+//------------------------------------------------------------------------------
+
+type conversationParams struct {
+	ConversationID string `json:"conversationId"`
+}
+
+type searchParams struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit"`
+}
+
+type sendMessageParams struct {
+	ConversationID string                `json:"conversationId"`
+	Content        string                `json:"content"`
+	Files          []string              `json:"files"`
+	Selections     []selection           `json:"selections"`
+	Attachments    []sessions.Attachment `json:"attachments"`
+}
+
+// selection is text selected in an editor. The lines are numbered from 1.
+type selection struct {
+	Path      string `json:"path"`
+	StartLine int    `json:"startLine"`
+	EndLine   int    `json:"endLine"`
+	Text      string `json:"text"`
+}
+
+type sendMessageResult struct {
+	ConversationID string            `json:"conversationId"`
+	Message        *messages.Message `json:"message"`
+}
+
+// eventParams are the params of an "event" notification.
+type eventParams struct {
+	ConversationID string `json:"conversationId"`
+	gpt.Event
+}
+
+func (s *Server) status() (any, error) {
+	return s.sessions.Status(), nil
+}
+
+func (s *Server) newConversation() (any, error) {
+	sess, err := s.sessions.Start(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return conversationParams{ConversationID: sess.ID()}, nil
+}
+
+func (s *Server) sendMessage(params json.RawMessage) (any, error) {
+	var p sendMessageParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	msgs, err := p.messages()
+	if err != nil {
+		return nil, err
+	}
+
+	var sess *sessions.Session
+	if p.ConversationID == "" {
+		sess, err = s.sessions.Start(true)
+	} else {
+		sess, err = s.sessions.Acquire(p.ConversationID)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.sessions.Release(sess)
+
+	id := sess.ID()
+
+	msg, err := sess.Send(msgs, func(event gpt.Event) {
+		s.write(request{
+			JSONRPC: protocolVersion,
+			Method:  "event",
+			Params:  eventParams{ConversationID: id, Event: event},
+		})
+	})
+
+	// A failed response was sent as an error event, and is returned with
+	// its error recorded in the message.
+	if msg == nil {
+		return nil, err
+	}
+
+	return sendMessageResult{ConversationID: id, Message: msg}, nil
+}
+
+// messages creates the messages to send, with their attachments.
+func (p *sendMessageParams) messages() ([]messages.Message, error) {
+	msgs := []messages.Message{}
+
+	if content := strings.TrimSpace(p.Content); content != "" {
+		msgs = append(msgs, messages.NewMessage(messages.You, content, false))
+	}
+
+	for _, path := range p.Files {
+		attached, err := chat_manager.AttachFile(path)
+		if err != nil {
+			return nil, newError(CodeInvalidParams, "%v", err)
+		}
+
+		msgs = append(msgs, attached...)
+	}
+
+	for _, sel := range p.Selections {
+		if sel.Path == "" {
+			return nil, newError(CodeInvalidParams, "selections must have a path")
+		}
+
+		name := sel.Path
+		if sel.StartLine > 0 && sel.EndLine >= sel.StartLine {
+			name = fmt.Sprintf("%s:L%d-L%d", sel.Path, sel.StartLine, sel.EndLine)
+		}
+
+		msgs = append(msgs, chat_manager.AttachInput(name, sel.Text)...)
+	}
+
+	attached, err := sessions.Attach(p.Attachments)
+	if err != nil {
+		return nil, newError(CodeInvalidParams, "%v", err)
+	}
+
+	msgs = append(msgs, attached...)
+
+	if len(msgs) == 0 {
+		return nil, newError(CodeInvalidParams, "the message is empty")
+	}
+
+	return msgs, nil
+}
+
+func (s *Server) cancel(params json.RawMessage) (any, error) {
+	var p conversationParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	s.sessions.Cancel(p.ConversationID)
+
+	return nil, nil
+}
+
+func (s *Server) listConversations() (any, error) {
+	conversations, err := storage.ListConversations()
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions.Summarize(conversations), nil
+}
+
+func (s *Server) getConversation(params json.RawMessage) (any, error) {
+	var p conversationParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	conversation, err := storage.LoadConversation(p.ConversationID)
+	if err != nil {
+		return nil, newError(CodeNotFound, "%v", err)
+	}
+
+	return conversation, nil
+}
+
+func (s *Server) search(params json.RawMessage, search func(string, int) ([]storage.Result, error)) (any, error) {
+	var p searchParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(p.Query) == "" {
+		return nil, newError(CodeInvalidParams, "the query is required")
+	}
+
+	if p.Limit == 0 {
+		p.Limit = sessions.DefaultSearchResults
+	} else if err := sessions.CheckSearchLimit(p.Limit); err != nil {
+		return nil, newError(CodeInvalidParams, "%v", err)
+	}
+
+	results, err := search(p.Query, p.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions.NewResults(results), nil
+}
+
+//------------------------------------------------------------------------------
+// Tool approval
+//------------------------------------------------------------------------------
+
+type approvalParams struct {
+	Tool      string `json:"tool"`
+	Arguments string `json:"arguments"`
+}
+
+type approvalResult struct {
+	Approved  bool   `json:"approved"`
+	Arguments string `json:"arguments"`
+}
+
+// ApproveToolCall asks the client whether the assistant may call a tool. The
+// call is denied if the client responds with an error, or if ctx is
+// cancelled first.
+func (s *Server) ApproveToolCall(ctx context.Context, tool gpt.Tool, argsJSON string) gpt.ToolApproval {
+	denied := gpt.ToolApproval{Approved: false, Arguments: argsJSON}
+
+	reply, err := s.request(ctx, "approveToolCall", approvalParams{Tool: tool.Name(), Arguments: argsJSON})
+	if err != nil {
+		debug.Log("[rpc] Tool call to %s not approved: %v", tool.Name(), err)
+		return denied
+	}
+
+	var approval approvalResult
+	if err := json.Unmarshal(reply, &approval); err != nil {
+		debug.Log("[rpc] Invalid approval of tool call to %s: %v", tool.Name(), err)
+		return denied
+	}
+
+	if approval.Arguments == "" {
+		approval.Arguments = argsJSON
+	}
+
+	return gpt.ToolApproval{Approved: approval.Approved, Arguments: approval.Arguments}
+}
+
+// request sends a request to the client and waits for its result.
+func (s *Server) request(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	reply := make(chan incoming, 1)
+
+	s.mutex.Lock()
+	s.lastID++
+	id := fmt.Sprintf("fnord-%d", s.lastID)
+	s.pending[id] = reply
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.pending, id)
+		s.mutex.Unlock()
+	}()
+
+	s.write(request{JSONRPC: protocolVersion, ID: id, Method: method, Params: params})
+
+	select {
+	case msg := <-reply:
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+
+		return msg.Result, nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+
+	case <-s.closed:
+		return nil, errors.New("the client has gone away")
+	}
+}
+
+// deliver passes a response from the client to the request awaiting it. The
+// request is forgotten, so that a repeated response is ignored, rather than
+// blocking the reader on the reply channel, which holds only one response.
+func (s *Server) deliver(msg incoming) {
+	var id string
+	json.Unmarshal(msg.ID, &id)
+
+	s.mutex.Lock()
+	reply, ok := s.pending[id]
+	delete(s.pending, id)
+	s.mutex.Unlock()
+
+	if !ok {
+		debug.Log("[rpc] Response to unknown request %s", msg.ID)
+		return
+	}
+
+	reply <- msg
+}
+
+//------------------------------------------------------------------------------
+// Helpers
+//------------------------------------------------------------------------------
+
+// errorCode returns the error code matching an error from the sessions
+// package.
+func errorCode(err error) int {
+	var sessErr *sessions.Error
+	if errors.As(err, &sessErr) {
+		switch sessErr.Kind {
+		case sessions.NotFound:
+			return CodeNotFound
+		case sessions.Busy:
+			return CodeBusy
+		case sessions.Backend:
+			return CodeBackend
+		}
+	}
+
+	return CodeInternalError
+}
+
+// decodeParams decodes the params of a request. Missing params are treated
+// as empty.
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return newError(CodeInvalidParams, "invalid params: %v", err)
+	}
+
+	return nil
+}
+
+// write writes a message to the client, on a line of its own.
+func (s *Server) write(msg any) {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		debug.Log("[rpc] Error serializing message: %v", err)
+		return
+	}
+
+	s.outMutex.Lock()
+	defer s.outMutex.Unlock()
+
+	if _, err := s.out.Write(append(buf, '\n')); err != nil {
+		debug.Log("[rpc] Error writing message: %v", err)
+	}
+}
+
+func (s *Server) writeError(id json.RawMessage, err *Error) {
+	debug.Log("[rpc] Error (%d): %s", err.Code, err.Message)
+
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+
+	s.write(errorResponse{JSONRPC: protocolVersion, ID: id, Error: err})
+}
@@ -0,0 +1,190 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/debug"
+	"github.com/sysread/fnord/pkg/fnord"
+	"github.com/sysread/fnord/pkg/gpt"
+	"github.com/sysread/fnord/pkg/messages"
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+// Nothing displays the logs during tests
+func TestMain(m *testing.M) {
+	debug.Discard()
+	os.Exit(m.Run())
+}
+
+// fakeClient responds to every message with the same text.
+type fakeClient struct{}
+
+func (c *fakeClient) GetCompletion(string, string) (string, error)  { return "A title", nil }
+func (c *fakeClient) CreateThread() (string, error)                 { return "thread_rpc", nil }
+func (c *fakeClient) AddMessage(string, string) error               { return nil }
+func (c *fakeClient) ResumeThread(string, []messages.Message) error { return nil }
+func (c *fakeClient) Model() string                                 { return "fake-model" }
+func (c *fakeClient) CancelRun(string) error                        { return nil }
+
+func (c *fakeClient) RunThread(ctx context.Context, threadID string, events chan<- gpt.Event) {
+	events <- gpt.Event{Type: gpt.EventTextDelta, Text: "Frobnicate nightly."}
+	events <- gpt.Event{Type: gpt.EventDone}
+	close(events)
+}
+
+// client is the editor's end of the connection.
+type client struct {
+	in  *io.PipeWriter
+	out *bufio.Scanner
+}
+
+func (c *client) send(t *testing.T, line string) {
+	_, err := fmt.Fprintln(c.in, line)
+	assert.NoError(t, err)
+}
+
+func (c *client) receive(t *testing.T) map[string]any {
+	assert.True(t, c.out.Scan())
+
+	var msg map[string]any
+	assert.NoError(t, json.Unmarshal(c.out.Bytes(), &msg))
+	return msg
+}
+
+func newTestServer(t *testing.T) (*Server, *client) {
+	cfg := &config.Config{
+		Home:              t.TempDir(),
+		Box:               "rpc_box",
+		Backend:           config.BackendChat,
+		EmbeddingProvider: config.EmbeddingProviderLocal,
+	}
+
+	assert.NoError(t, storage.Init(cfg))
+	assert.NoError(t, storage.InitializeConversationsCollection(cfg))
+	assert.NoError(t, storage.InitializeFactsCollection(cfg))
+
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+
+	s := New(&fnord.Fnord{Config: cfg, GptClient: &fakeClient{}}, outWriter)
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run(inReader) }()
+
+	t.Cleanup(func() {
+		inWriter.Close()
+		assert.NoError(t, <-done)
+		outWriter.Close()
+	})
+
+	scanner := bufio.NewScanner(outReader)
+	scanner.Buffer(nil, 1<<20)
+
+	return s, &client{in: inWriter, out: scanner}
+}
+
+func TestSendMessage(t *testing.T) {
+	_, c := newTestServer(t)
+
+	c.send(t, `{"jsonrpc": "2.0", "id": 1, "method": "sendMessage", "params": {"content": "When?", "selections": [{"path": "main.go", "startLine": 10, "endLine": 12, "text": "func main() {}"}]}}`)
+
+	event := c.receive(t)
+	assert.Equal(t, "event", event["method"])
+	assert.Equal(t, map[string]any{"conversationId": "thread_rpc", "type": "text_delta", "text": "Frobnicate nightly."}, event["params"])
+
+	event = c.receive(t)
+	assert.Equal(t, "done", event["params"].(map[string]any)["type"])
+
+	res := c.receive(t)
+	assert.Equal(t, float64(1), res["id"])
+	result := res["result"].(map[string]any)
+	assert.Equal(t, "thread_rpc", result["conversationId"])
+	assert.Equal(t, "Frobnicate nightly.", result["message"].(map[string]any)["content"])
+
+	c.send(t, `{"jsonrpc": "2.0", "id": 2, "method": "getConversation", "params": {"conversationId": "thread_rpc"}}`)
+	res = c.receive(t)
+	conversation := res["result"].(map[string]any)
+	msgs := conversation["messages"].([]any)
+	assert.Len(t, msgs, 4)
+	assert.Equal(t, "main.go:L10-L12", msgs[1].(map[string]any)["attachment"])
+
+	c.send(t, `{"jsonrpc": "2.0", "id": 3, "method": "listConversations"}`)
+	res = c.receive(t)
+	assert.Len(t, res["result"], 1)
+}
+
+func TestErrors(t *testing.T) {
+	_, c := newTestServer(t)
+
+	tests := []struct {
+		line string
+		code int
+	}{
+		{`{"jsonrpc": "2.0", "id": 1, "method": "frobnicate"}`, CodeMethodNotFound},
+		{`{"jsonrpc": "2.0", "id": 2, "method": "sendMessage", "params": {"content": " "}}`, CodeInvalidParams},
+		{`{"jsonrpc": "2.0", "id": 3, "method": "sendMessage", "params": {"files": ["does/not/exist.go"]}}`, CodeInvalidParams},
+		{`{"jsonrpc": "2.0", "id": 4, "method": "getConversation", "params": {"conversationId": "thread_nope"}}`, CodeNotFound},
+		{`{"jsonrpc": "2.0", "id": 5, "method": "searchFacts", "params": {"query": "widget", "limit": 1000}}`, CodeInvalidParams},
+		{`{"jsonrpc": "1.0", "id": 6, "method": "status"}`, CodeInvalidRequest},
+		{`{"jsonrpc": "2.0", "id": 7,`, CodeParseError},
+	}
+
+	for _, test := range tests {
+		c.send(t, test.line)
+
+		res := c.receive(t)
+		assert.Equal(t, float64(test.code), res["error"].(map[string]any)["code"], test.line)
+	}
+
+	// Notifications are not answered
+	c.send(t, `{"jsonrpc": "2.0", "method": "cancel", "params": {"conversationId": "thread_nope"}}`)
+	c.send(t, `{"jsonrpc": "2.0", "id": 8, "method": "status"}`)
+
+	res := c.receive(t)
+	assert.Equal(t, float64(8), res["id"])
+	assert.Equal(t, "rpc_box", res["result"].(map[string]any)["box"])
+}
+
+func TestApproveToolCall(t *testing.T) {
+	s, c := newTestServer(t)
+
+	tool := &gpt.FunctionTool{ToolName: "frobnicate"}
+
+	approval := make(chan gpt.ToolApproval)
+	go func() { approval <- s.ApproveToolCall(context.Background(), tool, `{"widget": 1}`) }()
+
+	req := c.receive(t)
+	assert.Equal(t, "approveToolCall", req["method"])
+	assert.Equal(t, map[string]any{"tool": "frobnicate", "arguments": `{"widget": 1}`}, req["params"])
+
+	c.send(t, fmt.Sprintf(`{"jsonrpc": "2.0", "id": %q, "result": {"approved": true, "arguments": "{\"widget\": 2}"}}`, req["id"]))
+	assert.Equal(t, gpt.ToolApproval{Approved: true, Arguments: `{"widget": 2}`}, <-approval)
+
+	go func() { approval <- s.ApproveToolCall(context.Background(), tool, `{"widget": 1}`) }()
+
+	req = c.receive(t)
+	c.send(t, fmt.Sprintf(`{"jsonrpc": "2.0", "id": %q, "error": {"code": -1, "message": "no"}}`, req["id"]))
+	assert.Equal(t, gpt.ToolApproval{Approved: false, Arguments: `{"widget": 1}`}, <-approval)
+
+	// Repeated responses are ignored, rather than stopping the server
+	go func() { approval <- s.ApproveToolCall(context.Background(), tool, `{"widget": 1}`) }()
+
+	req = c.receive(t)
+	for i := 0; i < 3; i++ {
+		c.send(t, fmt.Sprintf(`{"jsonrpc": "2.0", "id": %q, "result": {"approved": true, "arguments": "{}"}}`, req["id"]))
+	}
+
+	assert.Equal(t, gpt.ToolApproval{Approved: true, Arguments: `{}`}, <-approval)
+
+	c.send(t, `{"jsonrpc": "2.0", "id": 1, "method": "status"}`)
+	assert.Equal(t, float64(1), c.receive(t)["id"])
+}
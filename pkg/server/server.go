@@ -0,0 +1,617 @@
+// Package server exposes fnord as a local HTTP API, so that editors and other
+// front ends may share the same boxes, facts, and project index as the UI.
+//
+// Requests and responses are JSON. Errors are returned as {"error": "..."}.
+// Requests with a body must be sent as application/json, which browsers
+// cannot do across origins without a CORS preflight, which the server does
+// not allow.
+//
+// Every request must present the token generated when the server starts, as
+// "Authorization: Bearer <token>". The token is printed on startup and
+// written to $FNORD_HOME/server.token, readable only by the user. Requests
+// whose Host is not a loopback address, localhost, or the listen address are
+// refused, so that a page that rebinds its own domain name to the loopback
+// address cannot reach the API, even though its requests are then
+// same-origin.
+//
+//	GET    /status                          box, project, and model
+//	GET    /conversations                   list the box's conversations
+//	GET    /conversations/search?q=&limit=  search the box's conversations
+//	POST   /conversations                   start a conversation
+//	GET    /conversations/{id}              read a conversation
+//	DELETE /conversations/{id}              delete a conversation
+//	POST   /conversations/{id}/messages     send a message, and receive the response
+//	POST   /conversations/{id}/cancel       cancel the response being received
+//	GET    /facts                           list the box's facts
+//	GET    /facts/search?q=&limit=          search the box's facts
+//	POST   /facts                           save a fact
+//	GET    /facts/{id}                      read a fact
+//	PUT    /facts/{id}                      update a fact
+//	DELETE /facts/{id}                      delete a fact
+//	GET    /project/search?q=&limit=        search the project's files
+//
+// A message is sent as {"content": "...", "attachments": [{"name": "...",
+// "content": "..."}]}. If the request accepts text/event-stream, the
+// response is streamed as server-sent events, one per gpt.Event, followed by
+// a "message" event with the assistant's complete message. Otherwise, the
+// complete message is returned once the response has finished.
+//
+// A stored conversation is resumed the first time it is used.
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sysread/fnord/pkg/debug"
+	"github.com/sysread/fnord/pkg/fnord"
+	"github.com/sysread/fnord/pkg/gpt"
+	"github.com/sysread/fnord/pkg/messages"
+	"github.com/sysread/fnord/pkg/sessions"
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+// Largest request body accepted, which must hold a message's attachments
+const maxRequestBody = 32 << 20
+
+// TokenFile is the file, in FNORD_HOME, to which Serve writes the token that
+// requests must present.
+const TokenFile = "server.token"
+
+// Server handles API requests.
+type Server struct {
+	fnord *fnord.Fnord
+
+	// The token each request must present
+	token string
+
+	// Conversations used since the server started
+	sessions *sessions.Manager
+}
+
+// messageRequest is the body of a request to send a message.
+type messageRequest struct {
+	Content     string                `json:"content"`
+	Attachments []sessions.Attachment `json:"attachments"`
+}
+
+// factRequest is the body of a request to save a fact.
+type factRequest struct {
+	Content string `json:"content"`
+}
+
+// Serve listens on the configured address and handles API requests until
+// the process is stopped. It returns the process's exit status.
+func Serve(f *fnord.Fnord) int {
+	// There is no log view to drain the logs
+	debug.Discard()
+
+	token, err := newToken()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	tokenPath := filepath.Join(f.Config.Home, TokenFile)
+	if err := os.WriteFile(tokenPath, []byte(token+"\n"), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	defer os.Remove(tokenPath)
+
+	fmt.Fprintf(os.Stderr, "Serving box %s on http://%s\n", f.Config.Box, f.Config.Listen)
+	fmt.Fprintf(os.Stderr, "Token (also in %s): %s\n", tokenPath, token)
+
+	if err := http.ListenAndServe(f.Config.Listen, New(f, token).Handler()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// New creates a Server that accepts requests presenting token.
+func New(f *fnord.Fnord, token string) *Server {
+	return &Server{
+		fnord:    f,
+		token:    token,
+		sessions: sessions.NewManager(f),
+	}
+}
+
+// newToken generates a random token for a run of the server.
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating a token: %w", err)
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// Handler returns the handler routing requests to the API's endpoints.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /status", s.getStatus)
+
+	mux.HandleFunc("GET /conversations", s.listConversations)
+	mux.HandleFunc("GET /conversations/search", s.searchConversations)
+	mux.HandleFunc("POST /conversations", s.createConversation)
+	mux.HandleFunc("GET /conversations/{id}", s.getConversation)
+	mux.HandleFunc("DELETE /conversations/{id}", s.deleteConversation)
+	mux.HandleFunc("POST /conversations/{id}/messages", s.postMessage)
+	mux.HandleFunc("POST /conversations/{id}/cancel", s.cancelResponse)
+
+	mux.HandleFunc("GET /facts", s.listFacts)
+	mux.HandleFunc("GET /facts/search", s.searchFacts)
+	mux.HandleFunc("POST /facts", s.createFact)
+	mux.HandleFunc("GET /facts/{id}", s.getFact)
+	mux.HandleFunc("PUT /facts/{id}", s.updateFact)
+	mux.HandleFunc("DELETE /facts/{id}", s.deleteFact)
+
+	mux.HandleFunc("GET /project/search", s.searchProject)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		debug.Log("[server] %s %s", r.Method, r.URL.Path)
+
+		if !s.allowedHost(r.Host) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("requests for host %q are not accepted", r.Host))
+			return
+		}
+
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("a valid token is required (see "+TokenFile+")"))
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost reports whether the request's Host header names the server:
+// localhost, a loopback address, or the host of the listen address.
+func (s *Server) allowedHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	listenHost, _, err := net.SplitHostPort(s.fnord.Config.Listen)
+	return err == nil && listenHost != "" && strings.EqualFold(host, listenHost)
+}
+
+// authorized reports whether the request presents the server's token.
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && s.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+//------------------------------------------------------------------------------
+// Status
+//------------------------------------------------------------------------------
+
+func (s *Server) getStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.sessions.Status())
+}
+
+//------------------------------------------------------------------------------
+// Conversations
+//------------------------------------------------------------------------------
+
+func (s *Server) listConversations(w http.ResponseWriter, r *http.Request) {
+	conversations, err := storage.ListConversations()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sessions.Summarize(conversations))
+}
+
+func (s *Server) searchConversations(w http.ResponseWriter, r *http.Request) {
+	query, limit, err := searchParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	results, err := storage.SearchConversations(query, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sessions.NewResults(results))
+}
+
+func (s *Server) createConversation(w http.ResponseWriter, r *http.Request) {
+	sess, err := s.sessions.Start(false)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]string{"id": sess.ID()})
+}
+
+func (s *Server) getConversation(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	conversation, err := storage.LoadConversation(id)
+	if err != nil {
+		// A conversation is not stored until its first message is added
+		if s.sessions.Started(id) {
+			writeJSON(w, http.StatusOK, &storage.Conversation{ID: id, Box: s.fnord.Config.Box, Messages: []messages.Message{}})
+			return
+		}
+
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, conversation)
+}
+
+func (s *Server) deleteConversation(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if err := s.sessions.Delete(id); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) postMessage(w http.ResponseWriter, r *http.Request) {
+	var req messageRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	msgs := []messages.Message{}
+
+	if content := strings.TrimSpace(req.Content); content != "" {
+		msgs = append(msgs, messages.NewMessage(messages.You, content, false))
+	}
+
+	attached, err := sessions.Attach(req.Attachments)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	msgs = append(msgs, attached...)
+
+	if len(msgs) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("the message is empty"))
+		return
+	}
+
+	sess, err := s.sessions.Acquire(r.PathValue("id"))
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	defer s.sessions.Release(sess)
+
+	// Stop the response if the client goes away
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-r.Context().Done():
+			sess.Cancel()
+		case <-done:
+		}
+	}()
+
+	if !acceptsEventStream(r) {
+		msg, err := sess.Send(msgs, func(gpt.Event) {})
+		if err != nil {
+			writeSessionError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, msg)
+		return
+	}
+
+	events := newEventStream(w)
+
+	msg, err := sess.Send(msgs, func(event gpt.Event) {
+		events.send(string(event.Type), event)
+	})
+
+	// Without a response, the error was not sent as an event
+	if msg == nil {
+		events.send(string(gpt.EventError), gpt.Event{Type: gpt.EventError, Error: err.Error()})
+		return
+	}
+
+	events.send("message", msg)
+}
+
+func (s *Server) cancelResponse(w http.ResponseWriter, r *http.Request) {
+	s.sessions.Cancel(r.PathValue("id"))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//------------------------------------------------------------------------------
+// Facts
+//------------------------------------------------------------------------------
+
+func (s *Server) listFacts(w http.ResponseWriter, r *http.Request) {
+	facts, err := storage.ListFacts()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sessions.NewResults(facts))
+}
+
+func (s *Server) searchFacts(w http.ResponseWriter, r *http.Request) {
+	query, limit, err := searchParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	facts, err := storage.SearchFacts(query, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sessions.NewResults(facts))
+}
+
+func (s *Server) createFact(w http.ResponseWriter, r *http.Request) {
+	var req factRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if strings.TrimSpace(req.Content) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("the fact is empty"))
+		return
+	}
+
+	id, err := storage.CreateFact(req.Content)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]string{"id": id})
+}
+
+func (s *Server) getFact(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	content, err := storage.ReadFact(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("fact not found: %s", id))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sessions.Result{ID: id, Content: content})
+}
+
+func (s *Server) updateFact(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	var req factRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if strings.TrimSpace(req.Content) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("the fact is empty"))
+		return
+	}
+
+	// UpdateFact would create the fact under a new ID
+	if _, err := storage.ReadFact(id); err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("fact not found: %s", id))
+		return
+	}
+
+	if _, err := storage.UpdateFact(id, req.Content); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"id": id})
+}
+
+func (s *Server) deleteFact(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if _, err := storage.ReadFact(id); err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("fact not found: %s", id))
+		return
+	}
+
+	if err := storage.DeleteFact(id); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//------------------------------------------------------------------------------
+// Project
+//------------------------------------------------------------------------------
+
+func (s *Server) searchProject(w http.ResponseWriter, r *http.Request) {
+	if s.fnord.Config.ProjectPath == "" {
+		writeError(w, http.StatusNotFound, errors.New("no project is selected (see --project)"))
+		return
+	}
+
+	query, limit, err := searchParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	results, err := storage.SearchProject(query, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sessions.NewResults(results))
+}
+
+//------------------------------------------------------------------------------
+// Helpers
+//------------------------------------------------------------------------------
+
+// searchParams reads the query and the number of results from the request's
+// query string.
+func searchParams(r *http.Request) (string, int, error) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		return "", 0, errors.New("the q parameter is required")
+	}
+
+	limit := sessions.DefaultSearchResults
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			n = 0
+		}
+
+		if err := sessions.CheckSearchLimit(n); err != nil {
+			return "", 0, err
+		}
+
+		limit = n
+	}
+
+	return query, limit, nil
+}
+
+// readJSON decodes the request's JSON body.
+func readJSON(r *http.Request, v any) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return errors.New("the request must be sent as application/json")
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxRequestBody))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid request: %w", err)
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		debug.Log("[server] Error writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	debug.Log("[server] Error (%d): %v", status, err)
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeSessionError responds with the HTTP status matching an error from
+// the sessions package.
+func writeSessionError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	var sessErr *sessions.Error
+	if errors.As(err, &sessErr) {
+		switch sessErr.Kind {
+		case sessions.NotFound:
+			status = http.StatusNotFound
+		case sessions.Busy:
+			status = http.StatusConflict
+		case sessions.Backend:
+			status = http.StatusBadGateway
+		}
+	}
+
+	writeError(w, status, err)
+}
+
+func acceptsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// eventStream writes server-sent events.
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newEventStream(w http.ResponseWriter) *eventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+
+	stream := &eventStream{w: w, flusher: flusher}
+	stream.flush()
+
+	return stream
+}
+
+func (es *eventStream) send(event string, data any) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		debug.Log("[server] Error serializing %s event: %v", event, err)
+		return
+	}
+
+	fmt.Fprintf(es.w, "event: %s\ndata: %s\n\n", event, buf)
+	es.flush()
+}
+
+func (es *eventStream) flush() {
+	if es.flusher != nil {
+		es.flusher.Flush()
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/debug"
+	"github.com/sysread/fnord/pkg/fnord"
+	"github.com/sysread/fnord/pkg/gpt"
+	"github.com/sysread/fnord/pkg/messages"
+	"github.com/sysread/fnord/pkg/sessions"
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+// Nothing displays the logs during tests
+func TestMain(m *testing.M) {
+	debug.Discard()
+	os.Exit(m.Run())
+}
+
+// fakeClient responds to every message with the same text.
+type fakeClient struct{}
+
+func (c *fakeClient) GetCompletion(string, string) (string, error)  { return "A title", nil }
+func (c *fakeClient) CreateThread() (string, error)                 { return "thread_server", nil }
+func (c *fakeClient) AddMessage(string, string) error               { return nil }
+func (c *fakeClient) ResumeThread(string, []messages.Message) error { return nil }
+func (c *fakeClient) Model() string                                 { return "fake-model" }
+func (c *fakeClient) CancelRun(string) error                        { return nil }
+
+func (c *fakeClient) RunThread(ctx context.Context, threadID string, events chan<- gpt.Event) {
+	events <- gpt.Event{Type: gpt.EventTextDelta, Text: "Frobnicate "}
+	events <- gpt.Event{Type: gpt.EventTextDelta, Text: "nightly."}
+	events <- gpt.Event{Type: gpt.EventDone}
+	close(events)
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	cfg := &config.Config{
+		Home:              t.TempDir(),
+		Box:               "server_box",
+		Backend:           config.BackendChat,
+		EmbeddingProvider: config.EmbeddingProviderLocal,
+	}
+
+	assert.NoError(t, storage.Init(cfg))
+	assert.NoError(t, storage.InitializeConversationsCollection(cfg))
+	assert.NoError(t, storage.InitializeFactsCollection(cfg))
+
+	ts := httptest.NewServer(New(&fnord.Fnord{Config: cfg, GptClient: &fakeClient{}}, testToken).Handler())
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+const testToken = "test-token"
+
+func request(t *testing.T, method, url, body string, headers ...string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.NoError(t, err)
+
+	req.Header.Set("Authorization", "Bearer "+testToken)
+
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+
+	return res
+}
+
+func decode[T any](t *testing.T, res *http.Response) T {
+	var v T
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&v))
+	return v
+}
+
+func TestConversations(t *testing.T) {
+	ts := newTestServer(t)
+
+	res := request(t, "POST", ts.URL+"/conversations", "")
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	id := decode[map[string]string](t, res)["id"]
+	assert.Equal(t, "thread_server", id)
+
+	// Streamed response
+	res = request(t, "POST", ts.URL+"/conversations/"+id+"/messages",
+		`{"content": "When is the widget frobnicated?", "attachments": [{"name": "notes.txt", "content": "nightly builds"}]}`,
+		"Accept", "text/event-stream")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	var events []string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if event, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			events = append(events, event)
+		}
+	}
+
+	assert.Equal(t, []string{"text_delta", "text_delta", "done", "message"}, events)
+
+	// Plain JSON response
+	res = request(t, "POST", ts.URL+"/conversations/"+id+"/messages", `{"content": "Again?"}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	msg := decode[messages.Message](t, res)
+	assert.Equal(t, messages.Assistant, msg.From)
+	assert.Equal(t, "Frobnicate nightly.", msg.Content)
+
+	res = request(t, "GET", ts.URL+"/conversations/"+id, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	conversation := decode[storage.Conversation](t, res)
+	assert.Equal(t, "server_box", conversation.Box)
+	assert.Len(t, conversation.Messages, 6)
+	assert.Equal(t, "notes.txt", conversation.Messages[1].Attachment)
+
+	res = request(t, "GET", ts.URL+"/conversations", "")
+	assert.Len(t, decode[[]sessions.ConversationSummary](t, res), 1)
+
+	res = request(t, "POST", ts.URL+"/conversations/"+id+"/messages", `{"content": ""}`)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = request(t, "POST", ts.URL+"/conversations/"+id+"/messages", "content=hi", "Content-Type", "application/x-www-form-urlencoded")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = request(t, "DELETE", ts.URL+"/conversations/"+id, "")
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res = request(t, "GET", ts.URL+"/conversations/"+id, "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestFacts(t *testing.T) {
+	ts := newTestServer(t)
+
+	res := request(t, "POST", ts.URL+"/facts", `{"content": "The widget is frobnicated nightly"}`)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	id := decode[map[string]string](t, res)["id"]
+
+	res = request(t, "PUT", ts.URL+"/facts/"+id, `{"content": "The widget is frobnicated weekly"}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = request(t, "GET", ts.URL+"/facts/"+id, "")
+	assert.Equal(t, "The widget is frobnicated weekly", decode[sessions.Result](t, res).Content)
+
+	res = request(t, "GET", ts.URL+"/facts/search?q=frobnicated&limit=5", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Len(t, decode[[]sessions.Result](t, res), 1)
+
+	res = request(t, "GET", ts.URL+"/facts/search", "")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = request(t, "DELETE", ts.URL+"/facts/"+id, "")
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res = request(t, "PUT", ts.URL+"/facts/"+id, `{"content": "gone"}`)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res = request(t, "GET", ts.URL+"/facts", "")
+	assert.Empty(t, decode[[]sessions.Result](t, res))
+}
+
+func TestRequestsMustBeForThisServer(t *testing.T) {
+	ts := newTestServer(t)
+
+	res := request(t, "GET", ts.URL+"/status", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = request(t, "GET", ts.URL+"/status", "", "Authorization", "Bearer wrong")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res = request(t, "GET", ts.URL+"/status", "", "Authorization", "")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	// A page that rebinds its domain name to the loopback address
+	req, err := http.NewRequest("GET", ts.URL+"/facts", nil)
+	assert.NoError(t, err)
+
+	req.Host = "attacker.example:8765"
+	req.Header.Set("Authorization", "Bearer "+testToken)
+
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
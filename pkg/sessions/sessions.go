@@ -0,0 +1,351 @@
+// Package sessions keeps track of the conversations used by the front ends
+// that serve other programs, the HTTP API (pkg/server) and JSON-RPC
+// (pkg/rpc), and defines the types with which they describe conversations
+// and search results, so that the two behave alike.
+//
+// A conversation is started, or a stored conversation resumed, the first
+// time it is used. Only one response may be received at a time for each
+// conversation.
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sysread/fnord/pkg/chat_manager"
+	"github.com/sysread/fnord/pkg/fnord"
+	"github.com/sysread/fnord/pkg/gpt"
+	"github.com/sysread/fnord/pkg/messages"
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+// Limits on the number of search results
+const (
+	DefaultSearchResults = 10
+	MaxSearchResults     = 100
+)
+
+// ErrorKind classifies an Error, so that each front end may report it in its
+// own way, such as an HTTP status or a JSON-RPC error code.
+type ErrorKind int
+
+const (
+	// The conversation does not exist
+	NotFound ErrorKind = iota + 1
+
+	// The conversation is already receiving a response
+	Busy
+
+	// The assistant could not be reached
+	Backend
+)
+
+// Error is returned by a Manager or Session when the request cannot be
+// carried out.
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+var errBusy = &Error{Kind: Busy, Err: errors.New("the conversation is busy receiving a response")}
+
+// Manager tracks the conversations used since the front end started.
+type Manager struct {
+	fnord *fnord.Fnord
+
+	// Conversations by thread ID
+	mutex    sync.Mutex
+	sessions map[string]*Session
+}
+
+// Session is a conversation that has been started or resumed.
+type Session struct {
+	// Nil while the conversation is being resumed. Guarded by Manager.mutex.
+	cm *chat_manager.ChatManager
+
+	// Set while the conversation is being resumed or a response is being
+	// received. Guarded by Manager.mutex.
+	busy bool
+}
+
+// NewManager creates a Manager.
+func NewManager(f *fnord.Fnord) *Manager {
+	return &Manager{
+		fnord:    f,
+		sessions: map[string]*Session{},
+	}
+}
+
+// Status describes the selected box, project, backend, and model.
+func (m *Manager) Status() map[string]string {
+	return map[string]string{
+		"box":     m.fnord.Config.Box,
+		"project": m.fnord.Config.ProjectPath,
+		"backend": m.fnord.Config.Backend,
+		"model":   m.fnord.GptClient.Model(),
+	}
+}
+
+// Start starts a new conversation, marking it busy if requested, in which
+// case the caller must Release it.
+func (m *Manager) Start(busy bool) (*Session, error) {
+	cm := chat_manager.NewChatManager(m.fnord)
+
+	if err := cm.StartThread(); err != nil {
+		return nil, &Error{Kind: Backend, Err: err}
+	}
+
+	sess := &Session{cm: cm, busy: busy}
+
+	m.mutex.Lock()
+	m.sessions[cm.ThreadID()] = sess
+	m.mutex.Unlock()
+
+	return sess, nil
+}
+
+// Acquire returns the session of the conversation, resuming it if it has not
+// been used since the front end started, and marks it busy. The caller must
+// Release it.
+func (m *Manager) Acquire(id string) (*Session, error) {
+	m.mutex.Lock()
+
+	if sess, ok := m.sessions[id]; ok {
+		defer m.mutex.Unlock()
+
+		if sess.busy {
+			return nil, errBusy
+		}
+
+		sess.busy = true
+
+		return sess, nil
+	}
+
+	// Resuming the thread calls the API, so it is done without holding the
+	// lock. The session is busy until then, so no one else uses it.
+	sess := &Session{busy: true}
+	m.sessions[id] = sess
+	m.mutex.Unlock()
+
+	cm, err := m.resume(id)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err != nil {
+		delete(m.sessions, id)
+		return nil, err
+	}
+
+	sess.cm = cm
+
+	return sess, nil
+}
+
+// resume loads a stored conversation and resumes its thread.
+func (m *Manager) resume(id string) (*chat_manager.ChatManager, error) {
+	cm, err := chat_manager.LoadChatManager(m.fnord, id)
+	if err != nil {
+		return nil, &Error{Kind: NotFound, Err: err}
+	}
+
+	// There is no one to ask whether to continue an expired thread locally,
+	// so it always is.
+	err = cm.ResumeThread()
+	if errors.Is(err, gpt.ErrThreadNotFound) {
+		err = cm.ContinueLocally()
+	}
+
+	if err != nil {
+		return nil, &Error{Kind: Backend, Err: err}
+	}
+
+	return cm, nil
+}
+
+// Release marks the session as no longer busy.
+func (m *Manager) Release(sess *Session) {
+	m.mutex.Lock()
+	sess.busy = false
+	m.mutex.Unlock()
+}
+
+// Started returns true if the conversation has been started or resumed. A
+// conversation is not stored until its first message is added.
+func (m *Manager) Started(id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.sessions[id]
+	return ok
+}
+
+// Cancel cancels the response being received by the conversation, if any.
+func (m *Manager) Cancel(id string) {
+	var cm *chat_manager.ChatManager
+
+	m.mutex.Lock()
+	if sess, ok := m.sessions[id]; ok {
+		cm = sess.cm
+	}
+	m.mutex.Unlock()
+
+	if cm != nil {
+		cm.CancelResponse()
+	}
+}
+
+// CancelAll cancels every response being received.
+func (m *Manager) CancelAll() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, sess := range m.sessions {
+		if sess.cm != nil {
+			sess.cm.CancelResponse()
+		}
+	}
+}
+
+// Delete deletes a stored conversation, unless it is busy.
+func (m *Manager) Delete(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if sess, ok := m.sessions[id]; ok && sess.busy {
+		return errBusy
+	}
+
+	if _, err := storage.LoadConversation(id); err != nil {
+		return &Error{Kind: NotFound, Err: err}
+	}
+
+	if err := storage.DeleteConversation(id); err != nil {
+		return err
+	}
+
+	delete(m.sessions, id)
+
+	return nil
+}
+
+// ID returns the conversation's thread ID.
+func (s *Session) ID() string {
+	return s.cm.ThreadID()
+}
+
+// Send adds the messages to the conversation and receives the assistant's
+// response, passing each event to onEvent. The assistant's message is
+// returned, along with the error that ended the response, if it failed; the
+// error was then also passed to onEvent. If the messages could not be added,
+// there is no response, and only the error is returned.
+func (s *Session) Send(msgs []messages.Message, onEvent func(gpt.Event)) (*messages.Message, error) {
+	for _, msg := range msgs {
+		if err := s.cm.AddMessage(msg); err != nil {
+			return nil, &Error{Kind: Backend, Err: err}
+		}
+	}
+
+	if err := s.cm.RequestResponse(onEvent); err != nil {
+		return s.cm.LastMessage(), &Error{Kind: Backend, Err: err}
+	}
+
+	return s.cm.LastMessage(), nil
+}
+
+// Cancel cancels the response being received, if any.
+func (s *Session) Cancel() {
+	s.cm.CancelResponse()
+}
+
+//------------------------------------------------------------------------------
+// Types shared by the front ends
+//------------------------------------------------------------------------------
+
+// ConversationSummary describes a conversation in a list.
+type ConversationSummary struct {
+	ID       string    `json:"id"`
+	Title    string    `json:"title"`
+	Model    string    `json:"model"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	Messages int       `json:"messages"`
+}
+
+// Summarize describes each conversation.
+func Summarize(conversations []*storage.Conversation) []ConversationSummary {
+	summaries := make([]ConversationSummary, len(conversations))
+	for i, conversation := range conversations {
+		summaries[i] = ConversationSummary{
+			ID:       conversation.ID,
+			Title:    conversation.Title,
+			Model:    conversation.Model,
+			Created:  conversation.Created,
+			Updated:  conversation.Updated,
+			Messages: len(conversation.Messages),
+		}
+	}
+
+	return summaries
+}
+
+// Result is a search result, or a fact.
+type Result struct {
+	ID      string `json:"id"`
+	Content string `json:"content"`
+	Created string `json:"created,omitempty"`
+	Updated string `json:"updated,omitempty"`
+}
+
+// NewResults converts search results from storage.
+func NewResults(results []storage.Result) []Result {
+	converted := make([]Result, len(results))
+	for i, r := range results {
+		converted[i] = Result(r)
+	}
+
+	return converted
+}
+
+// CheckSearchLimit returns an error if the number of search results asked
+// for is out of bounds.
+func CheckSearchLimit(limit int) error {
+	if limit < 1 || limit > MaxSearchResults {
+		return fmt.Errorf("limit must be between 1 and %d", MaxSearchResults)
+	}
+
+	return nil
+}
+
+// Attachment is a named input attached to a message, such as a file's
+// contents.
+type Attachment struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// Attach creates the messages attaching each input.
+func Attach(attachments []Attachment) ([]messages.Message, error) {
+	var msgs []messages.Message
+
+	for _, a := range attachments {
+		if a.Name == "" {
+			return nil, errors.New("attachments must be named")
+		}
+
+		msgs = append(msgs, chat_manager.AttachInput(a.Name, a.Content)...)
+	}
+
+	return msgs, nil
+}
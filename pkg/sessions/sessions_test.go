@@ -0,0 +1,112 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/debug"
+	"github.com/sysread/fnord/pkg/fnord"
+	"github.com/sysread/fnord/pkg/gpt"
+	"github.com/sysread/fnord/pkg/messages"
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+// Nothing displays the logs during tests
+func TestMain(m *testing.M) {
+	debug.Discard()
+	os.Exit(m.Run())
+}
+
+// fakeClient responds to every message with the same text, unless told to
+// fail.
+type fakeClient struct {
+	fail bool
+}
+
+func (c *fakeClient) GetCompletion(string, string) (string, error)  { return "A title", nil }
+func (c *fakeClient) CreateThread() (string, error)                 { return "thread_sessions", nil }
+func (c *fakeClient) AddMessage(string, string) error               { return nil }
+func (c *fakeClient) ResumeThread(string, []messages.Message) error { return nil }
+func (c *fakeClient) Model() string                                 { return "fake-model" }
+func (c *fakeClient) CancelRun(string) error                        { return nil }
+
+func (c *fakeClient) RunThread(ctx context.Context, threadID string, events chan<- gpt.Event) {
+	if c.fail {
+		events <- gpt.Event{Type: gpt.EventError, Error: "the run failed"}
+	} else {
+		events <- gpt.Event{Type: gpt.EventTextDelta, Text: "Nightly."}
+		events <- gpt.Event{Type: gpt.EventDone}
+	}
+
+	close(events)
+}
+
+func newTestManager(t *testing.T, client *fakeClient) *Manager {
+	cfg := &config.Config{
+		Home:              t.TempDir(),
+		Box:               "sessions_box",
+		Backend:           config.BackendChat,
+		EmbeddingProvider: config.EmbeddingProviderLocal,
+	}
+
+	assert.NoError(t, storage.Init(cfg))
+	assert.NoError(t, storage.InitializeConversationsCollection(cfg))
+
+	return NewManager(&fnord.Fnord{Config: cfg, GptClient: client})
+}
+
+func errorKind(err error) ErrorKind {
+	var sessErr *Error
+	if errors.As(err, &sessErr) {
+		return sessErr.Kind
+	}
+
+	return 0
+}
+
+func TestSessions(t *testing.T) {
+	client := &fakeClient{}
+	m := newTestManager(t, client)
+
+	_, err := m.Acquire("thread_nope")
+	assert.Equal(t, NotFound, errorKind(err))
+	assert.False(t, m.Started("thread_nope"))
+
+	sess, err := m.Start(true)
+	assert.NoError(t, err)
+	assert.True(t, m.Started(sess.ID()))
+
+	// Only one response is received at a time
+	_, err = m.Acquire(sess.ID())
+	assert.Equal(t, Busy, errorKind(err))
+	assert.Equal(t, Busy, errorKind(m.Delete(sess.ID())))
+
+	msg, err := sess.Send([]messages.Message{messages.NewMessage(messages.You, "When?", false)}, func(gpt.Event) {})
+	assert.NoError(t, err)
+	assert.Equal(t, "Nightly.", msg.Content)
+
+	m.Release(sess)
+
+	// A failed response is returned with its error
+	client.fail = true
+
+	sess, err = m.Acquire(sess.ID())
+	assert.NoError(t, err)
+
+	msg, err = sess.Send([]messages.Message{messages.NewMessage(messages.You, "Really?", false)}, func(gpt.Event) {})
+	assert.Equal(t, Backend, errorKind(err))
+	if assert.NotNil(t, msg) {
+		assert.True(t, msg.IsFailed())
+	}
+
+	m.Release(sess)
+
+	assert.NoError(t, m.Delete(sess.ID()))
+	assert.False(t, m.Started(sess.ID()))
+	assert.Equal(t, NotFound, errorKind(m.Delete(sess.ID())))
+}
@@ -0,0 +1,563 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/philippgille/chromem-go"
+
+	"github.com/sysread/fnord/pkg/debug"
+)
+
+// ArchiveVersion is the version of the archive format written by ExportBox.
+// ImportBox refuses archives written by a newer version.
+const ArchiveVersion = 1
+
+// The files within an archive. Each conversation is stored in its own file,
+// in the same format used in ConversationsDir.
+const (
+	archiveManifestFile     = "manifest.json"
+	archiveFactsFile        = "facts.json"
+	archiveIndexFile        = "conversation_index.json"
+	archiveConversationsDir = "conversations"
+)
+
+// archiveManifest describes the contents of an archive.
+type archiveManifest struct {
+	Version  int       `json:"version"`
+	Box      string    `json:"box"`
+	Exported time.Time `json:"exported"`
+
+	// Set if the archive includes the documents' embeddings, which may only
+	// be imported into a box using the same embedding provider and model.
+	EmbeddingProvider string `json:"embedding_provider,omitempty"`
+	EmbeddingModel    string `json:"embedding_model,omitempty"`
+}
+
+// archiveDocument is a chromem document as stored in an archive.
+type archiveDocument struct {
+	ID        string            `json:"id"`
+	Content   string            `json:"content"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Embedding []float32         `json:"embedding,omitempty"`
+}
+
+// ExportResult summarizes what was written by ExportBox.
+type ExportResult struct {
+	Facts         int
+	Conversations int
+}
+
+// ImportResult summarizes what was read by ImportBox.
+type ImportResult struct {
+	Box           string
+	Facts         int
+	Conversations int
+
+	// Documents already present in the box, unchanged, are skipped
+	Skipped int
+
+	// Set if the archive's embeddings were used rather than embedding the
+	// documents again
+	UsedEmbeddings bool
+}
+
+// ImportCollisions is returned when merging an archive into a box that
+// already has different facts or conversations with the same IDs as those in
+// the archive. Nothing is imported.
+type ImportCollisions struct {
+	Facts         []string
+	Conversations []string
+}
+
+func (e *ImportCollisions) Error() string {
+	return fmt.Sprintf("the archive has %d facts and %d conversations with the same IDs as, but different contents than, those in the box", len(e.Facts), len(e.Conversations))
+}
+
+// ExportBox writes the selected box's facts and conversations to w as a
+// gzipped tar archive. If includeEmbeddings is set, the documents' embeddings
+// are included, along with the conversations' index, so that importing the
+// archive does not need to embed them again.
+func ExportBox(w io.Writer, includeEmbeddings bool) (*ExportResult, error) {
+	debug.Log("[storage] [archive] Exporting box %s (embeddings: %t)", conversationsBox, includeEmbeddings)
+
+	manifest := archiveManifest{
+		Version:  ArchiveVersion,
+		Box:      conversationsBox,
+		Exported: time.Now(),
+	}
+
+	if includeEmbeddings {
+		manifest.EmbeddingProvider = Embeddings.Name
+		manifest.EmbeddingModel = Embeddings.Model
+	}
+
+	facts, err := exportCollection(factsCollectionName, includeEmbeddings)
+	if err != nil {
+		return nil, err
+	}
+
+	conversations, err := ListConversations()
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	if err := writeArchiveJSON(tw, archiveManifestFile, manifest); err != nil {
+		return nil, err
+	}
+
+	if err := writeArchiveJSON(tw, archiveFactsFile, facts); err != nil {
+		return nil, err
+	}
+
+	for _, conversation := range conversations {
+		name := path.Join(archiveConversationsDir, conversation.ID+".json")
+		if err := writeArchiveJSON(tw, name, conversation); err != nil {
+			return nil, err
+		}
+	}
+
+	if includeEmbeddings {
+		index, err := exportCollection(Conversations.Name, true)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := writeArchiveJSON(tw, archiveIndexFile, index); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return &ExportResult{
+		Facts:         len(facts),
+		Conversations: len(conversations),
+	}, nil
+}
+
+// ImportBox reads an archive written by ExportBox into the selected box. If
+// replace is set, the box's facts and conversations are replaced by the
+// archive's. Otherwise, the archive is merged into the box; if any of its
+// facts or conversations have the same ID as, but different contents than,
+// those in the box, an *ImportCollisions error is returned and nothing is
+// imported.
+//
+// The archive's embeddings are used if it has them and they were made by the
+// configured embedding provider. Otherwise, the documents are embedded again.
+// Every document is embedded before the box is changed, so that a failure to
+// embed them leaves the box as it was.
+func ImportBox(r io.Reader, replace bool) (*ImportResult, error) {
+	debug.Log("[storage] [archive] Importing into box %s (replace: %t)", conversationsBox, replace)
+
+	archive, err := readArchive(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{
+		Box: archive.manifest.Box,
+		UsedEmbeddings: archive.manifest.EmbeddingProvider == Embeddings.Name &&
+			archive.manifest.EmbeddingModel == Embeddings.Model,
+	}
+
+	// Find which documents are new, and which collide with those in the box,
+	// before changing anything. When replacing the box's contents, all of
+	// the archive's documents are new.
+	factsByID := map[string]Result{}
+	conversationsByID := map[string]*Conversation{}
+
+	if !replace {
+		existingFacts, err := ListFacts()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fact := range existingFacts {
+			factsByID[fact.ID] = fact
+		}
+
+		existingConversations, err := ListConversations()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, conversation := range existingConversations {
+			conversationsByID[conversation.ID] = conversation
+		}
+	}
+
+	collisions := &ImportCollisions{}
+
+	var newFacts []chromem.Document
+	for _, fact := range archive.facts {
+		if existing, ok := factsByID[fact.ID]; ok {
+			if existing.Content != fact.Content {
+				collisions.Facts = append(collisions.Facts, fact.ID)
+			} else {
+				result.Skipped++
+			}
+
+			continue
+		}
+
+		doc := chromem.Document{
+			ID:       fact.ID,
+			Content:  fact.Content,
+			Metadata: fact.Metadata,
+		}
+
+		if result.UsedEmbeddings {
+			doc.Embedding = fact.Embedding
+		}
+
+		newFacts = append(newFacts, doc)
+	}
+
+	var newConversations []*preparedConversation
+	for _, conversation := range archive.conversations {
+		conversation.Box = conversationsBox
+
+		if existing, ok := conversationsByID[conversation.ID]; ok {
+			if !sameConversation(existing, conversation) {
+				collisions.Conversations = append(collisions.Conversations, conversation.ID)
+			} else {
+				result.Skipped++
+			}
+
+			continue
+		}
+
+		newConversations = append(newConversations, &preparedConversation{conversation: conversation})
+	}
+
+	if len(collisions.Facts) > 0 || len(collisions.Conversations) > 0 {
+		return nil, collisions
+	}
+
+	// Embed the new documents
+	ctx := context.Background()
+
+	for i := range newFacts {
+		if err := embedDocument(ctx, &newFacts[i]); err != nil {
+			return nil, fmt.Errorf("error embedding fact %s: %w", newFacts[i].ID, err)
+		}
+	}
+
+	for _, prepared := range newConversations {
+		index := archive.index[prepared.conversation.ID]
+
+		prepared.index, err = prepareConversationIndex(ctx, prepared.conversation, index, result.UsedEmbeddings)
+		if err != nil {
+			return nil, fmt.Errorf("error indexing conversation %s: %w", prepared.conversation.ID, err)
+		}
+	}
+
+	// Only now that everything is ready is the box changed
+	if replace {
+		if err := clearBox(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Import the new documents
+	if len(newFacts) > 0 {
+		if err := Facts.AddDocuments(context.Background(), newFacts, 1); err != nil {
+			return nil, fmt.Errorf("error importing facts: %w", err)
+		}
+	}
+
+	result.Facts = len(newFacts)
+
+	for _, prepared := range newConversations {
+		if err := importConversation(prepared); err != nil {
+			return nil, err
+		}
+
+		result.Conversations++
+	}
+
+	return result, nil
+}
+
+// preparedConversation is a conversation to be imported, along with the
+// embedded documents of its index.
+type preparedConversation struct {
+	conversation *Conversation
+	index        []chromem.Document
+}
+
+// prepareConversationIndex returns the embedded index documents for an
+// imported conversation. The archive's documents are used for windows whose
+// content is unchanged, if their embeddings are usable; the rest are embedded.
+func prepareConversationIndex(ctx context.Context, conversation *Conversation, index []archiveDocument, useEmbeddings bool) ([]chromem.Document, error) {
+	archived := map[string]archiveDocument{}
+	if useEmbeddings {
+		for _, doc := range index {
+			archived[doc.ID] = doc
+		}
+	}
+
+	var docs []chromem.Document
+
+	for id, content := range conversationWindows(conversation) {
+		doc := windowDocument(conversation, id, content)
+
+		if prev, ok := archived[id]; ok && prev.Content == content {
+			doc.Embedding = prev.Embedding
+		}
+
+		if err := embedDocument(ctx, &doc); err != nil {
+			return nil, err
+		}
+
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+// embedDocument embeds the document with the configured embedding provider,
+// unless it already has an embedding.
+func embedDocument(ctx context.Context, doc *chromem.Document) error {
+	if len(doc.Embedding) > 0 {
+		return nil
+	}
+
+	embedding, err := Embeddings.Embed(ctx, doc.Content)
+	if err != nil {
+		return err
+	}
+
+	doc.Embedding = embedding
+
+	return nil
+}
+
+// importConversation writes an imported conversation to disk and adds its
+// index documents, which have already been embedded.
+func importConversation(prepared *preparedConversation) error {
+	conversation := prepared.conversation
+
+	if err := writeConversationFile(ConversationsPath, conversation); err != nil {
+		return fmt.Errorf("error importing conversation %s: %w", conversation.ID, err)
+	}
+
+	if len(prepared.index) > 0 {
+		if err := Conversations.AddDocuments(context.Background(), prepared.index, 1); err != nil {
+			return fmt.Errorf("error indexing conversation %s: %w", conversation.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// clearBox deletes all of the selected box's facts and conversations.
+func clearBox() error {
+	if err := ResetFactCollection(); err != nil {
+		return err
+	}
+
+	conversations, err := ListConversations()
+	if err != nil {
+		return err
+	}
+
+	for _, conversation := range conversations {
+		if err := DeleteConversation(conversation.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sameConversation reports whether two conversations have the same contents.
+func sameConversation(a, b *Conversation) bool {
+	bufA, errA := json.Marshal(a)
+	bufB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(bufA, bufB)
+}
+
+// exportCollection returns the documents of the named collection, sorted by
+// ID so that exports are reproducible.
+func exportCollection(name string, includeEmbeddings bool) ([]archiveDocument, error) {
+	snap, err := snapshotCollection(name)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]archiveDocument, 0, len(snap.Documents))
+	for _, doc := range snap.Documents {
+		exported := archiveDocument{
+			ID:       doc.ID,
+			Content:  doc.Content,
+			Metadata: doc.Metadata,
+		}
+
+		if includeEmbeddings {
+			exported.Embedding = doc.Embedding
+		}
+
+		docs = append(docs, exported)
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].ID < docs[j].ID
+	})
+
+	return docs, nil
+}
+
+func writeArchiveJSON(tw *tar.Writer, name string, value any) error {
+	buf, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializing %s: %w", name, err)
+	}
+
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(buf)),
+		ModTime: time.Now(),
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = tw.Write(buf)
+	return err
+}
+
+// archiveContents is the parsed contents of an archive.
+type archiveContents struct {
+	manifest      archiveManifest
+	facts         []archiveDocument
+	conversations []*Conversation
+
+	// The conversation index's documents, by thread ID
+	index map[string][]archiveDocument
+}
+
+// readArchive reads and validates an archive written by ExportBox.
+func readArchive(r io.Reader) (*archiveContents, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a box archive: %w", err)
+	}
+
+	defer gz.Close()
+
+	archive := &archiveContents{
+		index: map[string][]archiveDocument{},
+	}
+
+	var hasManifest bool
+
+	conversationIDs := map[string]bool{}
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive: %w", err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		switch name := path.Clean(header.Name); {
+		case name == archiveManifestFile:
+			if err := json.NewDecoder(tr).Decode(&archive.manifest); err != nil {
+				return nil, fmt.Errorf("error reading %s: %w", name, err)
+			}
+
+			hasManifest = true
+
+		case name == archiveFactsFile:
+			if err := json.NewDecoder(tr).Decode(&archive.facts); err != nil {
+				return nil, fmt.Errorf("error reading %s: %w", name, err)
+			}
+
+		case name == archiveIndexFile:
+			var index []archiveDocument
+			if err := json.NewDecoder(tr).Decode(&index); err != nil {
+				return nil, fmt.Errorf("error reading %s: %w", name, err)
+			}
+
+			for _, doc := range index {
+				threadID := doc.Metadata[metaConversationThreadID]
+				archive.index[threadID] = append(archive.index[threadID], doc)
+			}
+
+		case path.Dir(name) == archiveConversationsDir && strings.HasSuffix(name, ".json"):
+			var conversation Conversation
+			if err := json.NewDecoder(tr).Decode(&conversation); err != nil {
+				return nil, fmt.Errorf("error reading %s: %w", name, err)
+			}
+
+			if !validConversationID(conversation.ID) {
+				return nil, fmt.Errorf("invalid conversation ID in %s: %q", name, conversation.ID)
+			}
+
+			if conversationIDs[conversation.ID] {
+				return nil, fmt.Errorf("the archive contains conversation %s more than once", conversation.ID)
+			}
+
+			conversationIDs[conversation.ID] = true
+
+			archive.conversations = append(archive.conversations, &conversation)
+
+		default:
+			debug.Log("[storage] [archive] Ignoring unexpected file in archive: %s", name)
+		}
+	}
+
+	if !hasManifest {
+		return nil, fmt.Errorf("not a box archive: %s is missing", archiveManifestFile)
+	}
+
+	if archive.manifest.Version > ArchiveVersion {
+		return nil, fmt.Errorf("the archive was written by a newer version of fnord (archive version %d)", archive.manifest.Version)
+	}
+
+	factIDs := map[string]bool{}
+
+	for _, fact := range archive.facts {
+		if fact.ID == "" {
+			return nil, fmt.Errorf("the archive contains a fact without an ID")
+		}
+
+		if factIDs[fact.ID] {
+			return nil, fmt.Errorf("the archive contains fact %s more than once", fact.ID)
+		}
+
+		factIDs[fact.ID] = true
+	}
+
+	return archive, nil
+}
@@ -0,0 +1,176 @@
+package storage_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/messages"
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+func TestExportImportBox(t *testing.T) {
+	cfg := setupTestConfig(t)
+	setupTestStorage(t, cfg)
+
+	err := storage.InitializeConversationsCollection(cfg)
+	assert.NoError(t, err)
+
+	factID, err := storage.CreateFact("The widget is frobnicated nightly")
+	assert.NoError(t, err)
+
+	conversation := &storage.Conversation{ID: "thread_archive"}
+	conversation.Messages = append(conversation.Messages,
+		messages.NewMessage(messages.You, "When is the widget frobnicated?", false),
+		messages.NewMessage(messages.Assistant, "Nightly.", false),
+	)
+
+	err = storage.SaveConversation(conversation)
+	assert.NoError(t, err)
+
+	var archive bytes.Buffer
+	exported, err := storage.ExportBox(&archive, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, exported.Facts)
+	assert.Equal(t, 1, exported.Conversations)
+
+	// Importing into a box that already has the same contents skips them
+	imported, err := storage.ImportBox(bytes.NewReader(archive.Bytes()), false)
+	assert.NoError(t, err)
+	assert.Zero(t, imported.Facts)
+	assert.Zero(t, imported.Conversations)
+	assert.Equal(t, 2, imported.Skipped)
+
+	// A fact with the same ID but different content collides
+	_, err = storage.UpdateFact(factID, "The widget is frobnicated weekly")
+	assert.NoError(t, err)
+
+	_, err = storage.ImportBox(bytes.NewReader(archive.Bytes()), false)
+	var collisions *storage.ImportCollisions
+	if assert.ErrorAs(t, err, &collisions) {
+		assert.Equal(t, []string{factID}, collisions.Facts)
+		assert.Empty(t, collisions.Conversations)
+	}
+
+	// Replacing the box's contents restores the archive's
+	imported, err = storage.ImportBox(bytes.NewReader(archive.Bytes()), true)
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.Box, imported.Box)
+	assert.Equal(t, 1, imported.Facts)
+	assert.Equal(t, 1, imported.Conversations)
+	assert.True(t, imported.UsedEmbeddings)
+
+	content, err := storage.ReadFact(factID)
+	assert.NoError(t, err)
+	assert.Equal(t, "The widget is frobnicated nightly", content)
+
+	restored, err := storage.LoadConversation("thread_archive")
+	assert.NoError(t, err)
+	assert.Len(t, restored.Messages, 2)
+
+	results, err := storage.SearchConversations("frobnicated", 10)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	// Not an archive
+	_, err = storage.ImportBox(bytes.NewReader([]byte("nope")), false)
+	assert.Error(t, err)
+
+	assert.NoError(t, storage.DeleteConversation("thread_archive"))
+	assert.NoError(t, storage.ResetFactCollection())
+}
+
+func TestImportBoxKeepsContentsWhenEmbeddingFails(t *testing.T) {
+	cfg := setupTestConfig(t)
+	setupTestStorage(t, cfg)
+
+	err := storage.InitializeConversationsCollection(cfg)
+	assert.NoError(t, err)
+
+	factID, err := storage.CreateFact("The gadget is polished weekly")
+	assert.NoError(t, err)
+
+	conversation := &storage.Conversation{ID: "thread_kept"}
+	conversation.Messages = append(conversation.Messages,
+		messages.NewMessage(messages.You, "When is the gadget polished?", false),
+		messages.NewMessage(messages.Assistant, "Weekly.", false),
+	)
+
+	err = storage.SaveConversation(conversation)
+	assert.NoError(t, err)
+
+	// Without embeddings, importing the archive must embed its documents
+	var archive bytes.Buffer
+	_, err = storage.ExportBox(&archive, false)
+	assert.NoError(t, err)
+
+	embeddings := storage.Embeddings
+	storage.Embeddings = &storage.EmbeddingProvider{
+		Name: "failing",
+		Embed: func(ctx context.Context, text string) ([]float32, error) {
+			return nil, errors.New("the embeddings API is down")
+		},
+	}
+
+	_, err = storage.ImportBox(bytes.NewReader(archive.Bytes()), true)
+	storage.Embeddings = embeddings
+	assert.ErrorContains(t, err, "the embeddings API is down")
+
+	// The box was not cleared
+	content, err := storage.ReadFact(factID)
+	assert.NoError(t, err)
+	assert.Equal(t, "The gadget is polished weekly", content)
+
+	_, err = storage.LoadConversation("thread_kept")
+	assert.NoError(t, err)
+
+	assert.NoError(t, storage.DeleteConversation("thread_kept"))
+	assert.NoError(t, storage.ResetFactCollection())
+}
+
+func TestImportBoxRejectsRepeatedIDs(t *testing.T) {
+	cfg := setupTestConfig(t)
+	setupTestStorage(t, cfg)
+
+	err := storage.InitializeConversationsCollection(cfg)
+	assert.NoError(t, err)
+
+	_, err = storage.ImportBox(bytes.NewReader(testArchive(t, map[string]string{
+		"manifest.json": `{"version": 1, "box": "other"}`,
+		"facts.json":    `[{"id": "fact_1", "content": "one"}, {"id": "fact_1", "content": "two"}]`,
+	})), false)
+	assert.ErrorContains(t, err, "fact fact_1 more than once")
+
+	_, err = storage.ImportBox(bytes.NewReader(testArchive(t, map[string]string{
+		"manifest.json":               `{"version": 1, "box": "other"}`,
+		"conversations/a.json":        `{"id": "thread_1"}`,
+		"conversations/thread_1.json": `{"id": "thread_1"}`,
+	})), false)
+	assert.ErrorContains(t, err, "conversation thread_1 more than once")
+}
+
+// testArchive builds a box archive containing the given files.
+func testArchive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content))})
+		assert.NoError(t, err)
+
+		_, err = tw.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gz.Close())
+
+	return buf.Bytes()
+}
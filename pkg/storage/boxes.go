@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/philippgille/chromem-go"
+
+	"github.com/sysread/fnord/pkg/debug"
+)
+
+// A box is not stored anywhere by itself. It is made up of the collections
+// whose names begin with these prefixes, followed by the box's name, and of
+// its directory of conversations.
+var boxCollectionPrefixes = []string{"conversations:", "facts:"}
+
+// BoxStats summarizes the contents of a box.
+type BoxStats struct {
+	Name          string
+	Facts         int
+	Conversations int
+	Messages      int
+
+	// The last time a fact or conversation in the box was updated, or the
+	// zero time if the box is empty.
+	LastActivity time.Time
+}
+
+// BoxExists reports whether any of the box's collections or its conversations
+// directory exist.
+func BoxExists(box string) bool {
+	collections := DB.ListCollections()
+
+	for _, prefix := range boxCollectionPrefixes {
+		if _, ok := collections[prefix+box]; ok {
+			return true
+		}
+	}
+
+	_, err := os.Stat(boxConversationsPath(box))
+	return err == nil
+}
+
+// CreateBox creates an empty box.
+func CreateBox(box string) error {
+	debug.Log("[storage] [box] Creating box %s", box)
+
+	if err := validateBoxName(box); err != nil {
+		return err
+	}
+
+	if BoxExists(box) {
+		return fmt.Errorf("box already exists: %s", box)
+	}
+
+	for _, prefix := range boxCollectionPrefixes {
+		if _, err := openCollection(prefix + box); err != nil {
+			return err
+		}
+	}
+
+	return os.MkdirAll(boxConversationsPath(box), 0700)
+}
+
+// DeleteBox removes every collection belonging to the box, along with its
+// conversations.
+func DeleteBox(box string) error {
+	debug.Log("[storage] [box] Deleting box %s", box)
+
+	if !BoxExists(box) {
+		return fmt.Errorf("box not found: %s", box)
+	}
+
+	for _, prefix := range boxCollectionPrefixes {
+		if err := deleteCollection(prefix + box); err != nil {
+			return fmt.Errorf("error deleting collection %s: %w", prefix+box, err)
+		}
+	}
+
+	if err := os.RemoveAll(boxConversationsPath(box)); err != nil {
+		return fmt.Errorf("error deleting conversations of box %s: %w", box, err)
+	}
+
+	return nil
+}
+
+// CopyBox copies the contents of one box into a new box. The copied documents
+// keep their embeddings, so nothing needs to be embedded again.
+func CopyBox(from, to string) error {
+	debug.Log("[storage] [box] Copying box %s to %s", from, to)
+
+	if err := validateBoxName(to); err != nil {
+		return err
+	}
+
+	if !BoxExists(from) {
+		return fmt.Errorf("box not found: %s", from)
+	}
+
+	if BoxExists(to) {
+		return fmt.Errorf("box already exists: %s", to)
+	}
+
+	for _, prefix := range boxCollectionPrefixes {
+		if err := copyCollection(prefix+from, prefix+to); err != nil {
+			return err
+		}
+	}
+
+	return copyConversations(from, to)
+}
+
+// RenameBox renames a box. chromem cannot rename a collection, so the box is
+// copied to its new name before the original is deleted.
+func RenameBox(from, to string) error {
+	debug.Log("[storage] [box] Renaming box %s to %s", from, to)
+
+	if err := CopyBox(from, to); err != nil {
+		return err
+	}
+
+	return DeleteBox(from)
+}
+
+// GetBoxStats summarizes the contents of a box.
+func GetBoxStats(box string) (*BoxStats, error) {
+	if !BoxExists(box) {
+		return nil, fmt.Errorf("box not found: %s", box)
+	}
+
+	stats := &BoxStats{Name: box}
+
+	if _, ok := DB.ListCollections()["facts:"+box]; ok {
+		snap, err := snapshotCollection("facts:" + box)
+		if err != nil {
+			return nil, err
+		}
+
+		stats.Facts = len(snap.Documents)
+
+		for _, doc := range snap.Documents {
+			updated, err := time.Parse(time.RFC3339, doc.Metadata["updated"])
+			if err == nil && updated.After(stats.LastActivity) {
+				stats.LastActivity = updated
+			}
+		}
+	}
+
+	conversations, err := readConversationFiles(boxConversationsPath(box))
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Conversations = len(conversations)
+
+	for _, conversation := range conversations {
+		stats.Messages += len(conversation.Messages)
+
+		if conversation.Updated.After(stats.LastActivity) {
+			stats.LastActivity = conversation.Updated
+		}
+	}
+
+	return stats, nil
+}
+
+// validateBoxName returns an error if the name cannot be used for a box.
+func validateBoxName(box string) error {
+	if box == "" {
+		return fmt.Errorf("box name cannot be empty")
+	}
+
+	if strings.ContainsAny(box, `/\`) || strings.HasPrefix(box, ".") {
+		return fmt.Errorf("invalid box name: %q", box)
+	}
+
+	return nil
+}
+
+func boxConversationsPath(box string) string {
+	return filepath.Join(conversationsRoot, box)
+}
+
+// copyCollection copies a collection's metadata and documents into a new
+// collection. It is not an error if the source collection does not exist.
+func copyCollection(from, to string) error {
+	if _, ok := DB.ListCollections()[from]; !ok {
+		return nil
+	}
+
+	snap, err := snapshotCollection(from)
+	if err != nil {
+		return err
+	}
+
+	collection, err := createCollection(to, snap.Metadata)
+	if err != nil {
+		return fmt.Errorf("error creating collection %s: %w", to, err)
+	}
+
+	if len(snap.Documents) == 0 {
+		return nil
+	}
+
+	docs := make([]chromem.Document, 0, len(snap.Documents))
+	for _, doc := range snap.Documents {
+		docs = append(docs, *doc)
+	}
+
+	if err := collection.AddDocuments(context.Background(), docs, 1); err != nil {
+		return fmt.Errorf("error copying documents to collection %s: %w", to, err)
+	}
+
+	return nil
+}
+
+// copyConversations copies the conversation files of one box into another,
+// recording the new box in each. Files that cannot be parsed are copied as
+// they are, so that nothing is lost when a box is renamed.
+func copyConversations(from, to string) error {
+	src := boxConversationsPath(from)
+	dst := boxConversationsPath(to)
+
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(src, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var conversation Conversation
+		if err := json.Unmarshal(buf, &conversation); err != nil || !validConversationID(conversation.ID) {
+			debug.Log("[storage] [box] Copying unreadable conversation file %s as is", path)
+
+			if err := os.WriteFile(filepath.Join(dst, filepath.Base(path)), buf, 0600); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		conversation.Box = to
+
+		if err := writeConversationFile(dst, &conversation); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
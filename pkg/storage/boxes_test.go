@@ -0,0 +1,80 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+func TestBoxLifecycle(t *testing.T) {
+	cfg := setupTestConfig(t)
+	setupTestStorage(t, cfg)
+
+	err := storage.InitializeConversationsCollection(cfg)
+	assert.NoError(t, err)
+
+	_, err = storage.CreateFact("The widget is frobnicated nightly")
+	assert.NoError(t, err)
+
+	err = storage.SaveConversation(&storage.Conversation{ID: "thread_box"})
+	assert.NoError(t, err)
+
+	// Copy
+	err = storage.CopyBox(cfg.Box, "box_copy")
+	assert.NoError(t, err)
+
+	err = storage.CopyBox(cfg.Box, "box_copy")
+	assert.Error(t, err)
+
+	stats, err := storage.GetBoxStats("box_copy")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Facts)
+	assert.Equal(t, 1, stats.Conversations)
+	assert.False(t, stats.LastActivity.IsZero())
+
+	// Rename
+	err = storage.RenameBox("box_copy", "box_renamed")
+	assert.NoError(t, err)
+	assert.False(t, storage.BoxExists("box_copy"))
+
+	boxes, err := storage.GetBoxes()
+	assert.NoError(t, err)
+	assert.Contains(t, boxes, "box_renamed")
+	assert.NotContains(t, boxes, "box_copy")
+
+	stats, err = storage.GetBoxStats("box_renamed")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Facts)
+	assert.Equal(t, 1, stats.Conversations)
+
+	// Delete
+	err = storage.DeleteBox("box_renamed")
+	assert.NoError(t, err)
+	assert.False(t, storage.BoxExists("box_renamed"))
+
+	err = storage.DeleteBox("box_renamed")
+	assert.Error(t, err)
+
+	// Create
+	err = storage.CreateBox("box_new")
+	assert.NoError(t, err)
+
+	stats, err = storage.GetBoxStats("box_new")
+	assert.NoError(t, err)
+	assert.Zero(t, stats.Facts)
+	assert.True(t, stats.LastActivity.IsZero())
+
+	assert.Error(t, storage.CreateBox("box_new"))
+	assert.Error(t, storage.CreateBox("../escape"))
+	assert.NoError(t, storage.DeleteBox("box_new"))
+
+	// The original box is untouched
+	facts, err := storage.ListFacts()
+	assert.NoError(t, err)
+	assert.Len(t, facts, 1)
+
+	assert.NoError(t, storage.DeleteConversation("thread_box"))
+	assert.NoError(t, storage.ResetFactCollection())
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/philippgille/chromem-go"
+)
+
+// CollectionsFile is the file, relative to FNORD_HOME, recording each
+// collection's metadata. chromem does not expose a collection's metadata,
+// and exporting the collection to read it means decoding every document, so
+// the metadata is also kept here.
+const CollectionsFile = "collections.json"
+
+// collectionsMeta is the metadata of each collection, by name, as recorded in
+// CollectionsFile.
+var (
+	collectionsMeta      map[string]map[string]string
+	collectionsMetaPath  string
+	collectionsMetaMutex sync.Mutex
+)
+
+// loadCollectionsMeta reads CollectionsFile from home.
+func loadCollectionsMeta(home string) error {
+	collectionsMetaMutex.Lock()
+	defer collectionsMetaMutex.Unlock()
+
+	collectionsMetaPath = filepath.Join(home, CollectionsFile)
+	collectionsMeta = map[string]map[string]string{}
+
+	buf, err := os.ReadFile(collectionsMetaPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(buf, &collectionsMeta); err != nil {
+		return fmt.Errorf("error reading %s: %w", collectionsMetaPath, err)
+	}
+
+	return nil
+}
+
+// collectionMetadata returns the named collection's metadata. Collections
+// created before their metadata was recorded are exported once to read it.
+func collectionMetadata(name string) (map[string]string, error) {
+	collectionsMetaMutex.Lock()
+	metadata, ok := collectionsMeta[name]
+	collectionsMetaMutex.Unlock()
+
+	if ok {
+		return metadata, nil
+	}
+
+	snap, err := snapshotCollection(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := recordCollectionMetadata(name, snap.Metadata); err != nil {
+		return nil, err
+	}
+
+	return snap.Metadata, nil
+}
+
+// createCollection creates the named collection and records its metadata.
+func createCollection(name string, metadata map[string]string) (*chromem.Collection, error) {
+	collection, err := DB.CreateCollection(name, metadata, Embeddings.Embed)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := recordCollectionMetadata(name, metadata); err != nil {
+		return nil, err
+	}
+
+	return collection, nil
+}
+
+// deleteCollection deletes the named collection and forgets its metadata.
+func deleteCollection(name string) error {
+	if err := DB.DeleteCollection(name); err != nil {
+		return err
+	}
+
+	return recordCollectionMetadata(name, nil)
+}
+
+// recordCollectionMetadata saves the named collection's metadata to
+// CollectionsFile, or removes it if metadata is nil.
+func recordCollectionMetadata(name string, metadata map[string]string) error {
+	collectionsMetaMutex.Lock()
+	defer collectionsMetaMutex.Unlock()
+
+	if collectionsMeta == nil {
+		collectionsMeta = map[string]map[string]string{}
+	}
+
+	if metadata == nil {
+		delete(collectionsMeta, name)
+	} else {
+		collectionsMeta[name] = metadata
+	}
+
+	// Without a home, as when storage is set up by hand, the metadata is
+	// only kept in memory
+	if collectionsMetaPath == "" {
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(collectionsMeta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializing collection metadata: %w", err)
+	}
+
+	dir := filepath.Dir(collectionsMetaPath)
+
+	tmp, err := os.CreateTemp(dir, CollectionsFile+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), collectionsMetaPath)
+}
+
+// collectionSnapshot is a point-in-time copy of a collection's metadata and
+// documents. chromem does not expose either directly, but does export them as
+// gob, which we decode into this mirror of chromem's persistence format.
+type collectionSnapshot struct {
+	Name      string
+	Metadata  map[string]string
+	Documents map[string]*chromem.Document
+}
+
+// snapshotCollection returns a snapshot of the named collection.
+func snapshotCollection(name string) (*collectionSnapshot, error) {
+	var buf bytes.Buffer
+
+	if err := DB.ExportToWriter(&buf, false, "", name); err != nil {
+		return nil, fmt.Errorf("error exporting collection %s: %v", name, err)
+	}
+
+	var exported struct {
+		Collections map[string]*collectionSnapshot
+	}
+
+	if err := gob.NewDecoder(&buf).Decode(&exported); err != nil {
+		return nil, fmt.Errorf("error decoding collection %s: %v", name, err)
+	}
+
+	snap, ok := exported.Collections[name]
+	if !ok {
+		return nil, fmt.Errorf("collection not found: %s", name)
+	}
+
+	if snap.Metadata == nil {
+		snap.Metadata = map[string]string{}
+	}
+
+	if snap.Documents == nil {
+		snap.Documents = map[string]*chromem.Document{}
+	}
+
+	return snap, nil
+}
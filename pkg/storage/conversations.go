@@ -2,101 +2,189 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/philippgille/chromem-go"
 
 	"github.com/sysread/fnord/pkg/config"
 	"github.com/sysread/fnord/pkg/debug"
+	"github.com/sysread/fnord/pkg/messages"
 )
 
-// Conversations is the chromem collection of conversation data
+// ConversationsDir is the directory, relative to FNORD_HOME, in which
+// conversations are stored. Each box's conversations are stored in their own
+// subdirectory, one JSON file per conversation, named for its thread ID.
+const ConversationsDir = "conversations"
+
+// Conversations are indexed for searching in overlapping windows of
+// messages, so that only the windows that change need to be embedded again
+// when a message is added. Long messages are truncated in the index.
+const (
+	conversationWindowSize    = 6
+	conversationWindowStride  = 3
+	conversationIndexMaxChars = 2000
+)
+
+// Metadata keys of the conversation index's documents
+const (
+	metaConversationThreadID = "thread_id"
+	metaConversationStart    = "start"
+)
+
+// Metadata key recording that a conversation index's flat transcripts have
+// all been migrated, so that the index need not be searched for them again
+const metaConversationsMigrated = "fnord_conversations_migrated"
+
+// Conversations is the chromem collection indexing the conversations in the
+// selected box. Its documents are windows of each conversation's messages.
+// The conversations themselves are stored as JSON files in
+// ConversationsPath.
 var Conversations *chromem.Collection
 
+// ConversationsPath is the directory containing the selected box's
+// conversations.
+var ConversationsPath string
+
+// The selected box, recorded with each conversation
+var conversationsBox string
+
+// The directory containing every box's conversations
+var conversationsRoot string
+
+// Guards the selected box's collection and paths, which are replaced when
+// another box is selected, against conversations being saved in the
+// background, such as when their titles are written.
+var conversationsMutex sync.RWMutex
+
+// Conversation is a conversation as stored on disk.
+type Conversation struct {
+	ID       string             `json:"id"`
+	Title    string             `json:"title"`
+	Box      string             `json:"box"`
+	Model    string             `json:"model"`
+	Created  time.Time          `json:"created"`
+	Updated  time.Time          `json:"updated"`
+	Messages []messages.Message `json:"messages"`
+}
+
 // InitializeConversationsCollection initializes the conversations collection in the chromem database.
 func InitializeConversationsCollection(config *config.Config) error {
 	debug.Log("[storage] [convo] Initializing conversations collection conversation:%s", config.Box)
-	var err error
 	collectionName := "conversations:" + config.Box
-	Conversations, err = DB.GetOrCreateCollection(collectionName, nil, nil)
-	return err
-}
-
-// CreateConversation stores a new conversation and returns an error if the operation fails.
-func CreateConversation(threadID string, content string) error {
-	debug.Log("[storage] [convo] Creating conversation %s", threadID)
+	collection, err := openCollection(collectionName)
+	if err != nil {
+		return err
+	}
 
-	now := time.Now().Format(time.RFC3339)
-	document := chromem.Document{
-		ID:      threadID,
-		Content: content,
-		Metadata: map[string]string{
-			"created": now,
-			"updated": now,
-		},
+	root := filepath.Join(config.Home, ConversationsDir)
+	path := filepath.Join(root, config.Box)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
 	}
 
-	return Conversations.AddDocuments(context.Background(), []chromem.Document{document}, 1)
+	conversationsMutex.Lock()
+	Conversations = collection
+	conversationsBox = config.Box
+	conversationsRoot = root
+	ConversationsPath = path
+	conversationsMutex.Unlock()
+
+	return migrateConversations(collectionName)
 }
 
-// ReadConversation retrieves a conversation by thread ID.
-func ReadConversation(threadID string) (string, error) {
-	debug.Log("[storage] [convo] Reading conversation %s", threadID)
+// SaveConversation writes the conversation to disk and updates its index.
+// Its update time is set to the current time, and its creation time, box,
+// and title are filled in if they are missing. A conversation is saved in
+// the box it belongs to, which is the selected box unless another has been
+// selected since it was first saved.
+func SaveConversation(conversation *Conversation) error {
+	debug.Log("[storage] [convo] Saving conversation %s", conversation.ID)
 
-	document, err := Conversations.GetByID(context.Background(), threadID)
-	if err != nil {
-		debug.Log("[storage] [convo] Conversation not found: %s", threadID)
-		return "", err
-	}
+	conversation.Updated = time.Now()
 
-	return document.Content, nil
-}
+	if conversation.Created.IsZero() {
+		conversation.Created = conversation.Updated
+	}
 
-// UpdateConversation modifies the content of an existing conversation.
-func UpdateConversation(threadID, content string) error {
-	debug.Log("[storage] [convo] Updating conversation %s", threadID)
+	if conversation.Title == "" {
+		conversation.Title = defaultConversationTitle(conversation.Messages)
+	}
 
-	// Find the existing entry
-	existingEntry, err := Conversations.GetByID(context.Background(), threadID)
+	path, collection, err := conversationStore(conversation)
 	if err != nil {
-		debug.Log("[storage] [convo] Conversation not found; creating instead: %s", threadID)
-		return CreateConversation(threadID, content)
+		debug.Log("[storage] [convo] Failed to open box %s for conversation %s: %v", conversation.Box, conversation.ID, err)
+		return err
 	}
 
-	// Set the document ID
-	existingEntry.ID = threadID
+	if err := writeConversationFile(path, conversation); err != nil {
+		debug.Log("[storage] [convo] Failed to save conversation %s: %v", conversation.ID, err)
+		return err
+	}
 
-	// Update the content
-	existingEntry.Content = content
+	if err := indexConversation(collection, conversation); err != nil {
+		debug.Log("[storage] [convo] Failed to index conversation %s: %v", conversation.ID, err)
+		return err
+	}
 
-	// Set the updated date
-	existingEntry.Metadata["updated"] = time.Now().Format(time.RFC3339)
+	return nil
+}
+
+// conversationStore returns the directory and index of the conversation's
+// box, which is set to the selected box if it is missing.
+func conversationStore(conversation *Conversation) (string, *chromem.Collection, error) {
+	conversationsMutex.RLock()
+	defer conversationsMutex.RUnlock()
 
-	// Preserve the original creation date, or set it to the updated date if it
-	// was missing.
-	if existingEntry.Metadata["created"] == "" {
-		existingEntry.Metadata["created"] = existingEntry.Metadata["updated"]
+	if conversation.Box == "" {
+		conversation.Box = conversationsBox
 	}
 
-	// Save the updated entry
-	err = Conversations.AddDocuments(context.Background(), []chromem.Document{existingEntry}, 1)
+	if conversation.Box == conversationsBox {
+		return ConversationsPath, Conversations, nil
+	}
+
+	collection, err := openCollection("conversations:" + conversation.Box)
 	if err != nil {
-		debug.Log("[storage] [convo] Failed to update conversation: %s", threadID)
-		return err
+		return "", nil, err
 	}
 
-	debug.Log("[storage] [convo] Updated conversation %s", threadID)
+	return filepath.Join(conversationsRoot, conversation.Box), collection, nil
+}
 
-	return nil
+// LoadConversation reads a conversation by thread ID.
+func LoadConversation(threadID string) (*Conversation, error) {
+	debug.Log("[storage] [convo] Loading conversation %s", threadID)
+	return readConversationFile(ConversationsPath, threadID)
 }
 
-// DeleteConversation removes a conversation by thread ID.
+// ListConversations reads all of the conversations in the selected box, most
+// recently updated first. Conversations that cannot be read are logged and
+// skipped.
+func ListConversations() ([]*Conversation, error) {
+	debug.Log("[storage] [convo] Listing conversations")
+	return readConversationFiles(ConversationsPath)
+}
+
+// DeleteConversation removes a conversation and its index by thread ID.
 func DeleteConversation(threadID string) error {
 	debug.Log("[storage] [convo] Deleting conversation %s", threadID)
 
-	err := Conversations.Delete(context.Background(), nil, nil, threadID)
+	err := Conversations.Delete(context.Background(), map[string]string{metaConversationThreadID: threadID}, nil)
 	if err != nil {
+		debug.Log("[storage] [convo] Failed to delete conversation index: %s", threadID)
+		return err
+	}
+
+	if err := os.Remove(conversationFilePath(threadID)); err != nil {
 		debug.Log("[storage] [convo] Failed to delete conversation: %s", threadID)
 		return err
 	}
@@ -104,35 +192,60 @@ func DeleteConversation(threadID string) error {
 	return nil
 }
 
-// SearchConversations queries the conversation collection for a given query
-// string and returns a slice of search results.
+// SearchConversations queries the conversation index for a given query
+// string and returns a slice of search results, one per conversation. Each
+// result's content is the window of the conversation that best matched the
+// query.
 func SearchConversations(query string, numResults int) ([]Result, error) {
 	debug.Log("[storage] [convo] Searching conversations for %d results using query '%s'", numResults, query)
+
+	// Several windows of the same conversation may match, so ask for more
+	// than are needed.
+	numWindows := numResults * conversationWindowSize
 	maxResults := Conversations.Count()
-	if numResults > maxResults {
-		numResults = maxResults
+	if numWindows > maxResults {
+		numWindows = maxResults
 	}
 
-	if numResults == 0 {
+	if numWindows == 0 {
 		debug.Log("[storage] [convo] No indexed conversations to search!")
 		return []Result{}, nil
 	}
 
-	results, err := Conversations.Query(context.Background(), query, numResults, nil, nil)
+	results, err := Conversations.Query(context.Background(), query, numWindows, nil, nil)
 	if err != nil {
 		debug.Log("[storage] [convo] Error querying conversations: %v", err)
 		return nil, err
 	}
 
-	var found []Result
+	seen := map[string]bool{}
+	found := []Result{}
+
 	for _, doc := range results {
-		debug.Log("[storage] [convo] Found conversation: %s", doc.ID)
+		threadID := doc.Metadata[metaConversationThreadID]
+		if seen[threadID] {
+			continue
+		}
+
+		seen[threadID] = true
+
+		conversation, err := LoadConversation(threadID)
+		if err != nil {
+			debug.Log("[storage] [convo] Skipping indexed conversation %s: %v", threadID, err)
+			continue
+		}
+
+		debug.Log("[storage] [convo] Found conversation: %s", threadID)
 		found = append(found, Result{
-			ID:      doc.ID,
+			ID:      threadID,
 			Content: doc.Content,
-			Created: doc.Metadata["created"],
-			Updated: doc.Metadata["updated"],
+			Created: conversation.Created.Format(time.RFC3339),
+			Updated: conversation.Updated.Format(time.RFC3339),
 		})
+
+		if len(found) == numResults {
+			break
+		}
 	}
 
 	return found, nil
@@ -145,8 +258,295 @@ func (r *Result) ConversationString() string {
 	updated := r.Updated
 
 	if updated == "" {
-		return fmt.Sprintf("Conversation on %s:\n%s\n\n", created, content)
+		return fmt.Sprintf("Excerpt of a conversation on %s:\n%s\n\n", created, content)
+	}
+
+	return fmt.Sprintf("Excerpt of a conversation from %s to %s:\n%s\n\n", created, updated, content)
+}
+
+// validConversationID reports whether the thread ID may be used as the name
+// of the conversation's file.
+func validConversationID(threadID string) bool {
+	return threadID != "" && !strings.ContainsAny(threadID, `/\`) && !strings.HasPrefix(threadID, ".")
+}
+
+func conversationFilePath(threadID string) string {
+	return filepath.Join(ConversationsPath, threadID+".json")
+}
+
+// readConversationFile reads the conversation stored under threadID in dir.
+func readConversationFile(dir string, threadID string) (*Conversation, error) {
+	if !validConversationID(threadID) {
+		return nil, fmt.Errorf("invalid conversation ID: %q", threadID)
+	}
+
+	buf, err := os.ReadFile(filepath.Join(dir, threadID+".json"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			debug.Log("[storage] [convo] Conversation not found: %s", threadID)
+			return nil, fmt.Errorf("conversation not found: %s", threadID)
+		}
+
+		return nil, err
+	}
+
+	var conversation Conversation
+	if err := json.Unmarshal(buf, &conversation); err != nil {
+		return nil, fmt.Errorf("error parsing conversation %s: %w", threadID, err)
+	}
+
+	return &conversation, nil
+}
+
+// readConversationFiles reads all of the conversations stored in dir, most
+// recently updated first. Conversations that cannot be read are logged and
+// skipped.
+func readConversationFiles(dir string) ([]*Conversation, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	conversations := []*Conversation{}
+
+	for _, path := range paths {
+		threadID := strings.TrimSuffix(filepath.Base(path), ".json")
+
+		conversation, err := readConversationFile(dir, threadID)
+		if err != nil {
+			debug.Log("[storage] [convo] Skipping conversation %s: %v", threadID, err)
+			continue
+		}
+
+		conversations = append(conversations, conversation)
+	}
+
+	sort.Slice(conversations, func(i, j int) bool {
+		return conversations[i].Updated.After(conversations[j].Updated)
+	})
+
+	return conversations, nil
+}
+
+// writeConversationFile writes the conversation to a temporary file in dir
+// and then renames it into place, so that a crash cannot leave a partially
+// written conversation behind.
+func writeConversationFile(dir string, conversation *Conversation) error {
+	if !validConversationID(conversation.ID) {
+		return fmt.Errorf("invalid conversation ID: %q", conversation.ID)
+	}
+
+	buf, err := json.MarshalIndent(conversation, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializing conversation: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, conversation.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, conversation.ID+".json"))
+}
+
+// defaultConversationTitle titles a conversation with the first line of the
+// user's first visible message.
+func defaultConversationTitle(msgs []messages.Message) string {
+	for _, msg := range msgs {
+		if !msg.IsUserMessage() || msg.IsHidden {
+			continue
+		}
+
+		title, _, _ := strings.Cut(strings.TrimSpace(msg.Content), "\n")
+		if len(title) > 80 {
+			title = title[:77] + "..."
+		}
+
+		return title
+	}
+
+	return ""
+}
+
+// conversationWindows splits the conversation's displayed messages into
+// overlapping windows, formatted as transcripts, to be indexed. The windows
+// are keyed by their document IDs.
+func conversationWindows(conversation *Conversation) map[string]string {
+	var indexed []messages.Message
+	for _, msg := range conversation.Messages {
+		if msg.From == messages.System || msg.IsHidden {
+			continue
+		}
+
+		if len(msg.Content) > conversationIndexMaxChars {
+			msg.Content = msg.Content[:conversationIndexMaxChars] + "..."
+		}
+
+		indexed = append(indexed, msg)
+	}
+
+	windows := map[string]string{}
+
+	for start := 0; start < len(indexed); start += conversationWindowStride {
+		end := min(start+conversationWindowSize, len(indexed))
+
+		window := messages.Conversation{Messages: indexed[start:end]}
+		windows[conversationWindowID(conversation.ID, start)] = window.ChatTranscript()
+
+		if end == len(indexed) {
+			break
+		}
+	}
+
+	return windows
+}
+
+func conversationWindowID(threadID string, start int) string {
+	return threadID + "#" + strconv.Itoa(start)
+}
+
+// windowDocument returns the index document for one of the conversation's
+// windows, without its embedding.
+func windowDocument(conversation *Conversation, id string, content string) chromem.Document {
+	return chromem.Document{
+		ID:      id,
+		Content: content,
+		Metadata: map[string]string{
+			metaConversationThreadID: conversation.ID,
+			metaConversationStart:    strings.TrimPrefix(id, conversation.ID+"#"),
+		},
+	}
+}
+
+// indexConversation updates the conversation's windows in the index. Only
+// windows whose content has changed are embedded.
+func indexConversation(collection *chromem.Collection, conversation *Conversation) error {
+	ctx := context.Background()
+	windows := conversationWindows(conversation)
+
+	var changed []chromem.Document
+
+	for id, content := range windows {
+		existing, err := collection.GetByID(ctx, id)
+		if err == nil && existing.Content == content {
+			continue
+		}
+
+		changed = append(changed, windowDocument(conversation, id, content))
+	}
+
+	// Remove any windows past the end of the conversation
+	for start := len(windows) * conversationWindowStride; ; start += conversationWindowStride {
+		id := conversationWindowID(conversation.ID, start)
+		if _, err := collection.GetByID(ctx, id); err != nil {
+			break
+		}
+
+		if err := collection.Delete(ctx, nil, nil, id); err != nil {
+			return err
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	debug.Log("[storage] [convo] Indexing %d windows of conversation %s", len(changed), conversation.ID)
+
+	return collection.AddDocuments(ctx, changed, 1)
+}
+
+// migrateConversations moves conversations stored in the index as flat
+// transcripts to their own files, and indexes them in windows. A
+// conversation that fails to migrate is logged and left in place, to be
+// retried the next time the collection is initialized. Once every
+// conversation has been migrated, that is recorded in the collection's
+// metadata, and the index is not read through again.
+func migrateConversations(collectionName string) error {
+	metadata, err := collectionMetadata(collectionName)
+	if err != nil {
+		return err
+	}
+
+	if metadata[metaConversationsMigrated] != "" {
+		return nil
+	}
+
+	snap, err := snapshotCollection(collectionName)
+	if err != nil {
+		return err
+	}
+
+	migrated := true
+
+	for id, doc := range snap.Documents {
+		if doc.Metadata[metaConversationThreadID] != "" {
+			continue
+		}
+
+		debug.Log("[storage] [convo] Migrating conversation %s", id)
+
+		if err := migrateConversation(doc); err != nil {
+			debug.Log("[storage] [convo] Failed to migrate conversation %s: %v", id, err)
+			migrated = false
+		}
+	}
+
+	if !migrated {
+		return nil
+	}
+
+	updated := map[string]string{metaConversationsMigrated: "true"}
+	for key, value := range metadata {
+		updated[key] = value
+	}
+
+	return recordCollectionMetadata(collectionName, updated)
+}
+
+func migrateConversation(doc *chromem.Document) error {
+	conversation, err := LoadConversation(doc.ID)
+	if err != nil {
+		conversation = &Conversation{
+			ID:       doc.ID,
+			Box:      conversationsBox,
+			Created:  parseConversationTime(doc.Metadata["created"]),
+			Updated:  parseConversationTime(doc.Metadata["updated"]),
+			Messages: messages.ParseTranscript(doc.Content).Messages,
+		}
+
+		conversation.Title = defaultConversationTitle(conversation.Messages)
+
+		// Written directly, rather than with SaveConversation, to preserve
+		// the conversation's original update time
+		if err := writeConversationFile(ConversationsPath, conversation); err != nil {
+			return err
+		}
+	}
+
+	if err := indexConversation(Conversations, conversation); err != nil {
+		return err
+	}
+
+	return Conversations.Delete(context.Background(), nil, nil, doc.ID)
+}
+
+func parseConversationTime(value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Now()
 	}
 
-	return fmt.Sprintf("Conversation from %s to %s:\n%s\n\n", created, updated, content)
+	return parsed
 }
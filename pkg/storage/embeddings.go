@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/philippgille/chromem-go"
+
+	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/debug"
+)
+
+// LocalEmbeddingDimensions is the size of the vectors produced by the local
+// hashing embedder.
+const LocalEmbeddingDimensions = 512
+
+// Collection metadata keys identifying the embedding provider used to embed
+// the collection's documents.
+const (
+	metaEmbeddingProvider = "embedding_provider"
+	metaEmbeddingModel    = "embedding_model"
+)
+
+// EmbeddingProvider identifies the embedding function used by the storage
+// system. Embeddings from different providers (or different models of the same
+// provider) are not comparable, so a collection may only be used with the
+// provider that originally embedded its documents.
+type EmbeddingProvider struct {
+	Name  string
+	Model string
+	Embed chromem.EmbeddingFunc
+}
+
+// Embeddings is the embedding provider selected in the configuration.
+var Embeddings *EmbeddingProvider
+
+// EmbeddingProviderMismatch is returned when opening a collection that was
+// embedded by a different provider than the one currently configured.
+type EmbeddingProviderMismatch struct {
+	Collection string
+	Expected   string
+	Configured string
+}
+
+func (e *EmbeddingProviderMismatch) Error() string {
+	return fmt.Sprintf("collection %s was embedded with %s, but the configured embedding provider is %s", e.Collection, e.Expected, e.Configured)
+}
+
+// NewEmbeddingProvider returns the embedding provider selected in the
+// configuration.
+func NewEmbeddingProvider(conf *config.Config) (*EmbeddingProvider, error) {
+	switch conf.EmbeddingProvider {
+	case config.EmbeddingProviderOpenAI, "":
+		model := conf.EmbeddingModel
+		if model == "" {
+			model = config.DefaultOpenAIEmbeddingModel
+		}
+
+		return &EmbeddingProvider{
+			Name:  config.EmbeddingProviderOpenAI,
+			Model: model,
+			Embed: chromem.NewEmbeddingFuncOpenAI(conf.OpenAIApiKey, chromem.EmbeddingModelOpenAI(model)),
+		}, nil
+
+	case config.EmbeddingProviderOpenAICompat:
+		return &EmbeddingProvider{
+			Name:  conf.EmbeddingProvider,
+			Model: conf.EmbeddingModel,
+			Embed: chromem.NewEmbeddingFuncOpenAICompat(conf.EmbeddingBaseURL, conf.OpenAIApiKey, conf.EmbeddingModel, nil),
+		}, nil
+
+	case config.EmbeddingProviderOllama:
+		return &EmbeddingProvider{
+			Name:  conf.EmbeddingProvider,
+			Model: conf.EmbeddingModel,
+			Embed: chromem.NewEmbeddingFuncOllama(conf.EmbeddingModel, conf.EmbeddingBaseURL),
+		}, nil
+
+	case config.EmbeddingProviderLocal:
+		return &EmbeddingProvider{
+			Name:  conf.EmbeddingProvider,
+			Model: fmt.Sprintf("hash-%d", LocalEmbeddingDimensions),
+			Embed: NewLocalEmbeddingFunc(LocalEmbeddingDimensions),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown embedding provider: %s", conf.EmbeddingProvider)
+	}
+}
+
+// String returns the provider's name and model, e.g. "openai:text-embedding-3-small".
+func (p *EmbeddingProvider) String() string {
+	return p.Name + ":" + p.Model
+}
+
+func (p *EmbeddingProvider) metadata() map[string]string {
+	return map[string]string{
+		metaEmbeddingProvider: p.Name,
+		metaEmbeddingModel:    p.Model,
+	}
+}
+
+// openCollection gets or creates the named collection using the configured
+// embedding provider. New collections are tagged with the provider. Existing
+// collections are refused if they were embedded by a different provider,
+// unless they are empty, in which case they are recreated.
+func openCollection(name string) (*chromem.Collection, error) {
+	collection := DB.GetCollection(name, Embeddings.Embed)
+	if collection == nil {
+		return createCollection(name, Embeddings.metadata())
+	}
+
+	metadata, err := collectionMetadata(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collections created before providers were recorded were always
+	// embedded by chromem's default, OpenAI's text-embedding-3-small.
+	provider := metadata[metaEmbeddingProvider]
+	model := metadata[metaEmbeddingModel]
+	if provider == "" {
+		provider = config.EmbeddingProviderOpenAI
+		model = config.DefaultOpenAIEmbeddingModel
+	}
+
+	if provider == Embeddings.Name && model == Embeddings.Model {
+		return collection, nil
+	}
+
+	if collection.Count() == 0 {
+		debug.Log("[storage] Recreating empty collection %s for embedding provider %s", name, Embeddings)
+
+		if err := deleteCollection(name); err != nil {
+			return nil, err
+		}
+
+		return createCollection(name, Embeddings.metadata())
+	}
+
+	return nil, &EmbeddingProviderMismatch{
+		Collection: name,
+		Expected:   provider + ":" + model,
+		Configured: Embeddings.String(),
+	}
+}
+
+// NewLocalEmbeddingFunc returns a deterministic embedding function that runs
+// entirely offline. It uses the "hashing trick" to map each word in the text
+// onto one of a fixed number of dimensions. Texts sharing words will be
+// similar, but it has no understanding of synonyms or meaning.
+func NewLocalEmbeddingFunc(dimensions int) chromem.EmbeddingFunc {
+	return func(_ context.Context, text string) ([]float32, error) {
+		vector := make([]float32, dimensions)
+
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+
+		for _, word := range words {
+			hash := fnv.New64a()
+			hash.Write([]byte(word))
+			sum := hash.Sum64()
+
+			// Use one bit of the hash as the sign, so that collisions tend to
+			// cancel out rather than accumulate.
+			idx := int(sum % uint64(dimensions))
+			if sum&(1<<63) == 0 {
+				vector[idx] += 1
+			} else {
+				vector[idx] -= 1
+			}
+		}
+
+		// chromem requires normalized vectors. An empty text gets an arbitrary
+		// unit vector rather than a zero vector, which cannot be normalized.
+		var norm float64
+		for _, v := range vector {
+			norm += float64(v * v)
+		}
+
+		if norm == 0 {
+			vector[0] = 1
+			return vector, nil
+		}
+
+		norm = math.Sqrt(norm)
+		for i := range vector {
+			vector[i] = float32(float64(vector[i]) / norm)
+		}
+
+		return vector, nil
+	}
+}
@@ -0,0 +1,63 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+func TestLocalEmbeddingFunc(t *testing.T) {
+	embed := storage.NewLocalEmbeddingFunc(storage.LocalEmbeddingDimensions)
+
+	a, err := embed(context.Background(), "The quick brown fox")
+	assert.NoError(t, err)
+	assert.Len(t, a, storage.LocalEmbeddingDimensions)
+
+	// Embeddings are deterministic and case-insensitive
+	b, err := embed(context.Background(), "the QUICK brown fox")
+	assert.NoError(t, err)
+	assert.Equal(t, a, b)
+
+	// Empty text still produces a unit vector
+	empty, err := embed(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, float32(1), empty[0])
+}
+
+func TestEmbeddingProviderMismatch(t *testing.T) {
+	cfg := setupTestConfig(t)
+	cfg.Box = "mismatch_box"
+
+	err := storage.Init(cfg)
+	assert.NoError(t, err)
+
+	err = storage.InitializeFactsCollection(cfg)
+	assert.NoError(t, err)
+
+	err = storage.ResetFactCollection()
+	assert.NoError(t, err)
+
+	_, err = storage.CreateFact("Embedded by the local provider")
+	assert.NoError(t, err)
+
+	// Reopening the collection with a different provider is refused
+	configured := storage.Embeddings
+	defer func() { storage.Embeddings = configured }()
+
+	storage.Embeddings = &storage.EmbeddingProvider{
+		Name:  "other",
+		Model: "other-model",
+		Embed: configured.Embed,
+	}
+
+	err = storage.InitializeFactsCollection(cfg)
+	assert.ErrorAs(t, err, new(*storage.EmbeddingProviderMismatch))
+
+	// ...and allowed again with the original provider
+	storage.Embeddings = configured
+	err = storage.InitializeFactsCollection(cfg)
+	assert.NoError(t, err)
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,19 +16,38 @@ import (
 // Facts represents the collection of stored facts.
 var Facts *chromem.Collection
 
+// The name of the selected box's facts collection
+var factsCollectionName string
+
 // InitializeFactsCollection initializes the facts collection in the chromem database.
 func InitializeFactsCollection(config *config.Config) error {
 	debug.Log("[storage] [facts] Initializing facts collection facts:%s", config.Box)
 	var err error
 	collectionName := "facts:" + config.Box
-	Facts, err = DB.GetOrCreateCollection(collectionName, nil, nil)
+	Facts, err = openCollection(collectionName)
+	factsCollectionName = collectionName
 	return err
 }
 
 // ResetFactCollection removes all facts from the collection.
 func ResetFactCollection() error {
 	debug.Log("[storage] [facts] Resetting facts collection")
-	return Facts.Delete(context.Background(), nil, nil, "")
+
+	facts, err := ListFacts()
+	if err != nil {
+		return err
+	}
+
+	if len(facts) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(facts))
+	for i, fact := range facts {
+		ids[i] = fact.ID
+	}
+
+	return Facts.Delete(context.Background(), nil, nil, ids...)
 }
 
 // CreateFact stores a new fact and returns its UUID.
@@ -121,6 +141,37 @@ func DeleteFact(id string) error {
 	return nil
 }
 
+// ListFacts returns every fact in the box, most recently updated first.
+func ListFacts() ([]Result, error) {
+	debug.Log("[storage] [facts] Listing facts")
+
+	snap, err := snapshotCollection(factsCollectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	found := []Result{}
+	for _, doc := range snap.Documents {
+		found = append(found, Result{
+			ID:      doc.ID,
+			Content: doc.Content,
+			Created: doc.Metadata["created"],
+			Updated: doc.Metadata["updated"],
+		})
+	}
+
+	// Timestamps are RFC3339, so they sort as strings
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Updated != found[j].Updated {
+			return found[i].Updated > found[j].Updated
+		}
+
+		return found[i].ID < found[j].ID
+	})
+
+	return found, nil
+}
+
 // SearchFact returns a list of facts that match the query.
 func SearchFacts(query string, numResults int) ([]Result, error) {
 	debug.Log("[storage] [facts] Searching facts for %d results using query '%s'", numResults, query)
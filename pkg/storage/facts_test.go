@@ -2,6 +2,7 @@ package storage_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/sysread/fnord/pkg/config"
@@ -11,8 +12,9 @@ import (
 // Setup initializes the test configuration and database.
 func setupTestConfig(t *testing.T) *config.Config {
 	return &config.Config{
-		Home: t.TempDir(), // Use a temporary directory for the tests
-		Box:  "test_box",  // Use a distinct box for testing
+		Home:              t.TempDir(), // Use a temporary directory for the tests
+		Box:               "test_box",  // Use a distinct box for testing
+		EmbeddingProvider: "local",     // Do not call out to an embeddings API
 	}
 }
 
@@ -48,8 +50,9 @@ func TestFactStorage(t *testing.T) {
 
 	// Test UpdateFact
 	newContent := "This is an updated fact."
-	err = storage.UpdateFact(id, newContent)
+	updatedID, err := storage.UpdateFact(id, newContent)
 	assert.NoError(t, err)
+	assert.Equal(t, id, updatedID)
 
 	// Test Read after Update
 	updatedContent, err := storage.ReadFact(id)
@@ -103,3 +106,41 @@ func TestSearchFact(t *testing.T) {
 	assert.Len(t, searchResults, 1)
 	assert.Equal(t, "A third interesting fact", searchResults[0].Content)
 }
+
+func TestListFacts(t *testing.T) {
+	// Setup configuration and storage
+	cfg := setupTestConfig(t)
+	setupTestStorage(t, cfg)
+
+	facts, err := storage.ListFacts()
+	assert.NoError(t, err)
+	assert.Empty(t, facts)
+
+	first, err := storage.CreateFact("The first fact")
+	assert.NoError(t, err)
+
+	second, err := storage.CreateFact("The second fact")
+	assert.NoError(t, err)
+
+	// Timestamps have a resolution of one second
+	time.Sleep(1100 * time.Millisecond)
+
+	_, err = storage.UpdateFact(first, "The first fact, corrected")
+	assert.NoError(t, err)
+
+	// Most recently updated first
+	facts, err = storage.ListFacts()
+	assert.NoError(t, err)
+	if assert.Len(t, facts, 2) {
+		assert.Equal(t, first, facts[0].ID)
+		assert.Equal(t, "The first fact, corrected", facts[0].Content)
+		assert.Equal(t, second, facts[1].ID)
+	}
+
+	err = storage.ResetFactCollection()
+	assert.NoError(t, err)
+
+	facts, err = storage.ListFacts()
+	assert.NoError(t, err)
+	assert.Empty(t, facts)
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Project files are indexed in overlapping chunks of lines, so that each
+// chunk fits within the embedding model's limits and a search returns only
+// the relevant part of a file. Chunks end before a top-level definition or a
+// paragraph where possible.
+const (
+	projectChunkMinLines = 20
+	projectChunkMaxLines = 80
+	projectChunkMaxChars = 6000
+	projectChunkOverlap  = 5
+)
+
+// Metadata keys of the project index's documents
+const (
+	metaProjectPath      = "path"
+	metaProjectStartLine = "start_line"
+	metaProjectEndLine   = "end_line"
+	metaProjectLanguage  = "language"
+	metaProjectHash      = "hash" // Of the whole file's content
+)
+
+// projectChunk is a range of a project file's lines.
+type projectChunk struct {
+	StartLine int // Numbered from 1
+	EndLine   int // Inclusive
+	Content   string
+}
+
+// projectChunkID returns the ID of a chunk's document, which is also how it
+// is cited, e.g. "/path/to/main.go:L10-L58".
+func projectChunkID(path string, chunk projectChunk) string {
+	return fmt.Sprintf("%s:L%d-L%d", path, chunk.StartLine, chunk.EndLine)
+}
+
+// chunkProjectFile splits a file's content into overlapping chunks.
+func chunkProjectFile(content string) []projectChunk {
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+
+	// A trailing newline does not start another line
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	chunks := []projectChunk{}
+
+	for start := 0; start < len(lines); {
+		end := projectChunkEnd(lines, start)
+
+		text := strings.Join(lines[start:end], "\n")
+
+		// A single line may be longer than a chunk, as in minified files
+		if len(text) > projectChunkMaxChars {
+			text = strings.ToValidUTF8(text[:projectChunkMaxChars], "")
+		}
+
+		if strings.TrimSpace(text) != "" {
+			chunks = append(chunks, projectChunk{
+				StartLine: start + 1,
+				EndLine:   end,
+				Content:   text,
+			})
+		}
+
+		if end == len(lines) {
+			break
+		}
+
+		start = max(end-projectChunkOverlap, start+1)
+	}
+
+	return chunks
+}
+
+// projectChunkEnd returns the index of the line after the last line of the
+// chunk beginning at start.
+func projectChunkEnd(lines []string, start int) int {
+	// Find the most lines that fit in a chunk
+	limit := start
+	size := 0
+
+	for limit < len(lines) && limit-start < projectChunkMaxLines {
+		size += len(lines[limit]) + 1
+		if size > projectChunkMaxChars && limit > start {
+			break
+		}
+
+		limit++
+	}
+
+	if limit == len(lines) {
+		return limit
+	}
+
+	// Don't let a chunk end so early that it is mostly overlap
+	earliest := start + min(projectChunkMinLines, (limit-start)/2)
+
+	// Prefer to end the chunk before a top-level definition, then before a
+	// paragraph, and otherwise at the limit.
+	for _, isBoundary := range []func([]string, int) bool{isTopLevelBoundary, isParagraphBoundary} {
+		for end := limit; end > earliest; end-- {
+			if isBoundary(lines, end) {
+				return end
+			}
+		}
+	}
+
+	return limit
+}
+
+// isParagraphBoundary reports whether the line begins a paragraph; that is,
+// it follows a blank line.
+func isParagraphBoundary(lines []string, i int) bool {
+	return i > 0 && strings.TrimSpace(lines[i-1]) == "" && strings.TrimSpace(lines[i]) != ""
+}
+
+// isTopLevelBoundary reports whether the line begins an unindented paragraph,
+// which is usually a definition or its doc comment in code, or a heading in
+// prose. Closing brackets don't count.
+func isTopLevelBoundary(lines []string, i int) bool {
+	return isParagraphBoundary(lines, i) && !strings.ContainsRune(" \t})]", rune(lines[i][0]))
+}
+
+// projectFileLanguages maps file extensions, and some file names, to the
+// languages recorded with the index's documents.
+var projectFileLanguages = map[string]string{
+	".c":          "c",
+	".h":          "c",
+	".cc":         "cpp",
+	".cpp":        "cpp",
+	".hpp":        "cpp",
+	".cs":         "csharp",
+	".css":        "css",
+	".ex":         "elixir",
+	".exs":        "elixir",
+	".erl":        "erlang",
+	".go":         "go",
+	".hs":         "haskell",
+	".html":       "html",
+	".java":       "java",
+	".js":         "javascript",
+	".jsx":        "javascript",
+	".mjs":        "javascript",
+	".json":       "json",
+	".kt":         "kotlin",
+	".lua":        "lua",
+	".md":         "markdown",
+	".ml":         "ocaml",
+	".php":        "php",
+	".pl":         "perl",
+	".pm":         "perl",
+	".py":         "python",
+	".rb":         "ruby",
+	".rs":         "rust",
+	".scala":      "scala",
+	".sh":         "shell",
+	".bash":       "shell",
+	".zsh":        "shell",
+	".sql":        "sql",
+	".swift":      "swift",
+	".toml":       "toml",
+	".ts":         "typescript",
+	".tsx":        "typescript",
+	".txt":        "text",
+	".xml":        "xml",
+	".yaml":       "yaml",
+	".yml":        "yaml",
+	"Dockerfile":  "dockerfile",
+	"Makefile":    "make",
+	"Gemfile":     "ruby",
+	"Rakefile":    "ruby",
+	"go.mod":      "go.mod",
+	"Jenkinsfile": "groovy",
+}
+
+// projectFileLanguage returns the language of the file, or an empty string if
+// it is not known.
+func projectFileLanguage(path string) string {
+	if language, ok := projectFileLanguages[filepath.Base(path)]; ok {
+		return language
+	}
+
+	return projectFileLanguages[strings.ToLower(filepath.Ext(path))]
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkProjectFile(t *testing.T) {
+	assert.Empty(t, chunkProjectFile(""))
+
+	// Short files are a single chunk
+	chunks := chunkProjectFile("package main\n\nfunc main() {}\n")
+	assert.Equal(t, []projectChunk{{StartLine: 1, EndLine: 3, Content: "package main\n\nfunc main() {}"}}, chunks)
+
+	// Longer files end their chunks before top-level definitions
+	var src strings.Builder
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&src, "// widget%d frobnicates\nfunc widget%d() {\n", i, i)
+		for j := 0; j < 10; j++ {
+			fmt.Fprintf(&src, "\tstep(%d)\n\n", j)
+		}
+		src.WriteString("}\n\n")
+	}
+
+	lines := strings.Split(src.String(), "\n")
+	chunks = chunkProjectFile(src.String())
+	assert.Greater(t, len(chunks), 1)
+	assert.Equal(t, 1, chunks[0].StartLine)
+
+	for i, chunk := range chunks {
+		assert.LessOrEqual(t, chunk.EndLine-chunk.StartLine+1, projectChunkMaxLines)
+		assert.Equal(t, strings.Join(lines[chunk.StartLine-1:chunk.EndLine], "\n"), chunk.Content)
+
+		if i == len(chunks)-1 {
+			break
+		}
+
+		// Each chunk ends before a doc comment, and overlaps the next
+		assert.True(t, strings.HasPrefix(lines[chunk.EndLine], "// widget"), lines[chunk.EndLine])
+		assert.Equal(t, chunk.EndLine-projectChunkOverlap+1, chunks[i+1].StartLine)
+	}
+
+	assert.Equal(t, len(lines)-1, chunks[len(chunks)-1].EndLine)
+
+	// Long lines are split by size
+	chunks = chunkProjectFile(strings.Repeat(strings.Repeat("x", 1000)+"\n", 20))
+	assert.Equal(t, 1, chunks[0].StartLine)
+	assert.Equal(t, projectChunkMaxChars/1001, chunks[0].EndLine)
+
+	assert.Equal(t, "/src/main.go:L10-L58", projectChunkID("/src/main.go", projectChunk{StartLine: 10, EndLine: 58}))
+	assert.Equal(t, "go", projectFileLanguage("/src/main.go"))
+	assert.Equal(t, "make", projectFileLanguage("/src/Makefile"))
+	assert.Equal(t, "", projectFileLanguage("/src/LICENSE"))
+}
@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/fsnotify/fsnotify"
@@ -23,12 +24,16 @@ import (
 // unset, the service will not index a project directory.
 var ProjectPath string
 
-// ProjectFiles is the chromem collection of files in the project directory
+// ProjectFiles is the chromem collection of files in the project directory.
+// Its documents are chunks of each file's lines (see project_chunks.go).
 var ProjectFiles *chromem.Collection
 
 // ProjectGitIgnored is the gitignore parser for the project directory
 var ProjectGitIgnored *gitignore.GitIgnore
 
+// The number of files indexed at once
+var projectIndexWorkers int
+
 func InitializeProjectFilesCollection(config *config.Config) error {
 	debug.Log("[storage] [project] Initializing project files collection from root path %s", config.ProjectPath)
 	var err error
@@ -41,20 +46,51 @@ func InitializeProjectFilesCollection(config *config.Config) error {
 
 	ProjectPath = config.ProjectPath
 
+	projectIndexWorkers = max(config.IndexWorkers, 1)
+
 	collectionName := fmt.Sprintf("project_files:%s", ProjectPath)
-	ProjectFiles, err = DB.GetOrCreateCollection(collectionName, nil, nil)
+	ProjectFiles, err = openCollection(collectionName)
 	if err != nil {
 		debug.Log("[storage] [project] Error creating %s collection: %v", collectionName, err)
-	} else {
-		// Load the .gitignore file
-		ProjectGitIgnored, err = gitignore.CompileIgnoreFile(filepath.Join(ProjectPath, ".gitignore"))
+		return err
+	}
+
+	// Only files that have changed since the project was last indexed are
+	// indexed again. Without a manifest, there's no telling which of the
+	// collection's documents are current, so it is rebuilt.
+	var current bool
+	projectIndex, current, err = loadProjectManifest(config.Home, ProjectPath)
+	if err != nil {
+		return err
+	}
+
+	if !current && ProjectFiles.Count() > 0 {
+		debug.Log("[storage] [project] Rebuilding the index of %s", ProjectPath)
+
+		if err := deleteCollection(collectionName); err != nil {
+			return err
+		}
+
+		ProjectFiles, err = openCollection(collectionName)
 		if err != nil {
 			return err
 		}
+	}
+
+	// The collection is recreated if it was empty when the embedding
+	// provider changed
+	if current && ProjectFiles.Count() == 0 {
+		projectIndex.Files = map[string]*projectManifestEntry{}
+	}
 
-		go startIndexer()
+	// Load the .gitignore file
+	ProjectGitIgnored, err = gitignore.CompileIgnoreFile(filepath.Join(ProjectPath, ".gitignore"))
+	if err != nil {
+		return err
 	}
 
+	go startIndexer()
+
 	return nil
 }
 
@@ -75,6 +111,8 @@ func GetProjects() ([]string, error) {
 }
 
 // Searches the project file index for the given query and returns the results.
+// Each result is a chunk of a file, identified by the file's path and the
+// chunk's lines, e.g. "/path/to/main.go:L10-L58".
 func SearchProject(query string, numResults int) ([]Result, error) {
 	debug.Log("[storage] [project] Searching project files for %d results using query: '%s'", numResults, query)
 
@@ -100,7 +138,7 @@ func SearchProject(query string, numResults int) ([]Result, error) {
 
 	var found []Result
 	for _, doc := range results {
-		debug.Log("[storage] [project] Found project file: %s", doc.ID)
+		debug.Log("[storage] [project] Found project file chunk: %s", doc.ID)
 
 		found = append(found, Result{
 			ID:      doc.ID,
@@ -126,17 +164,30 @@ func startIndexer() {
 		return
 	}
 
+	projectQueue = newIndexQueue()
+
+	for i := 0; i < projectIndexWorkers; i++ {
+		go indexWorker(projectQueue)
+	}
+
 	// On init, ensure that everything that is not git-ignored in the
-	// project directory is indexed.
-	var toIndex []string
+	// project directory is indexed. Only new and changed files are
+	// embedded.
+	present := map[string]bool{}
 
 	// Queue files for indexing
 	walkProjectDir(func(path string) {
-		toIndex = append(toIndex, path)
+		projectQueue.add(path, 0)
+		present[path] = true
 	})
 
-	// Queue them for indexing
-	indexPaths(toIndex)
+	// Queue files that have vanished since the project was last indexed,
+	// to be removed from the index
+	for _, path := range projectIndex.paths() {
+		if !present[path] {
+			projectQueue.add(path, 0)
+		}
+	}
 
 	// Start the directory watcher, and index new files or files that have changed.
 	err := watchProjectDir()
@@ -145,8 +196,58 @@ func startIndexer() {
 	}
 }
 
+// indexWorker indexes the files queued in q, until the program exits.
+func indexWorker(q *indexQueue) {
+	for {
+		path := q.next()
+
+		indexQueuedPath(path)
+
+		if q.finish(path) {
+			saveProjectIndex()
+		}
+	}
+}
+
+// indexQueuedPath indexes a queued file, or removes it from the index if it
+// no longer exists or may no longer be indexed. If it was a directory, the
+// files that were in it are removed.
+func indexQueuedPath(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		for _, indexed := range projectIndex.paths() {
+			if indexed == path || strings.HasPrefix(indexed, path+string(filepath.Separator)) {
+				unindexFile(indexed)
+			}
+		}
+
+		return
+	}
+
+	if info.IsDir() {
+		return
+	}
+
+	if !canIndex(path) {
+		if projectIndex.get(path) != nil {
+			unindexFile(path)
+		}
+
+		return
+	}
+
+	if _, err := indexFile(path); err != nil {
+		debug.Log("[storage] [project] Error indexing %s: %v", path, err)
+	}
+}
+
 func walkProjectDir(fn func(path string)) error {
-	err := filepath.WalkDir(ProjectPath, func(path string, d fs.DirEntry, err error) error {
+	return walkDir(ProjectPath, fn)
+}
+
+// walkDir calls fn with each file under dir that may be indexed.
+func walkDir(dir string, fn func(path string)) error {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -166,7 +267,7 @@ func walkProjectDir(fn func(path string)) error {
 	})
 
 	if err != nil {
-		return fmt.Errorf("error performing initial index of project directory: %v", err)
+		return fmt.Errorf("error walking %s: %v", dir, err)
 	}
 
 	return nil
@@ -195,46 +296,37 @@ func watchProjectDir() error {
 					return
 				}
 
-				// Handle file create, write, rename, and remove events
-				switch {
-				case event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) != 0:
-					// Ensure it's not a directory
-					info, err := os.Stat(event.Name)
+				// Handle file create, write, rename, and remove events.
+				// A renamed file's event is for its old name; its new
+				// name has a create event.
+				if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename|fsnotify.Remove) == 0 {
+					continue
+				}
 
-					if err != nil {
-						debug.Log("[storage] [project] Error getting file info: %v", err)
+				info, err := os.Stat(event.Name)
+				if err == nil && info.IsDir() {
+					if event.Op&fsnotify.Create == 0 {
 						continue
 					}
 
-					if info.IsDir() {
-						// If it's a directory, add it to the watcher recursively
-						if err = addDirRecursive(watcher, event.Name); err != nil {
-							debug.Log("[storage] [project] Failed to add new directory to watcher: %v", err)
-						}
-					} else {
-						// Queue file for indexing
-						indexPath(event.Name)
+					// If it's a new directory, add it to the watcher
+					// recursively, and index any files that were moved
+					// into it
+					if err = addDirRecursive(watcher, event.Name); err != nil {
+						debug.Log("[storage] [project] Failed to add new directory to watcher: %v", err)
 					}
 
-				case event.Op&fsnotify.Remove != 0:
-					// Handle file/directory removal
-					debug.Log("[storage] [project] File or directory removed: %s", event.Name)
+					walkDir(event.Name, func(path string) {
+						projectQueue.add(path, projectIndexDebounce)
+					})
 
-					info, err := os.Stat(event.Name)
-					if err != nil {
-						// Remove from index
-						removeFromIndex(event.Name)
-						continue
-					}
-
-					if info.IsDir() {
-						watcher.Remove(event.Name)
-						debug.Log("[storage] [project] Deleted directory removed from watcher: %s", event.Name)
-					} else {
-						// Remove from index
-						removeFromIndex(event.Name)
-					}
+					continue
 				}
+
+				// Queue the file to be indexed, or removed from the
+				// index, once it has settled
+				projectQueue.add(event.Name, projectIndexDebounce)
+
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					return
@@ -280,66 +372,127 @@ func addDirRecursive(watcher *fsnotify.Watcher, dir string) error {
 	})
 }
 
-func indexPath(path string) {
-	if !canIndex(path) {
-		return
+// indexFile indexes the file if it is new or has changed since it was last
+// indexed, replacing its old documents. It reports whether the file was
+// indexed.
+func indexFile(path string) (bool, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false, fmt.Errorf("error getting absolute path of %s: %v", path, err)
 	}
 
-	doc, err := toChromemDocument(path)
+	info, err := os.Stat(absPath)
 	if err != nil {
-		debug.Log("[storage] [project] Error converting file to document: %v", err)
-		return
+		return false, err
 	}
 
-	debug.Log("[storage] [project]   - index: %s", path)
-	ProjectFiles.AddDocuments(context.Background(), []chromem.Document{doc}, 2)
-}
+	changed, err := projectIndex.changed(absPath, info)
+	if err != nil || !changed {
+		return false, err
+	}
 
-func removeFromIndex(path string) {
-	absPath, err := filepath.Abs(path)
+	buf, err := os.ReadFile(absPath)
 	if err != nil {
-		debug.Log("[storage] [project] Error getting absolute path: %v", err)
-		return
+		return false, fmt.Errorf("error reading file %s: %v", path, err)
 	}
 
-	debug.Log("[storage] [project]   - remove from index: %s", absPath)
-	ProjectFiles.Delete(context.Background(), nil, nil, absPath)
-}
+	hash := hashContent(buf)
+	docs := toChromemDocuments(absPath, buf, hash)
 
-func indexPaths(paths []string) {
-	var toIndex []chromem.Document
+	debug.Log("[storage] [project]   - index: %s (%d chunks)", absPath, len(docs))
 
-	for _, path := range paths {
-		if !canIndex(path) {
-			continue
+	// Chunks with the same lines replace the old ones. If embedding fails,
+	// the old chunks are left in place, and the file is indexed again the
+	// next time it changes or the project is opened.
+	if len(docs) > 0 {
+		// Files are indexed concurrently by the workers, so each file's
+		// chunks are embedded one at a time.
+		if err := ProjectFiles.AddDocuments(context.Background(), docs, 1); err != nil {
+			return false, err
 		}
+	}
 
-		doc, err := toChromemDocument(path)
-		if err != nil {
-			debug.Log("[storage] [project] Error converting file to document: %v", err)
-			continue
+	entry := &projectManifestEntry{
+		Hash:    hash,
+		ModTime: info.ModTime(),
+		Size:    info.Size(),
+		Chunks:  make([]string, len(docs)),
+	}
+
+	ids := map[string]bool{}
+	for i, doc := range docs {
+		entry.Chunks[i] = doc.ID
+		ids[doc.ID] = true
+	}
+
+	// Remove the chunks that were not replaced
+	if old := projectIndex.get(absPath); old != nil {
+		var stale []string
+		for _, id := range old.Chunks {
+			if !ids[id] {
+				stale = append(stale, id)
+			}
 		}
 
-		debug.Log("[storage] [project]   - index: %s", path)
-		toIndex = append(toIndex, doc)
+		if len(stale) > 0 {
+			if err := ProjectFiles.Delete(context.Background(), nil, nil, stale...); err != nil {
+				return false, err
+			}
+		}
 	}
 
-	ProjectFiles.AddDocuments(context.Background(), toIndex, 4)
+	projectIndex.set(absPath, entry)
+
+	return true, nil
 }
 
-func toChromemDocument(path string) (chromem.Document, error) {
-	buf, err := os.ReadFile(path)
+// unindexFile removes the file's documents from the index.
+func unindexFile(path string) {
+	absPath, err := filepath.Abs(path)
 	if err != nil {
-		return chromem.Document{}, fmt.Errorf("error reading file %s: %v", path, err)
+		debug.Log("[storage] [project] Error getting absolute path: %v", err)
+		return
+	}
+
+	debug.Log("[storage] [project]   - remove from index: %s", absPath)
+
+	err = ProjectFiles.Delete(context.Background(), map[string]string{metaProjectPath: absPath}, nil)
+	if err != nil {
+		debug.Log("[storage] [project] Error removing %s from the index: %v", absPath, err)
+		return
+	}
+
+	projectIndex.remove(absPath)
+}
+
+func saveProjectIndex() {
+	if err := projectIndex.save(); err != nil {
+		debug.Log("[storage] [project] Error saving the project manifest: %v", err)
+	}
+}
+
+// toChromemDocuments splits the file's content into chunks, returning a
+// document for each.
+func toChromemDocuments(absPath string, buf []byte, hash string) []chromem.Document {
+	language := projectFileLanguage(absPath)
+	chunks := chunkProjectFile(string(buf))
+	docs := make([]chromem.Document, len(chunks))
+
+	for i, chunk := range chunks {
+		docs[i] = chromem.Document{
+			ID:      projectChunkID(absPath, chunk),
+			Content: chunk.Content,
+			Metadata: map[string]string{
+				metaProjectHash:      hash,
+				metaProjectPath:      absPath,
+				metaProjectStartLine: strconv.Itoa(chunk.StartLine),
+				metaProjectEndLine:   strconv.Itoa(chunk.EndLine),
+				metaProjectLanguage:  language,
+			},
+		}
 	}
 
-	return chromem.Document{
-		ID:      path,
-		Content: string(buf),
-		Metadata: map[string]string{
-			"hash": path,
-		},
-	}, nil
+	return docs
 }
 
 func canIndex(path string) bool {
@@ -406,9 +559,9 @@ func isGitIgnored(path string) bool {
 	return ProjectGitIgnored.MatchesPath(relpath)
 }
 
-// Result represents a search result
+// Returns a string representation of a search result.
 func (r *Result) ProjectFileString() string {
-	path := r.ID
+	location := r.ID
 	content := r.Content
-	return fmt.Sprintf("Project file: %s\n%s\n\n", path, content)
+	return fmt.Sprintf("Project file excerpt: %s\n%s\n\n", location, content)
 }
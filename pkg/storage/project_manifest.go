@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ProjectManifestsDir is the directory, relative to FNORD_HOME, in which the
+// manifests of indexed projects are stored. Each manifest records the files
+// that were indexed, so that only new and changed files are indexed when the
+// project is opened again.
+const ProjectManifestsDir = "project_manifests"
+
+// projectIndexVersion is incremented when the way project files are split
+// into documents changes, so that projects indexed the old way are indexed
+// again from scratch.
+const projectIndexVersion = 1
+
+// projectManifest records the state of each file in the project index.
+type projectManifest struct {
+	Version int                              `json:"version"`
+	Project string                           `json:"project"`
+	Files   map[string]*projectManifestEntry `json:"files"`
+
+	path  string
+	mutex sync.Mutex
+}
+
+// projectManifestEntry is an indexed file. A file whose modification time and
+// size are unchanged is assumed to be unchanged; otherwise, its content hash
+// is compared.
+type projectManifestEntry struct {
+	Hash    string    `json:"hash"`
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+
+	// The IDs of the file's documents
+	Chunks []string `json:"chunks"`
+}
+
+// projectIndex is the manifest of the selected project's index.
+var projectIndex *projectManifest
+
+// projectManifestPath returns the path of the project's manifest, which is
+// named for a hash of the project's path.
+func projectManifestPath(home string, project string) string {
+	sum := sha256.Sum256([]byte(project))
+	return filepath.Join(home, ProjectManifestsDir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// loadProjectManifest reads the project's manifest. If there is none, or it
+// was written by an older version of the indexer, an empty manifest is
+// returned, and ok is false.
+func loadProjectManifest(home string, project string) (manifest *projectManifest, ok bool, err error) {
+	manifest = &projectManifest{
+		Version: projectIndexVersion,
+		Project: project,
+		Files:   map[string]*projectManifestEntry{},
+		path:    projectManifestPath(home, project),
+	}
+
+	buf, err := os.ReadFile(manifest.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, false, nil
+	}
+
+	if err != nil {
+		return nil, false, fmt.Errorf("error reading project manifest: %w", err)
+	}
+
+	var stored projectManifest
+	if err := json.Unmarshal(buf, &stored); err != nil || stored.Version != projectIndexVersion || stored.Project != project {
+		return manifest, false, nil
+	}
+
+	if stored.Files != nil {
+		manifest.Files = stored.Files
+	}
+
+	return manifest, true, nil
+}
+
+// save writes the manifest to a temporary file and then renames it into
+// place, so that a crash cannot leave a partially written manifest behind.
+func (m *projectManifest) save() error {
+	m.mutex.Lock()
+	buf, err := json.Marshal(m)
+	m.mutex.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("error serializing project manifest: %w", err)
+	}
+
+	dir := filepath.Dir(m.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(m.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), m.path)
+}
+
+// get returns a copy of the file's entry, or nil if it is not indexed.
+func (m *projectManifest) get(path string) *projectManifestEntry {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry, ok := m.Files[path]
+	if !ok {
+		return nil
+	}
+
+	copied := *entry
+	return &copied
+}
+
+func (m *projectManifest) set(path string, entry *projectManifestEntry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.Files[path] = entry
+}
+
+func (m *projectManifest) remove(path string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.Files, path)
+}
+
+// paths returns the paths of the indexed files.
+func (m *projectManifest) paths() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	paths := make([]string, 0, len(m.Files))
+	for path := range m.Files {
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
+// changed reports whether the file has changed since it was indexed. Its
+// content is only hashed if its modification time or size has changed; if
+// only those have changed, the entry is updated.
+func (m *projectManifest) changed(path string, info os.FileInfo) (bool, error) {
+	entry := m.get(path)
+	if entry != nil && entry.ModTime.Equal(info.ModTime()) && entry.Size == info.Size() {
+		return false, nil
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	if entry == nil || entry.Hash != hash {
+		return true, nil
+	}
+
+	// Touched, but not changed
+	entry.ModTime = info.ModTime()
+	entry.Size = info.Size()
+	m.set(path, entry)
+
+	return false, nil
+}
+
+// hashContent returns the hex-encoded SHA-256 hash of a file's content.
+func hashContent(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFile returns the hex-encoded SHA-256 hash of the file's content.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("error hashing %s: %w", path, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
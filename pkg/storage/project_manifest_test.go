@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysread/fnord/pkg/config"
+)
+
+func TestIncrementalProjectIndexing(t *testing.T) {
+	cfg := &config.Config{
+		Home:              t.TempDir(),
+		Box:               "test_box",
+		EmbeddingProvider: config.EmbeddingProviderLocal,
+	}
+
+	assert.NoError(t, Init(cfg))
+
+	project := t.TempDir()
+
+	var err error
+	ProjectFiles, err = openCollection("project_files:" + project)
+	assert.NoError(t, err)
+
+	var current bool
+	projectIndex, current, err = loadProjectManifest(cfg.Home, project)
+	assert.NoError(t, err)
+	assert.False(t, current)
+
+	t.Cleanup(func() {
+		ProjectFiles = nil
+		projectIndex = nil
+	})
+
+	// A file long enough to be split into chunks
+	path := filepath.Join(project, "widget.go")
+	long := strings.Repeat("// frobnicate the widget\n\n", 100)
+	assert.NoError(t, os.WriteFile(path, []byte(long), 0600))
+
+	indexed, err := indexFile(path)
+	assert.NoError(t, err)
+	assert.True(t, indexed)
+	assert.Greater(t, ProjectFiles.Count(), 1)
+	assert.Equal(t, hashContent([]byte(long)), projectIndex.get(path).Hash)
+
+	// Unchanged files are not indexed again, even if they were touched
+	indexed, err = indexFile(path)
+	assert.NoError(t, err)
+	assert.False(t, indexed)
+
+	touched := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, touched, touched))
+
+	indexed, err = indexFile(path)
+	assert.NoError(t, err)
+	assert.False(t, indexed)
+	assert.True(t, projectIndex.get(path).ModTime.Equal(touched))
+
+	// The manifest is kept between runs
+	saveProjectIndex()
+
+	loaded, current, err := loadProjectManifest(cfg.Home, project)
+	assert.NoError(t, err)
+	assert.True(t, current)
+	assert.Equal(t, projectIndex.get(path).Chunks, loaded.get(path).Chunks)
+
+	// Chunks that no longer exist are removed when the file changes
+	assert.NoError(t, os.WriteFile(path, []byte("package widget\n"), 0600))
+
+	indexed, err = indexFile(path)
+	assert.NoError(t, err)
+	assert.True(t, indexed)
+	assert.Equal(t, 1, ProjectFiles.Count())
+	assert.Equal(t, []string{path + ":L1-L1"}, projectIndex.get(path).Chunks)
+
+	unindexFile(path)
+	assert.Equal(t, 0, ProjectFiles.Count())
+	assert.Nil(t, projectIndex.get(path))
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// Changes to a file are indexed once the file has been left alone this long,
+// so that a burst of writes, such as from a checkout or a formatter, indexes
+// each file once.
+const projectIndexDebounce = 500 * time.Millisecond
+
+// The manifest is saved after this many files are indexed, as well as when
+// the queue is drained, so that little work is lost if fnord is stopped part
+// way through indexing a large project.
+const projectIndexCheckpoint = 100
+
+// IndexProgress is the progress of indexing the project's files.
+type IndexProgress struct {
+	Done  int // Files indexed since the queue was last empty
+	Total int // Files queued since the queue was last empty; 0 if it is empty
+}
+
+// indexQueue holds the paths of project files waiting to be indexed, or to
+// be removed from the index if they no longer exist. A path queued again
+// before it is indexed is only indexed once. A path is only indexed by one
+// worker at a time.
+type indexQueue struct {
+	mutex sync.Mutex
+
+	// Paths in the order they were queued, and when each may be indexed
+	order   []string
+	pending map[string]time.Time
+
+	// Paths being indexed
+	running map[string]bool
+
+	// Signalled when a path is queued or finished
+	wake chan struct{}
+
+	progress IndexProgress
+}
+
+// projectQueue is the queue of the selected project's files to index.
+var projectQueue *indexQueue
+
+func newIndexQueue() *indexQueue {
+	return &indexQueue{
+		pending: map[string]time.Time{},
+		running: map[string]bool{},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// add queues the path to be indexed after the delay. If it is already
+// queued, its delay starts over.
+func (q *indexQueue) add(path string, delay time.Duration) {
+	q.mutex.Lock()
+
+	if _, queued := q.pending[path]; !queued {
+		q.order = append(q.order, path)
+		q.progress.Total++
+	}
+
+	q.pending[path] = time.Now().Add(delay)
+
+	q.mutex.Unlock()
+
+	q.signal()
+}
+
+// next waits until a queued path is ready to be indexed, and returns it.
+func (q *indexQueue) next() string {
+	for {
+		q.mutex.Lock()
+
+		now := time.Now()
+		wait := time.Duration(-1)
+
+		for i, path := range q.order {
+			ready := q.pending[path]
+
+			if q.running[path] || ready.After(now) {
+				if delay := ready.Sub(now); delay > 0 && (wait < 0 || delay < wait) {
+					wait = delay
+				}
+
+				continue
+			}
+
+			// Paths are almost always taken from the front of the queue
+			if i == 0 {
+				q.order = q.order[1:]
+			} else {
+				q.order = append(q.order[:i], q.order[i+1:]...)
+			}
+
+			delete(q.pending, path)
+			q.running[path] = true
+
+			more := len(q.order) > 0
+
+			q.mutex.Unlock()
+
+			// Pass the signal on to the next idle worker
+			if more {
+				q.signal()
+			}
+
+			return path
+		}
+
+		q.mutex.Unlock()
+
+		if wait < 0 {
+			<-q.wake
+			continue
+		}
+
+		select {
+		case <-q.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// finish records that the path has been indexed. It reports whether the
+// manifest should be saved.
+func (q *indexQueue) finish(path string) bool {
+	q.mutex.Lock()
+
+	delete(q.running, path)
+	q.progress.Done++
+
+	checkpoint := q.progress.Done%projectIndexCheckpoint == 0
+
+	// Once the queue is drained, the next change starts a new count
+	drained := len(q.pending) == 0 && len(q.running) == 0
+	if drained {
+		q.progress = IndexProgress{}
+	}
+
+	q.mutex.Unlock()
+
+	// The path may have been queued again while it was being indexed
+	q.signal()
+
+	return checkpoint || drained
+}
+
+func (q *indexQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *indexQueue) getProgress() IndexProgress {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.progress
+}
+
+// ProjectIndexProgress returns the progress of indexing the project's files.
+// Until the queue is drained, searches of the project may miss files that
+// have not been indexed yet.
+func ProjectIndexProgress() IndexProgress {
+	if projectQueue == nil {
+		return IndexProgress{}
+	}
+
+	return projectQueue.getProgress()
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexQueue(t *testing.T) {
+	q := newIndexQueue()
+
+	// Paths queued again before they are indexed are indexed once
+	q.add("/src/a.go", 0)
+	q.add("/src/b.go", 0)
+	q.add("/src/a.go", 0)
+	assert.Equal(t, IndexProgress{Done: 0, Total: 2}, q.getProgress())
+
+	// Debounced paths wait for their delay, and are passed over for paths
+	// that are ready
+	q.add("/src/c.go", 50*time.Millisecond)
+
+	assert.Equal(t, "/src/a.go", q.next())
+	assert.Equal(t, "/src/b.go", q.next())
+	assert.False(t, q.finish("/src/a.go"))
+	assert.Equal(t, IndexProgress{Done: 1, Total: 3}, q.getProgress())
+
+	started := time.Now()
+	assert.Equal(t, "/src/c.go", q.next())
+	assert.GreaterOrEqual(t, time.Since(started), 40*time.Millisecond)
+
+	// A path being indexed is not handed to another worker until it is
+	// finished
+	q.add("/src/c.go", 0)
+
+	next := make(chan string)
+	go func() { next <- q.next() }()
+
+	select {
+	case path := <-next:
+		t.Fatalf("%s was handed out while it was being indexed", path)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	assert.False(t, q.finish("/src/c.go"))
+	assert.Equal(t, "/src/c.go", <-next)
+
+	// Progress starts over once the queue is drained
+	assert.False(t, q.finish("/src/b.go"))
+	assert.True(t, q.finish("/src/c.go"))
+	assert.Equal(t, IndexProgress{}, q.getProgress())
+}
@@ -3,6 +3,7 @@ package storage
 
 import (
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/philippgille/chromem-go"
@@ -34,11 +35,20 @@ func Init(config *config.Config) error {
 
 	Path = filepath.Join(config.Home, "vector_store")
 
+	Embeddings, err = NewEmbeddingProvider(config)
+	if err != nil {
+		return err
+	}
+
 	DB, err = chromem.NewPersistentDB(Path, true)
 	if err != nil {
 		return err
 	}
 
+	if err := loadCollectionsMeta(config.Home); err != nil {
+		return err
+	}
+
 	// Initialize the conversations collection
 	err = InitializeConversationsCollection(config)
 	if err != nil {
@@ -51,29 +61,39 @@ func Init(config *config.Config) error {
 		return err
 	}
 
-	// Initialize the project files collection
-	if config.ProjectPath != "" {
-		err = InitializeProjectFilesCollection(config)
-		if err != nil {
-			return err
-		}
+	return nil
+}
+
+// InitProject opens the project files collection, if a project was selected,
+// and starts indexing the project in the background. It is separate from
+// Init so that callers that only need the box's collections, like the
+// command-line sub-commands, do not index the project.
+func InitProject(config *config.Config) error {
+	if config.ProjectPath == "" {
+		return nil
 	}
 
-	return nil
+	return InitializeProjectFilesCollection(config)
 }
 
 // Function to list all boxes' collections
 func GetBoxes() ([]string, error) {
 	collections := DB.ListCollections()
+	seen := map[string]bool{}
 	var boxes []string
 
 	for name := range collections {
 		// We exclude project files' collections based on their naming pattern
-		if strings.HasPrefix(name, "conversations:") {
-			name = strings.TrimPrefix(name, "conversations:")
-			boxes = append(boxes, name)
+		for _, prefix := range boxCollectionPrefixes {
+			box, ok := strings.CutPrefix(name, prefix)
+			if ok && !seen[box] {
+				seen[box] = true
+				boxes = append(boxes, box)
+			}
 		}
 	}
 
+	sort.Strings(boxes)
+
 	return boxes, nil
 }
@@ -1,57 +1,252 @@
 package storage_test
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/philippgille/chromem-go"
 	"github.com/stretchr/testify/assert"
 
-	"github.com/sysread/fnord/pkg/config"
+	"github.com/sysread/fnord/pkg/debug"
+	"github.com/sysread/fnord/pkg/messages"
 	"github.com/sysread/fnord/pkg/storage"
 )
 
+// Nothing displays the logs during tests
+func TestMain(m *testing.M) {
+	debug.Discard()
+	os.Exit(m.Run())
+}
+
 func TestStorage(t *testing.T) {
 	// Setup configuration and storage
-	cfg := &config.Config{
-		Home: t.TempDir(), // Use a temporary directory for the tests
-	}
+	cfg := setupTestConfig(t)
 
 	err := storage.Init(cfg)
 	assert.NoError(t, err)
 
+	err = storage.InitializeConversationsCollection(cfg)
+	assert.NoError(t, err)
+
 	// Test Create
-	content := "This is a test conversation."
-	id, err := storage.Create(content)
+	id := "thread_test"
+	conversation := &storage.Conversation{ID: id}
+	conversation.Messages = append(conversation.Messages,
+		messages.NewMessage(messages.You, "The project is visible to you.", true),
+		messages.NewMessage(messages.You, "How do I frobnicate the widget?\nIt's urgent.", false),
+	)
+
+	err = storage.SaveConversation(conversation)
 	assert.NoError(t, err)
-	assert.NotEmpty(t, id)
+	assert.Equal(t, "How do I frobnicate the widget?", conversation.Title)
+	assert.Equal(t, cfg.Box, conversation.Box)
+	assert.FileExists(t, filepath.Join(cfg.Home, storage.ConversationsDir, cfg.Box, id+".json"))
 
 	// Test Read
-	readContent, err := storage.Read(id)
+	read, err := storage.LoadConversation(id)
 	assert.NoError(t, err)
-	assert.Equal(t, content, readContent)
+	assert.Equal(t, conversation.Messages[0].Content, read.Messages[0].Content)
+	assert.True(t, read.Messages[0].IsHidden)
+	assert.True(t, conversation.Created.Equal(read.Created))
 
 	// Test Update
-	newContent := "This is an updated conversation."
-	err = storage.Update(id, newContent)
+	assistantMsg := messages.NewMessage(messages.Assistant, "Use the frobnicator.", false)
+	assistantMsg.ToolCalls = []messages.ToolCall{{Name: "search_facts", Arguments: `{"query_text": "frobnicator"}`, Output: "none"}}
+	conversation.Messages = append(conversation.Messages, assistantMsg)
+
+	err = storage.SaveConversation(conversation)
 	assert.NoError(t, err)
 
 	// Test Read after Update
-	updatedContent, err := storage.Read(id)
+	updated, err := storage.LoadConversation(id)
 	assert.NoError(t, err)
-	assert.Equal(t, newContent, updatedContent)
+	assert.Len(t, updated.Messages, 3)
+	assert.Equal(t, assistantMsg.ToolCalls, updated.Messages[2].ToolCalls)
+	assert.True(t, updated.Created.Equal(read.Created))
 
-	// Test Search
-	searchResults, err := storage.Search("updated", 10)
+	// Test Search. Hidden messages are not indexed.
+	searchResults, err := storage.SearchConversations("frobnicator", 10)
 	assert.NoError(t, err)
 	assert.Len(t, searchResults, 1)
 	assert.Equal(t, id, searchResults[0].ID)
-	assert.Equal(t, newContent, searchResults[0].Content)
+	assert.Equal(t, "You: How do I frobnicate the widget?\nIt's urgent.\n\nAssistant: Use the frobnicator.\n\n", searchResults[0].Content)
 
 	// Test Delete
-	err = storage.Delete(id)
+	err = storage.DeleteConversation(id)
 	assert.NoError(t, err)
 
 	// Test Read after Delete
-	deletedContent, err := storage.Read(id)
+	deleted, err := storage.LoadConversation(id)
+	assert.Error(t, err)
+	assert.Nil(t, deleted)
+
+	searchResults, err = storage.SearchConversations("frobnicator", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, searchResults)
+}
+
+func TestConversationWindows(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	err := storage.Init(cfg)
+	assert.NoError(t, err)
+
+	err = storage.InitializeConversationsCollection(cfg)
+	assert.NoError(t, err)
+
+	conversation := &storage.Conversation{ID: "thread_long"}
+	for i := 0; i < 10; i++ {
+		conversation.Messages = append(conversation.Messages,
+			messages.NewMessage(messages.You, fmt.Sprintf("Question %d", i), false),
+			messages.NewMessage(messages.Assistant, fmt.Sprintf("Answer %d", i), false),
+		)
+	}
+
+	err = storage.SaveConversation(conversation)
+	assert.NoError(t, err)
+
+	// 20 messages, in windows of 6 every 3 messages
+	assert.Equal(t, 6, storage.Conversations.Count())
+
+	// Each conversation is returned once, with its best matching window
+	results, err := storage.SearchConversations("Question 9 Answer 9", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Contains(t, results[0].Content, "Answer 9")
+	}
+
+	// Windows past the end of a shortened conversation are removed
+	conversation.Messages = conversation.Messages[:4]
+	err = storage.SaveConversation(conversation)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, storage.Conversations.Count())
+
+	err = storage.DeleteConversation(conversation.ID)
+	assert.NoError(t, err)
+}
+
+func TestMigrateConversations(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	err := storage.Init(cfg)
+	assert.NoError(t, err)
+
+	// A conversation stored as a flat transcript, before conversations were
+	// stored in files, in a box that has not been opened since
+	cfg.Box = "legacy_box"
+
+	legacy, err := storage.DB.CreateCollection("conversations:"+cfg.Box, map[string]string{
+		"embedding_provider": storage.Embeddings.Name,
+		"embedding_model":    storage.Embeddings.Model,
+	}, storage.Embeddings.Embed)
+	assert.NoError(t, err)
+
+	err = legacy.AddDocument(context.Background(), chromem.Document{
+		ID:      "thread_legacy",
+		Content: "You: Hi\n\nthere\n\nAssistant (incomplete): Hello\n\n",
+		Metadata: map[string]string{
+			"created": "2024-08-01T10:00:00Z",
+			"updated": "2024-08-01T10:05:00Z",
+		},
+	})
+	assert.NoError(t, err)
+
+	err = storage.InitializeConversationsCollection(cfg)
+	assert.NoError(t, err)
+
+	conversation, err := storage.LoadConversation("thread_legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi", conversation.Title)
+	assert.Equal(t, "2024-08-01T10:05:00Z", conversation.Updated.Format(time.RFC3339))
+	assert.Len(t, conversation.Messages, 2)
+	assert.Equal(t, "Hi\n\nthere", conversation.Messages[0].Content)
+	assert.True(t, conversation.Messages[1].IsIncomplete)
+
+	// The transcript document is replaced by the conversation's windows
+	_, err = storage.Conversations.GetByID(context.Background(), "thread_legacy")
 	assert.Error(t, err)
-	assert.Empty(t, deletedContent)
+	assert.Equal(t, 1, storage.Conversations.Count())
+
+	// Once migrated, the index is not searched for transcripts again
+	err = storage.Conversations.AddDocument(context.Background(), chromem.Document{ID: "thread_late", Content: "You: Hi\n\n"})
+	assert.NoError(t, err)
+
+	err = storage.InitializeConversationsCollection(cfg)
+	assert.NoError(t, err)
+
+	_, err = storage.LoadConversation("thread_late")
+	assert.Error(t, err)
+
+	err = storage.DeleteConversation("thread_legacy")
+	assert.NoError(t, err)
+}
+
+func TestListConversations(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	err := storage.Init(cfg)
+	assert.NoError(t, err)
+
+	err = storage.InitializeConversationsCollection(cfg)
+	assert.NoError(t, err)
+
+	for _, id := range []string{"thread_a", "thread_b", "thread_c"} {
+		conversation := &storage.Conversation{ID: id, Title: "Conversation " + id}
+		err = storage.SaveConversation(conversation)
+		assert.NoError(t, err)
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Most recently updated first
+	conversations, err := storage.ListConversations()
+	assert.NoError(t, err)
+	if assert.Len(t, conversations, 3) {
+		assert.Equal(t, "thread_c", conversations[0].ID)
+		assert.Equal(t, "thread_a", conversations[2].ID)
+	}
+
+	for _, conversation := range conversations {
+		assert.NoError(t, storage.DeleteConversation(conversation.ID))
+	}
+}
+
+func TestSaveConversationKeepsItsBox(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	err := storage.Init(cfg)
+	assert.NoError(t, err)
+
+	err = storage.InitializeConversationsCollection(cfg)
+	assert.NoError(t, err)
+
+	conversation := &storage.Conversation{ID: "thread_kept"}
+	assert.NoError(t, storage.SaveConversation(conversation))
+	assert.Equal(t, cfg.Box, conversation.Box)
+
+	// Another box is selected before the conversation is saved again
+	other := *cfg
+	other.Box = "other_box"
+
+	err = storage.InitializeConversationsCollection(&other)
+	assert.NoError(t, err)
+
+	conversation.Title = "A better title"
+	assert.NoError(t, storage.SaveConversation(conversation))
+
+	_, err = storage.LoadConversation("thread_kept")
+	assert.Error(t, err)
+
+	err = storage.InitializeConversationsCollection(cfg)
+	assert.NoError(t, err)
+
+	saved, err := storage.LoadConversation("thread_kept")
+	assert.NoError(t, err)
+	assert.Equal(t, "A better title", saved.Title)
+
+	assert.NoError(t, storage.DeleteConversation("thread_kept"))
 }
@@ -1,7 +1,15 @@
 package ui
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
+
+	"github.com/sysread/fnord/pkg/gpt"
 )
 
 func (ui *UI) alert(message string, callback func()) tview.Primitive {
@@ -19,3 +27,108 @@ func (ui *UI) alert(message string, callback func()) tview.Primitive {
 
 	return modal
 }
+
+// confirm asks the user a yes or no question.
+func (ui *UI) confirm(message string, callback func(bool)) tview.Primitive {
+	modal := tview.NewModal()
+
+	modal.SetText(message)
+
+	modal.AddButtons([]string{"Yes", "No"})
+
+	modal.SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+		callback(buttonLabel == "Yes")
+	})
+
+	return modal
+}
+
+// prompt asks the user for a single line of text. The callback receives the
+// text and whether the user accepted it or cancelled.
+func (ui *UI) prompt(title string, label string, callback func(string, bool)) tview.Primitive {
+	form := tview.NewForm()
+
+	input := tview.NewInputField().
+		SetLabel(label).
+		SetFieldWidth(0)
+
+	form.AddFormItem(input)
+
+	form.AddButton("OK", func() {
+		callback(strings.TrimSpace(input.GetText()), true)
+	})
+
+	form.AddButton("Cancel", func() {
+		callback("", false)
+	})
+
+	form.SetCancelFunc(func() {
+		callback("", false)
+	})
+
+	form.SetBorder(true)
+	form.SetTitle(" " + title + " ")
+	form.SetButtonsAlign(tview.AlignCenter)
+
+	// Center the form on the screen
+	return tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(form, 7, 0, true).
+			AddItem(nil, 0, 1, false), 80, 0, true).
+		AddItem(nil, 0, 1, false)
+}
+
+// toolApproval asks the user whether the assistant may call a tool, allowing
+// them to edit the tool's arguments first.
+func (ui *UI) toolApproval(toolName string, argsJSON string, callback func(gpt.ToolApproval)) tview.Primitive {
+	// Pretty-print the arguments for editing
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, []byte(argsJSON), "", "    "); err != nil {
+		pretty.Reset()
+		pretty.WriteString(argsJSON)
+	}
+
+	form := tview.NewForm()
+
+	args := tview.NewTextArea().
+		SetLabel("Arguments").
+		SetText(pretty.String(), false).
+		SetSize(15, 0)
+
+	form.AddTextView("Tool", toolName, 0, 1, false, false)
+	form.AddFormItem(args)
+
+	deny := func() {
+		callback(gpt.ToolApproval{Approved: false, Arguments: argsJSON})
+	}
+
+	form.AddButton("Approve", func() {
+		// Make sure any edits left the arguments valid
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(args.GetText())); err != nil {
+			form.SetTitle(fmt.Sprintf(" Invalid arguments: %s ", err))
+			form.SetTitleColor(tcell.ColorRed)
+			return
+		}
+
+		callback(gpt.ToolApproval{Approved: true, Arguments: compact.String()})
+	})
+
+	form.AddButton("Deny", deny)
+	form.SetCancelFunc(deny)
+
+	form.SetBorder(true)
+	form.SetTitle(" The assistant wants to use a tool ")
+	form.SetButtonsAlign(tview.AlignCenter)
+
+	// Center the form on the screen
+	return tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(form, 23, 0, true).
+			AddItem(nil, 0, 1, false), 100, 0, true).
+		AddItem(nil, 0, 1, false)
+}
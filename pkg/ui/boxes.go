@@ -0,0 +1,183 @@
+package ui
+
+import (
+	"fmt"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+// boxesView lists the boxes, and lets the user switch to, create, and delete
+// them.
+type boxesView struct {
+	*tview.Frame
+
+	ui *UI
+
+	list *tview.List
+
+	// The boxes currently listed, in the order they are listed
+	listed []string
+}
+
+func (ui *UI) newBoxesView() *boxesView {
+	bv := &boxesView{
+		ui: ui,
+	}
+
+	bv.list = tview.NewList().
+		ShowSecondaryText(true).
+		SetHighlightFullLine(true)
+
+	bv.list.SetBorder(true)
+
+	bv.list.SetSelectedFunc(func(index int, _ string, _ string, _ rune) {
+		bv.open(index)
+	})
+
+	bv.list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Rune() {
+		case 'n':
+			bv.create()
+			return nil
+
+		case 'd':
+			bv.delete(bv.list.GetCurrentItem())
+			return nil
+		}
+
+		return event
+	})
+
+	bv.Frame = ui.newScreen(bv.list, screenArgs{
+		title: "Boxes",
+		keys: []keyBinding{
+			{"enter", "switch to box"},
+			{"n", "new box"},
+			{"d", "delete"},
+			{"esc", "home"},
+			{"F10", "logs"},
+		},
+	})
+
+	bv.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyEscape:
+			ui.OpenHome()
+			return nil
+
+		case tcell.KeyF10:
+			ui.OpenLogs()
+			return nil
+		}
+
+		return event
+	})
+
+	return bv
+}
+
+func (bv *boxesView) GetInitialFocus() tview.Primitive {
+	return bv.list
+}
+
+// Refresh lists the boxes, along with what each of them holds. The selected
+// box is listed first.
+func (bv *boxesView) Refresh() {
+	boxes, err := storage.GetBoxes()
+	if err != nil {
+		bv.ui.OpenAlert(fmt.Sprintf("Error: %s", err), nil)
+		return
+	}
+
+	current := bv.ui.Fnord.Config.Box
+
+	bv.listed = []string{current}
+	for _, box := range boxes {
+		if box != current {
+			bv.listed = append(bv.listed, box)
+		}
+	}
+
+	bv.list.Clear()
+
+	for _, box := range bv.listed {
+		name := tview.Escape(box)
+		if box == current {
+			name += " (current)"
+		}
+
+		details := "(empty)"
+
+		stats, err := storage.GetBoxStats(box)
+		if err == nil && !stats.LastActivity.IsZero() {
+			details = fmt.Sprintf("%d facts | %d conversations | Last active %s",
+				stats.Facts,
+				stats.Conversations,
+				stats.LastActivity.Local().Format("2006-01-02 15:04"),
+			)
+		}
+
+		bv.list.AddItem(name, details, 0, nil)
+	}
+
+	bv.list.SetTitle(fmt.Sprintf(" %d boxes ", len(bv.listed)))
+}
+
+// open switches to the box at index.
+func (bv *boxesView) open(index int) {
+	if index < 0 || index >= len(bv.listed) {
+		return
+	}
+
+	box := bv.listed[index]
+	if box == bv.ui.Fnord.Config.Box {
+		bv.ui.OpenChat()
+		return
+	}
+
+	bv.ui.SwitchBox(box)
+}
+
+// create prompts for the name of a new box, creates it, and switches to it.
+func (bv *boxesView) create() {
+	bv.ui.OpenPrompt("New box", "Name", func(box string) {
+		if err := storage.CreateBox(box); err != nil {
+			bv.ui.OpenAlert(fmt.Sprintf("Error: %s", err), nil)
+			return
+		}
+
+		bv.ui.SwitchBox(box)
+	})
+}
+
+// delete removes the box at index, once the user confirms it. The selected
+// box cannot be deleted.
+func (bv *boxesView) delete(index int) {
+	if index < 0 || index >= len(bv.listed) {
+		return
+	}
+
+	box := bv.listed[index]
+	if box == bv.ui.Fnord.Config.Box {
+		bv.ui.OpenAlert("The current box cannot be deleted. Switch to another box first.", nil)
+		return
+	}
+
+	prompt := fmt.Sprintf("Delete the box %q, along with all of its facts and conversations? This cannot be undone.", box)
+
+	bv.ui.OpenConfirm(prompt, func(yes bool) {
+		if !yes {
+			return
+		}
+
+		if err := storage.DeleteBox(box); err != nil {
+			bv.ui.OpenAlert(fmt.Sprintf("Error: %s", err), nil)
+			return
+		}
+
+		bv.Refresh()
+	})
+}
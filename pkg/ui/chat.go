@@ -1,9 +1,11 @@
 package ui
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 	"unicode/utf8"
 
 	"github.com/atotto/clipboard"
@@ -12,6 +14,7 @@ import (
 	"github.com/sysread/textsel"
 
 	"github.com/sysread/fnord/pkg/chat_manager"
+	"github.com/sysread/fnord/pkg/gpt"
 	"github.com/sysread/fnord/pkg/markdown"
 	"github.com/sysread/fnord/pkg/messages"
 )
@@ -41,7 +44,11 @@ type chatView struct {
 	userInput   *tview.TextArea
 
 	receivingBuffer *tview.TextView
-	isReceiving     bool
+
+	// Set while the assistant is responding. It is changed by the goroutine
+	// waiting for the response and read from the UI goroutine.
+	receivingMutex sync.Mutex
+	isReceiving    bool
 
 	helpModal       *tview.Modal
 	helpModalIsOpen bool
@@ -49,8 +56,14 @@ type chatView struct {
 
 func (ui *UI) newChatView() *chatView {
 	cv := &chatView{
-		ui:      ui,
-		chatMgr: chat_manager.NewChatManager(ui.Fnord),
+		ui: ui,
+	}
+
+	// When resuming a conversation, don't start a new thread that would just
+	// be thrown away. One is started by Resume if the conversation cannot be
+	// resumed.
+	if ui.Fnord.Config.Resume == "" {
+		cv.chatMgr = chat_manager.NewChatManager(ui.Fnord)
 	}
 
 	cv.container = tview.NewFlex().
@@ -69,6 +82,11 @@ func (ui *UI) newChatView() *chatView {
 
 	cv.userInput = cv.newChatInput()
 
+	// Disabled until the conversation has been resumed
+	if cv.chatMgr == nil {
+		cv.userInput.SetDisabled(true)
+	}
+
 	cv.messageList = textsel.NewTextSel()
 	cv.messageList.
 		SetScrollable(true).
@@ -94,6 +112,7 @@ func (ui *UI) newChatView() *chatView {
 		title: cv.getTitle(),
 		keys: []keyBinding{
 			{"ctrl-space", "sends"},
+			{"ctrl-x", "cancels response"},
 			{"shift-tab", "switches focus"},
 			{"space, enter", "select, copy (in msgs)"},
 			{"ctrl-/", "help"},
@@ -121,6 +140,12 @@ func (ui *UI) newChatView() *chatView {
 			}
 			return nil
 
+		case tcell.KeyCtrlX:
+			if cv.IsReceiving() {
+				cv.cancelResponse()
+				return nil
+			}
+
 		// This is actually Ctrl-/
 		case tcell.KeyCtrlUnderscore:
 			cv.toggleHelp()
@@ -158,6 +183,11 @@ func (cv *chatView) assistantIsTyping() {
 	cv.ui.SetStatus("[#000000:green:b]Assistant is typing...[-:-:-]")
 }
 
+func (cv *chatView) cancelResponse() {
+	cv.ui.SetStatus("[#000000:yellow:b]Cancelling response...[-:-:-]")
+	go cv.chatMgr.CancelResponse()
+}
+
 func (cv *chatView) setStatusFromAssistant(status string) {
 	cv.ui.SetStatus("[#000000:green:b]" + status + "[-:-:-]")
 }
@@ -216,26 +246,52 @@ func (cv *chatView) FocusMessageList() {
 	cv.messageList.MoveToLastLine()
 }
 
+// IsReceiving returns true while the assistant is responding.
+func (cv *chatView) IsReceiving() bool {
+	cv.receivingMutex.Lock()
+	defer cv.receivingMutex.Unlock()
+
+	return cv.isReceiving
+}
+
+func (cv *chatView) setReceiving(receiving bool) {
+	cv.receivingMutex.Lock()
+	defer cv.receivingMutex.Unlock()
+
+	cv.isReceiving = receiving
+}
+
 func (cv *chatView) ToggleReceiving() {
-	if cv.isReceiving {
+	if cv.IsReceiving() {
 		cv.readyToSend()
-		lastMessage := cv.chatMgr.LastMessage()
-		if lastMessage != nil {
-			cv.container.RemoveItem(cv.receivingBuffer)
-			cv.container.AddItem(cv.chatFlex, 0, 1, false)
-			cv.isReceiving = false
+		cv.container.RemoveItem(cv.receivingBuffer)
+		cv.container.AddItem(cv.chatFlex, 0, 1, false)
+		cv.setReceiving(false)
 
-			cv.queueAppendText(AssistantMsgHeader)
-			cv.queueAppendText(cv.renderMarkdown(lastMessage.Content) + "\n")
+		// The user's own message is already displayed, so only the
+		// assistant's response is rendered.
+		lastMessage := cv.chatMgr.LastMessage()
+		if lastMessage != nil && lastMessage.From == messages.Assistant {
+			cv.queueAppendText(cv.renderMessage(*lastMessage))
 			cv.messageList.ScrollToEnd()
 		}
+
+		cv.ui.app.QueueUpdateDraw(func() {
+			cv.ui.app.SetFocus(cv.userInput)
+		})
 	} else {
 		cv.assistantIsTyping()
 		cv.receivingBuffer.SetText(cv.messageList.GetText(false))
 		cv.container.RemoveItem(cv.chatFlex)
 		cv.container.AddItem(cv.receivingBuffer, 0, 1, false)
-		cv.isReceiving = true
+		cv.setReceiving(true)
 		cv.receivingBuffer.ScrollToEnd()
+
+		// The chat input is hidden while receiving. Focus the receiving
+		// buffer so that key bindings (e.g. cancel) still reach this view.
+		cv.ui.app.QueueUpdateDraw(func() {
+			cv.ui.app.SetFocus(cv.receivingBuffer)
+		})
 	}
 }
 
@@ -284,12 +340,19 @@ func (cv *chatView) onSubmit() {
 
 	// Add the parsed user messages to the chat view and conversation.
 	for _, msg := range msgs {
-		if !msg.IsHidden {
-			content := cv.renderMarkdown(msg.Content)
-			cv.queueAppendText(UserMsgHeader + content + "\n")
+		if err := cv.chatMgr.AddMessage(msg); err != nil {
+			// Give the user their message back so they can try again
+			cv.ui.app.QueueUpdateDraw(func() {
+				cv.userInput.SetText(messageText, true)
+				cv.userInput.SetDisabled(false)
+			})
+
+			cv.showError(err)
+			return
 		}
 
-		cv.chatMgr.AddMessage(msg)
+		cv.queueAppendText(cv.renderMessage(msg))
+
 		cv.messageList.ScrollToEnd()
 		cv.messageList.MoveToLastLine()
 	}
@@ -297,22 +360,39 @@ func (cv *chatView) onSubmit() {
 	// Get the assistant's response
 	cv.ToggleReceiving()
 	cv.queueAppendText(AssistantMsgHeader)
-	cv.chatMgr.RequestResponse(
+	err := cv.chatMgr.RequestResponse(func(event gpt.Event) {
+		switch event.Type {
 		// Append the assistant's response to the chat view
-		func(chunk string) {
+		case gpt.EventTextDelta:
 			cv.ui.app.QueueUpdateDraw(func() {
 				cv.assistantIsTyping()
 			})
 
-			cv.queueAppendText(chunk)
-		},
-		// Update the status message
-		func(status string) {
+			cv.queueAppendText(event.Text)
+
+		// Update the status message. When the assistant requests several
+		// tools at once, they run concurrently, so show the progress of the
+		// batch rather than each tool's status line.
+		case gpt.EventToolStarted:
+			status := event.Tool.Status
+			if event.Tool.Total > 1 {
+				status = fmt.Sprintf("Running %d tools... (%s)", event.Tool.Total, event.Tool.Progress())
+			}
+
 			cv.ui.app.QueueUpdateDraw(func() {
 				cv.setStatusFromAssistant(status)
 			})
-		},
-	)
+
+		case gpt.EventToolFinished:
+			if event.Tool.Total > 1 {
+				status := fmt.Sprintf("Running %d tools... (%s)", event.Tool.Total, event.Tool.Progress())
+
+				cv.ui.app.QueueUpdateDraw(func() {
+					cv.setStatusFromAssistant(status)
+				})
+			}
+		}
+	})
 
 	// Now that the response is complete, append a few newlines to separate it
 	// from the next user message and scroll to the end of the chat view.
@@ -320,11 +400,123 @@ func (cv *chatView) onSubmit() {
 
 	// Re-enable the chat input
 	cv.userInput.SetDisabled(false)
+
+	if err != nil {
+		cv.showError(err)
+	}
+}
+
+// Resume replaces the displayed conversation with the one stored under
+// threadID and continues its thread. If the thread has expired on the server,
+// the user is asked whether to continue the conversation locally instead.
+func (cv *chatView) Resume(threadID string) {
+	if cv.IsReceiving() {
+		cv.showError(errors.New("cannot resume a conversation while the assistant is responding"))
+		return
+	}
+
+	defer cv.ui.app.QueueUpdateDraw(func() {
+		cv.userInput.SetDisabled(false)
+	})
+
+	cm, err := cv.resumeChatManager(threadID)
+	if err != nil {
+		// If resuming at startup failed, there is no conversation to return
+		// to, so start a new one.
+		cv.ui.app.QueueUpdateDraw(func() {
+			if cv.chatMgr == nil {
+				cv.chatMgr = chat_manager.NewChatManager(cv.ui.Fnord)
+			}
+		})
+
+		if err != errResumeDeclined {
+			cv.showError(err)
+		}
+
+		return
+	}
+
+	var transcript strings.Builder
+	for _, msg := range cm.Messages {
+		transcript.WriteString(cv.renderMessage(msg))
+	}
+
+	cv.ui.app.QueueUpdateDraw(func() {
+		cv.chatMgr = cm
+		cv.messageList.SetText(asciiDamnit(transcript.String()))
+		cv.ui.OpenChat()
+	})
+}
+
+var errResumeDeclined = errors.New("the user declined to continue the conversation locally")
+
+func (cv *chatView) resumeChatManager(threadID string) (*chat_manager.ChatManager, error) {
+	cm, err := chat_manager.LoadChatManager(cv.ui.Fnord, threadID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cm.ResumeThread()
+	if err == nil {
+		return cm, nil
+	}
+
+	if !errors.Is(err, gpt.ErrThreadNotFound) {
+		return nil, err
+	}
+
+	// The thread has expired on the server, but the conversation is still
+	// stored locally.
+	done := make(chan bool)
+
+	cv.ui.app.QueueUpdateDraw(func() {
+		cv.ui.OpenConfirm("This conversation's thread has expired on the server. Continue the conversation locally?", func(yes bool) {
+			done <- yes
+		})
+	})
+
+	if !<-done {
+		return nil, errResumeDeclined
+	}
+
+	if err := cm.ContinueLocally(); err != nil {
+		return nil, err
+	}
+
+	return cm, nil
+}
+
+// renderMessage formats a message for display in the chat view. Messages
+// that are not displayed are rendered as an empty string.
+func (cv *chatView) renderMessage(msg messages.Message) string {
+	if msg.From == messages.System || msg.IsHidden {
+		return ""
+	}
+
+	if msg.IsUserMessage() {
+		return UserMsgHeader + cv.renderMarkdown(msg.Content) + "\n"
+	}
+
+	content := msg.Content
+	if msg.IsIncomplete {
+		content += "\n\n_(response cancelled)_"
+	} else if msg.IsFailed() {
+		content += fmt.Sprintf("\n\n_(response failed: %s)_", msg.Error)
+	}
+
+	return AssistantMsgHeader + cv.renderMarkdown(content) + "\n"
+}
+
+// showError displays an error in a modal dialog.
+func (cv *chatView) showError(err error) {
+	cv.ui.app.QueueUpdateDraw(func() {
+		cv.ui.OpenAlert(fmt.Sprintf("Error: %s", err), nil)
+	})
 }
 
 // Appends text to the chat view.
 func (cv *chatView) queueAppendText(text string) {
-	if cv.isReceiving {
+	if cv.IsReceiving() {
 		cv.ui.app.QueueUpdateDraw(func() {
 			cv.receivingBuffer.SetText(cv.receivingBuffer.GetText(false) + asciiDamnit(text))
 			cv.receivingBuffer.ScrollToEnd()
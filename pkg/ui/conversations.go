@@ -0,0 +1,338 @@
+package ui
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+
+	"github.com/sysread/fnord/pkg/storage"
+	"github.com/sysread/fnord/pkg/util"
+)
+
+// How many conversations a semantic search returns
+const conversationSearchResults = 20
+
+// conversationsView lists the conversations stored in the current box. Typing
+// in the filter narrows the list by fuzzy matching conversations' titles.
+// Pressing enter in the filter instead searches the conversations' content
+// semantically.
+type conversationsView struct {
+	*tview.Frame
+
+	ui *UI
+
+	filter  *tview.InputField
+	list    *tview.List
+	preview *tview.TextView
+
+	// All of the box's conversations, most recently updated first
+	conversations []*storage.Conversation
+
+	// The conversations currently listed, in the order they are listed
+	listed []*storage.Conversation
+
+	// Set while the list holds the results of a semantic search
+	searchResults bool
+}
+
+func (ui *UI) newConversationsView() *conversationsView {
+	cv := &conversationsView{
+		ui: ui,
+	}
+
+	cv.filter = tview.NewInputField().
+		SetLabel("Filter: ").
+		SetPlaceholder("type to filter titles, enter to search contents")
+
+	cv.filter.SetChangedFunc(func(text string) {
+		cv.searchResults = false
+		cv.applyFilter(text)
+	})
+
+	cv.filter.SetDoneFunc(func(key tcell.Key) {
+		switch key {
+		case tcell.KeyEnter:
+			if query := strings.TrimSpace(cv.filter.GetText()); query != "" {
+				go cv.search(query)
+			}
+
+		case tcell.KeyDown, tcell.KeyTab:
+			cv.ui.app.SetFocus(cv.list)
+		}
+	})
+
+	cv.list = tview.NewList().
+		ShowSecondaryText(true).
+		SetHighlightFullLine(true)
+
+	cv.list.SetBorder(true)
+
+	cv.list.SetChangedFunc(func(index int, _ string, _ string, _ rune) {
+		cv.showPreview(index)
+	})
+
+	cv.list.SetSelectedFunc(func(index int, _ string, _ string, _ rune) {
+		cv.open(index)
+	})
+
+	cv.list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyTab:
+			cv.ui.app.SetFocus(cv.preview)
+			return nil
+
+		case tcell.KeyBacktab:
+			cv.ui.app.SetFocus(cv.filter)
+			return nil
+		}
+
+		switch event.Rune() {
+		case 'd':
+			cv.delete(cv.list.GetCurrentItem())
+			return nil
+
+		case '/':
+			cv.ui.app.SetFocus(cv.filter)
+			return nil
+		}
+
+		return event
+	})
+
+	cv.preview = tview.NewTextView().
+		SetDynamicColors(true).
+		SetScrollable(true).
+		SetWordWrap(true)
+
+	cv.preview.SetBorder(true)
+
+	cv.preview.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyTab:
+			cv.ui.app.SetFocus(cv.filter)
+			return nil
+
+		case tcell.KeyBacktab:
+			cv.ui.app.SetFocus(cv.list)
+			return nil
+		}
+
+		return event
+	})
+
+	listFlex := tview.NewFlex().
+		SetDirection(tview.FlexRow).
+		AddItem(cv.filter, 1, 0, true).
+		AddItem(nil, 1, 0, false).
+		AddItem(cv.list, 0, 1, false)
+
+	flex := tview.NewFlex().
+		AddItem(listFlex, 0, 1, true).
+		AddItem(cv.preview, 0, 2, false)
+
+	cv.Frame = ui.newScreen(flex, screenArgs{
+		title: fmt.Sprintf("Conversations | Box: %s", ui.Fnord.Config.Box),
+		keys: []keyBinding{
+			{"enter", "search (in filter), resume (in list)"},
+			{"d", "delete"},
+			{"tab", "switches focus"},
+			{"esc", "home"},
+			{"F10", "logs"},
+		},
+	})
+
+	cv.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyEscape:
+			// The first escape clears the search
+			if cv.ui.app.GetFocus() == cv.filter && cv.filter.GetText() != "" {
+				cv.filter.SetText("")
+				return nil
+			}
+
+			ui.OpenHome()
+			return nil
+
+		case tcell.KeyF10:
+			ui.OpenLogs()
+			return nil
+		}
+
+		return event
+	})
+
+	return cv
+}
+
+func (cv *conversationsView) GetInitialFocus() tview.Primitive {
+	return cv.filter
+}
+
+// Refresh reloads the box's conversations from storage.
+func (cv *conversationsView) Refresh() {
+	conversations, err := storage.ListConversations()
+	if err != nil {
+		cv.ui.OpenAlert(fmt.Sprintf("Error: %s", err), nil)
+		return
+	}
+
+	cv.conversations = conversations
+	cv.searchResults = false
+	cv.filter.SetText("")
+	cv.applyFilter("")
+}
+
+// applyFilter lists the conversations whose titles fuzzy match the filter,
+// best matches first.
+func (cv *conversationsView) applyFilter(filter string) {
+	type match struct {
+		conversation *storage.Conversation
+		score        int
+	}
+
+	var matches []match
+	for _, conversation := range cv.conversations {
+		if ok, score := util.FuzzyMatch(filter, conversation.Title); ok {
+			matches = append(matches, match{conversation, score})
+		}
+	}
+
+	// Equally good matches stay in order of when they were updated
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	listed := make([]*storage.Conversation, len(matches))
+	for i, m := range matches {
+		listed[i] = m.conversation
+	}
+
+	cv.setListed(listed)
+}
+
+// search lists the conversations whose content best matches the query. It
+// calls the embeddings API, so it runs outside of the UI goroutine.
+func (cv *conversationsView) search(query string) {
+	var status string
+
+	cv.ui.app.QueueUpdateDraw(func() {
+		status = cv.ui.status.GetText(false)
+		cv.ui.SetStatus("[#000000:green:b]Searching conversations...[-:-:-]")
+	})
+
+	results, err := storage.SearchConversations(query, conversationSearchResults)
+
+	cv.ui.app.QueueUpdateDraw(func() {
+		cv.ui.SetStatus(status)
+
+		if err != nil {
+			cv.ui.OpenAlert(fmt.Sprintf("Error: %s", err), nil)
+			return
+		}
+
+		byID := map[string]*storage.Conversation{}
+		for _, conversation := range cv.conversations {
+			byID[conversation.ID] = conversation
+		}
+
+		listed := []*storage.Conversation{}
+		for _, result := range results {
+			if conversation, ok := byID[result.ID]; ok {
+				listed = append(listed, conversation)
+			}
+		}
+
+		cv.searchResults = true
+		cv.setListed(listed)
+		cv.ui.app.SetFocus(cv.list)
+	})
+}
+
+func (cv *conversationsView) setListed(listed []*storage.Conversation) {
+	cv.listed = listed
+	cv.list.Clear()
+
+	for _, conversation := range listed {
+		title := conversation.Title
+		if title == "" {
+			title = "(untitled)"
+		}
+
+		details := fmt.Sprintf("Updated %s | Created %s | %d messages",
+			formatConversationTime(conversation.Updated),
+			formatConversationTime(conversation.Created),
+			len(conversation.Messages),
+		)
+
+		cv.list.AddItem(tview.Escape(title), details, 0, nil)
+	}
+
+	title := fmt.Sprintf(" %d conversations ", len(listed))
+	if cv.searchResults {
+		title = fmt.Sprintf(" %d matching conversations ", len(listed))
+	}
+
+	cv.list.SetTitle(title)
+	cv.showPreview(0)
+}
+
+// showPreview renders the conversation at index in the preview pane.
+func (cv *conversationsView) showPreview(index int) {
+	cv.preview.Clear()
+	cv.preview.SetTitle("")
+
+	if index < 0 || index >= len(cv.listed) {
+		return
+	}
+
+	cv.preview.SetTitle(" " + tview.Escape(cv.listed[index].Title) + " ")
+
+	var preview strings.Builder
+	for _, msg := range cv.listed[index].Messages {
+		preview.WriteString(cv.ui.chat.renderMessage(msg))
+	}
+
+	cv.preview.SetText(asciiDamnit(preview.String()))
+	cv.preview.ScrollToBeginning()
+}
+
+// open resumes the conversation at index in the chat view.
+func (cv *conversationsView) open(index int) {
+	if index < 0 || index >= len(cv.listed) {
+		return
+	}
+
+	go cv.ui.chat.Resume(cv.listed[index].ID)
+}
+
+// delete removes the conversation at index, once the user confirms it.
+func (cv *conversationsView) delete(index int) {
+	if index < 0 || index >= len(cv.listed) {
+		return
+	}
+
+	conversation := cv.listed[index]
+
+	prompt := fmt.Sprintf("Delete the conversation %q? This cannot be undone.", conversation.Title)
+
+	cv.ui.OpenConfirm(prompt, func(yes bool) {
+		if !yes {
+			return
+		}
+
+		if err := storage.DeleteConversation(conversation.ID); err != nil {
+			cv.ui.OpenAlert(fmt.Sprintf("Error: %s", err), nil)
+			return
+		}
+
+		cv.Refresh()
+	})
+}
+
+func formatConversationTime(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04")
+}
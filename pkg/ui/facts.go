@@ -0,0 +1,308 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+
+	"github.com/sysread/fnord/pkg/storage"
+)
+
+// How many facts a semantic search returns
+const factSearchResults = 20
+
+// factsView lists the facts saved in the current box, and lets the user
+// search, edit, add, and delete them. The selected fact is shown in an
+// editor; saving it updates (and re-embeds) the fact.
+type factsView struct {
+	*tview.Frame
+
+	ui *UI
+
+	search *tview.InputField
+	list   *tview.List
+	editor *tview.TextArea
+
+	// The facts currently listed, in the order they are listed
+	listed []storage.Result
+
+	// The ID of the fact in the editor, or empty for a new fact
+	editing string
+}
+
+func (ui *UI) newFactsView() *factsView {
+	fv := &factsView{
+		ui: ui,
+	}
+
+	fv.search = tview.NewInputField().
+		SetLabel("Search: ").
+		SetPlaceholder("enter to search, empty to list all")
+
+	fv.search.SetDoneFunc(func(key tcell.Key) {
+		switch key {
+		case tcell.KeyEnter:
+			go fv.Refresh()
+
+		case tcell.KeyDown, tcell.KeyTab:
+			fv.ui.app.SetFocus(fv.list)
+		}
+	})
+
+	fv.list = tview.NewList().
+		ShowSecondaryText(true).
+		SetHighlightFullLine(true)
+
+	fv.list.SetBorder(true)
+
+	fv.list.SetChangedFunc(func(index int, _ string, _ string, _ rune) {
+		fv.edit(index)
+	})
+
+	fv.list.SetSelectedFunc(func(index int, _ string, _ string, _ rune) {
+		fv.edit(index)
+		fv.ui.app.SetFocus(fv.editor)
+	})
+
+	fv.list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyTab:
+			fv.ui.app.SetFocus(fv.editor)
+			return nil
+
+		case tcell.KeyBacktab:
+			fv.ui.app.SetFocus(fv.search)
+			return nil
+		}
+
+		switch event.Rune() {
+		case 'a':
+			fv.add()
+			return nil
+
+		case 'd':
+			fv.delete(fv.list.GetCurrentItem())
+			return nil
+
+		case '/':
+			fv.ui.app.SetFocus(fv.search)
+			return nil
+		}
+
+		return event
+	})
+
+	fv.editor = tview.NewTextArea()
+	fv.editor.SetBorder(true)
+
+	fv.editor.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyCtrlS:
+			go fv.save()
+			return nil
+
+		case tcell.KeyTab:
+			fv.ui.app.SetFocus(fv.search)
+			return nil
+
+		case tcell.KeyBacktab:
+			fv.ui.app.SetFocus(fv.list)
+			return nil
+		}
+
+		return event
+	})
+
+	listFlex := tview.NewFlex().
+		SetDirection(tview.FlexRow).
+		AddItem(fv.search, 1, 0, true).
+		AddItem(nil, 1, 0, false).
+		AddItem(fv.list, 0, 1, false)
+
+	flex := tview.NewFlex().
+		AddItem(listFlex, 0, 1, true).
+		AddItem(fv.editor, 0, 1, false)
+
+	fv.Frame = ui.newScreen(flex, screenArgs{
+		title: fmt.Sprintf("Facts | Box: %s", ui.Fnord.Config.Box),
+		keys: []keyBinding{
+			{"enter", "search (in search), edit (in list)"},
+			{"a", "add"},
+			{"d", "delete"},
+			{"ctrl-s", "save"},
+			{"tab", "switches focus"},
+			{"esc", "home"},
+			{"F10", "logs"},
+		},
+	})
+
+	fv.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyEscape:
+			ui.OpenHome()
+			return nil
+
+		case tcell.KeyF10:
+			ui.OpenLogs()
+			return nil
+		}
+
+		return event
+	})
+
+	return fv
+}
+
+func (fv *factsView) GetInitialFocus() tview.Primitive {
+	return fv.list
+}
+
+// Refresh lists the facts matching the search, or every fact if the search
+// is empty. Searching calls the embeddings API, so Refresh runs outside of
+// the UI goroutine.
+func (fv *factsView) Refresh() {
+	var query string
+	fv.ui.app.QueueUpdate(func() {
+		query = strings.TrimSpace(fv.search.GetText())
+	})
+
+	var facts []storage.Result
+	var err error
+
+	if query == "" {
+		facts, err = storage.ListFacts()
+	} else {
+		facts, err = storage.SearchFacts(query, factSearchResults)
+	}
+
+	fv.ui.app.QueueUpdateDraw(func() {
+		if err != nil {
+			fv.ui.OpenAlert(fmt.Sprintf("Error: %s", err), nil)
+			return
+		}
+
+		fv.setListed(facts, query != "")
+	})
+}
+
+func (fv *factsView) setListed(facts []storage.Result, isSearch bool) {
+	fv.listed = facts
+	fv.list.Clear()
+
+	for _, fact := range facts {
+		summary, _, _ := strings.Cut(strings.TrimSpace(fact.Content), "\n")
+
+		details := fmt.Sprintf("Updated %s | Created %s", formatFactTime(fact.Updated), formatFactTime(fact.Created))
+
+		fv.list.AddItem(tview.Escape(summary), details, 0, nil)
+	}
+
+	title := fmt.Sprintf(" %d facts ", len(facts))
+	if isSearch {
+		title = fmt.Sprintf(" %d matching facts ", len(facts))
+	}
+
+	fv.list.SetTitle(title)
+
+	if len(facts) == 0 {
+		fv.add()
+	} else {
+		fv.edit(fv.list.GetCurrentItem())
+	}
+}
+
+// edit loads the fact at index into the editor.
+func (fv *factsView) edit(index int) {
+	if index < 0 || index >= len(fv.listed) {
+		return
+	}
+
+	fv.editing = fv.listed[index].ID
+	fv.editor.SetTitle(" Fact " + fv.editing + " ")
+	fv.editor.SetText(fv.listed[index].Content, false)
+}
+
+// add clears the editor for a new fact.
+func (fv *factsView) add() {
+	fv.editing = ""
+	fv.editor.SetTitle(" New fact ")
+	fv.editor.SetText("", false)
+	fv.ui.app.SetFocus(fv.editor)
+}
+
+// save stores the fact in the editor, creating it if it is new. Saving calls
+// the embeddings API, so it runs outside of the UI goroutine.
+func (fv *factsView) save() {
+	var id, content string
+	fv.ui.app.QueueUpdate(func() {
+		id = fv.editing
+		content = strings.TrimSpace(fv.editor.GetText())
+	})
+
+	if content == "" {
+		fv.ui.app.QueueUpdateDraw(func() {
+			fv.ui.OpenAlert("A fact cannot be empty. Use 'd' to delete it instead.", nil)
+		})
+
+		return
+	}
+
+	var err error
+	if id == "" {
+		_, err = storage.CreateFact(content)
+	} else {
+		_, err = storage.UpdateFact(id, content)
+	}
+
+	if err != nil {
+		fv.ui.app.QueueUpdateDraw(func() {
+			fv.ui.OpenAlert(fmt.Sprintf("Error: %s", err), nil)
+		})
+
+		return
+	}
+
+	fv.Refresh()
+
+	fv.ui.app.QueueUpdateDraw(func() {
+		fv.ui.app.SetFocus(fv.list)
+	})
+}
+
+// delete removes the fact at index, once the user confirms it.
+func (fv *factsView) delete(index int) {
+	if index < 0 || index >= len(fv.listed) {
+		return
+	}
+
+	fact := fv.listed[index]
+
+	summary, _, _ := strings.Cut(strings.TrimSpace(fact.Content), "\n")
+	prompt := fmt.Sprintf("Delete the fact %q? This cannot be undone.", summary)
+
+	fv.ui.OpenConfirm(prompt, func(yes bool) {
+		if !yes {
+			return
+		}
+
+		if err := storage.DeleteFact(fact.ID); err != nil {
+			fv.ui.OpenAlert(fmt.Sprintf("Error: %s", err), nil)
+			return
+		}
+
+		go fv.Refresh()
+	})
+}
+
+// formatFactTime formats a fact's RFC3339 timestamp for display.
+func formatFactTime(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+
+	return t.Local().Format("2006-01-02 15:04")
+}
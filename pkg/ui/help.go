@@ -10,6 +10,10 @@ func (ui *UI) newHelpView() tview.Primitive {
 Key bindings:
 
 	[blue]     c[-] - Start a new chat
+	[blue]     v[-] - Browse, search, and resume past conversations
+	[blue]     r[-] - Resume a conversation by its thread ID
+	[blue]     f[-] - Browse, search, and edit the facts saved in the box
+	[blue]     b[-] - Switch to, create, or delete boxes
 
 	[blue]     ?[-] - Show this help
 	[blue]   F10[-] - Display logs
@@ -23,6 +23,25 @@ func (ui *UI) newHomeView() tview.Primitive {
 
 			case 'c':
 				ui.OpenChat()
+
+			case 'v':
+				ui.OpenConversations()
+				return nil
+
+			case 'f':
+				ui.OpenFacts()
+				return nil
+
+			case 'b':
+				ui.OpenBoxes()
+				return nil
+
+			case 'r':
+				ui.OpenPrompt("Resume a conversation", "Thread ID", func(threadID string) {
+					go ui.chat.Resume(threadID)
+				})
+
+				return nil
 			}
 		}
 
@@ -33,6 +52,10 @@ func (ui *UI) newHomeView() tview.Primitive {
 		title: "Fnord",
 		keys: []keyBinding{
 			{"c", "chat"},
+			{"v", "conversations"},
+			{"f", "facts"},
+			{"b", "boxes"},
+			{"r", "resume conversation"},
 			{"?", "help"},
 			{"F10", "logs"},
 			{"q, esc", "quit"},
@@ -1,11 +1,21 @@
 package ui
 
 import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/rivo/tview"
 
 	"github.com/sysread/fnord/pkg/fnord"
+	"github.com/sysread/fnord/pkg/gpt"
+	"github.com/sysread/fnord/pkg/storage"
 )
 
+// How often the status bar's indexing progress is updated
+const indexProgressInterval = 250 * time.Millisecond
+
 type UI struct {
 	Fnord *fnord.Fnord
 
@@ -14,15 +24,25 @@ type UI struct {
 	status *tview.TextView
 	pages  *tview.Pages
 
+	// The progress of indexing the project, shown beside the status
+	statusBar   *tview.Flex
+	indexStatus *tview.TextView
+
 	// Pages
 	home       tview.Primitive
 	help       tview.Primitive
 	logs	   *logView
 	chat       *chatView
+	convos     *conversationsView
+	facts      *factsView
+	boxes      *boxesView
 	filePicker *filePicker
+
+	// Serializes requests to approve tool calls
+	approvalMutex sync.Mutex
 }
 
-func New() *UI {
+func New(f *fnord.Fnord) *UI {
 	app := tview.NewApplication()
 	app.EnableMouse(true)
 
@@ -34,17 +54,31 @@ func New() *UI {
 		SetTextAlign(tview.AlignCenter)
 	status.SetText("Loading...")
 
+	indexStatus := tview.NewTextView().
+		SetDynamicColors(true).
+		SetTextAlign(tview.AlignRight)
+
+	// The index status takes no space until there is progress to show
+	statusBar := tview.NewFlex().
+		AddItem(status, 0, 1, false).
+		AddItem(indexStatus, 0, 0, false)
+
 	ui := &UI{
-		Fnord:  fnord.NewFnord(),
-		app:    app,
-		frame:  frame,
-		status: status,
-		pages:  tview.NewPages(),
+		Fnord:       f,
+		app:         app,
+		frame:       frame,
+		status:      status,
+		pages:       tview.NewPages(),
+		statusBar:   statusBar,
+		indexStatus: indexStatus,
 	}
 
 	ui.home = ui.newHomeView()
 	ui.help = ui.newHelpView()
 	ui.chat = ui.newChatView()
+	ui.convos = ui.newConversationsView()
+	ui.facts = ui.newFactsView()
+	ui.boxes = ui.newBoxesView()
 	ui.filePicker = ui.newFilePicker()
 	ui.logs = ui.newLogsView()
 
@@ -52,19 +86,35 @@ func New() *UI {
 	ui.pages.AddPage("help", ui.help, true, true)
 	ui.pages.AddPage("logs", ui.logs, true, true)
 	ui.pages.AddPage("chat", ui.chat, true, true)
+	ui.pages.AddPage("conversations", ui.convos, true, true)
+	ui.pages.AddPage("facts", ui.facts, true, true)
+	ui.pages.AddPage("boxes", ui.boxes, true, true)
 	ui.pages.AddPage("filePicker", ui.filePicker, true, true)
 
 	ui.frame.AddItem(ui.pages, 0, 1, true)
-	ui.frame.AddItem(ui.status, 1, 0, false)
+	ui.frame.AddItem(ui.statusBar, 1, 0, false)
 
 	ui.app.SetRoot(ui.frame, true).SetFocus(ui.pages)
 
+	// Tools under the "ask" policy are approved through a modal dialog
+	gpt.Tools.SetApprover(ui.ApproveToolCall)
+
 	return ui
 }
 
 func (ui *UI) Run() {
 	ui.OpenChat()
 
+	if threadID := ui.Fnord.Config.Resume; threadID != "" {
+		go ui.chat.Resume(threadID)
+	}
+
+	if ui.Fnord.Config.ProjectPath != "" {
+		go ui.watchIndexProgress()
+	}
+
+	defer ui.Fnord.Close()
+
 	if err := ui.app.Run(); err != nil {
 		panic(err)
 	}
@@ -78,6 +128,42 @@ func (ui *UI) SetStatus(status string) {
 	ui.status.SetText(status)
 }
 
+// watchIndexProgress shows the progress of indexing the project in the status
+// bar, so the user knows whether searches of the project are complete. It
+// runs until the program exits.
+func (ui *UI) watchIndexProgress() {
+	ticker := time.NewTicker(indexProgressInterval)
+	defer ticker.Stop()
+
+	var shown storage.IndexProgress
+
+	for range ticker.C {
+		progress := storage.ProjectIndexProgress()
+		if progress == shown {
+			continue
+		}
+
+		shown = progress
+
+		ui.app.QueueUpdateDraw(func() {
+			ui.setIndexStatus(progress)
+		})
+	}
+}
+
+func (ui *UI) setIndexStatus(progress storage.IndexProgress) {
+	if progress.Total == 0 {
+		ui.indexStatus.SetText("")
+		ui.statusBar.ResizeItem(ui.indexStatus, 0, 0)
+		return
+	}
+
+	text := fmt.Sprintf(" Indexing %d/%d files ", progress.Done, progress.Total)
+
+	ui.indexStatus.SetText("[#000000:orange:b]" + text + "[-:-:-]")
+	ui.statusBar.ResizeItem(ui.indexStatus, len(text), 0)
+}
+
 func (ui *UI) CurrentPage() string {
 	page, _ := ui.pages.GetFrontPage()
 	return page
@@ -100,12 +186,174 @@ func (ui *UI) OpenChat() {
 	ui.app.SetFocus(ui.chat.GetInitialFocus())
 }
 
+func (ui *UI) OpenConversations() {
+	ui.convos.Refresh()
+	ui.Open("conversations")
+	ui.app.SetFocus(ui.convos.GetInitialFocus())
+}
+
+func (ui *UI) OpenFacts() {
+	ui.Open("facts")
+	ui.app.SetFocus(ui.facts.GetInitialFocus())
+
+	// Searching uses the embeddings API, so facts are (re)loaded outside of
+	// the UI goroutine.
+	go ui.facts.Refresh()
+}
+
+func (ui *UI) OpenBoxes() {
+	ui.boxes.Refresh()
+	ui.Open("boxes")
+	ui.app.SetFocus(ui.boxes.GetInitialFocus())
+}
+
+// SwitchBox selects another box and starts a new conversation in it. The
+// views showing the box's contents are rebuilt for the new box. SwitchBox is
+// called from the UI goroutine; setting up the assistant for the box calls
+// the API, so that part runs in the background.
+func (ui *UI) SwitchBox(box string) {
+	if ui.chat.IsReceiving() {
+		ui.OpenAlert("Cannot switch boxes while the assistant is responding.", nil)
+		return
+	}
+
+	ui.SetStatus(fmt.Sprintf("[#000000:green:b]Switching to box %s...[-:-:-]", box))
+
+	// Messages sent now would go to the previous box's conversation
+	ui.chat.userInput.SetDisabled(true)
+
+	go ui.switchBox(box)
+}
+
+// switchBox selects the box and rebuilds the views for it once the
+// assistant has been set up.
+func (ui *UI) switchBox(box string) {
+	if err := ui.Fnord.SwitchBox(box); err != nil {
+		ui.app.QueueUpdateDraw(func() {
+			ui.chat.userInput.SetDisabled(false)
+			ui.OpenAlert(fmt.Sprintf("Error: %s", err), nil)
+		})
+
+		return
+	}
+
+	ui.app.QueueUpdateDraw(func() {
+		ui.chat = ui.newChatView()
+		ui.convos = ui.newConversationsView()
+		ui.facts = ui.newFactsView()
+
+		// Adding a page replaces the page of the same name
+		ui.pages.AddPage("chat", ui.chat, true, false)
+		ui.pages.AddPage("conversations", ui.convos, true, false)
+		ui.pages.AddPage("facts", ui.facts, true, false)
+
+		ui.OpenChat()
+	})
+}
+
 func (ui *UI) OpenFilePicker(prompt string, path string, callback func(string)) {
 	ui.Open("filePicker")
 	ui.filePicker.Setup(prompt, path, callback)
 	ui.app.SetFocus(ui.filePicker.GetInitialFocus())
 }
 
+// OpenAlert displays a message in a modal dialog. When the user dismisses it,
+// the previously displayed page is restored and the callback (if any) is
+// called.
+func (ui *UI) OpenAlert(message string, callback func()) {
+	previous := ui.CurrentPage()
+	focus := ui.app.GetFocus()
+
+	ui.pages.AddAndSwitchToPage("alert", ui.alert(message, func() {
+		ui.pages.RemovePage("alert")
+		ui.Open(previous)
+		ui.app.SetFocus(focus)
+
+		if callback != nil {
+			callback()
+		}
+	}), true)
+}
+
+// OpenConfirm asks the user a yes or no question in a modal dialog. When the
+// user answers, the previously displayed page is restored and the callback is
+// called with the answer.
+func (ui *UI) OpenConfirm(message string, callback func(bool)) {
+	previous := ui.CurrentPage()
+	focus := ui.app.GetFocus()
+
+	ui.pages.AddAndSwitchToPage("confirm", ui.confirm(message, func(yes bool) {
+		ui.pages.RemovePage("confirm")
+		ui.Open(previous)
+		ui.app.SetFocus(focus)
+
+		callback(yes)
+	}), true)
+}
+
+// OpenPrompt asks the user for a line of text in a modal dialog. When the
+// user accepts it, the previously displayed page is restored and the callback
+// is called with the text. Nothing is called if the user cancels.
+func (ui *UI) OpenPrompt(title string, label string, callback func(string)) {
+	previous := ui.CurrentPage()
+	focus := ui.app.GetFocus()
+
+	ui.pages.AddAndSwitchToPage("prompt", ui.prompt(title, label, func(text string, ok bool) {
+		ui.pages.RemovePage("prompt")
+		ui.Open(previous)
+		ui.app.SetFocus(focus)
+
+		if ok && text != "" {
+			callback(text)
+		}
+	}), true)
+}
+
+// ApproveToolCall asks the user whether the assistant may call a tool. It is
+// called from the goroutine running the assistant's response, and blocks
+// until the user responds or ctx is cancelled. Only one request is displayed
+// at a time.
+func (ui *UI) ApproveToolCall(ctx context.Context, tool gpt.Tool, argsJSON string) gpt.ToolApproval {
+	ui.approvalMutex.Lock()
+	defer ui.approvalMutex.Unlock()
+
+	// Buffered so that a response after ctx is cancelled does not block
+	result := make(chan gpt.ToolApproval, 1)
+
+	var previous string
+	var focus tview.Primitive
+
+	closeApproval := func() {
+		ui.pages.RemovePage("toolApproval")
+		ui.Open(previous)
+		ui.app.SetFocus(focus)
+	}
+
+	ui.app.QueueUpdateDraw(func() {
+		previous = ui.CurrentPage()
+		focus = ui.app.GetFocus()
+
+		ui.pages.AddAndSwitchToPage("toolApproval", ui.toolApproval(tool.Name(), argsJSON, func(approval gpt.ToolApproval) {
+			closeApproval()
+			result <- approval
+		}), true)
+	})
+
+	select {
+	case approval := <-result:
+		return approval
+
+	case <-ctx.Done():
+		ui.app.QueueUpdateDraw(func() {
+			if ui.pages.HasPage("toolApproval") {
+				closeApproval()
+			}
+		})
+
+		return gpt.ToolApproval{Approved: false, Arguments: argsJSON}
+	}
+}
+
 func (ui *UI) OpenLogs() {
 	ui.Open("logs")
 	ui.app.SetFocus(ui.logs)
@@ -44,9 +44,9 @@ func TestExtractInnerText(t *testing.T) {
 			t.Fatalf("Failed to parse HTML: %v", err)
 		}
 
-		actualText := extractInnerText(doc)
+		actualText := ExtractInnerText(doc)
 		if actualText != tt.expectedText {
-			t.Errorf("extractInnerText(%q) = %q; want %q", tt.htmlInput, actualText, tt.expectedText)
+			t.Errorf("ExtractInnerText(%q) = %q; want %q", tt.htmlInput, actualText, tt.expectedText)
 		}
 	}
 }
@@ -3,6 +3,7 @@ package util
 import (
 	"bufio"
 	"strings"
+	"unicode"
 )
 
 // TrimMessage trims leading and trailing whitespace from a message's content.
@@ -44,3 +45,38 @@ func Chunkify(scanner *bufio.Scanner, chunkSize int) []string {
 
 	return parts
 }
+
+// FuzzyMatch reports whether each character of pattern appears in text, in
+// order, ignoring case. Matches are scored so that they may be ranked: runs
+// of consecutive characters, and characters at the start of a word, score
+// higher. An empty pattern matches everything with a score of 0.
+func FuzzyMatch(pattern string, text string) (bool, int) {
+	patternRunes := []rune(strings.ToLower(pattern))
+	textRunes := []rune(strings.ToLower(text))
+
+	score := 0
+	consecutive := 0
+	p := 0
+
+	for t := 0; t < len(textRunes) && p < len(patternRunes); t++ {
+		if textRunes[t] != patternRunes[p] {
+			consecutive = 0
+			continue
+		}
+
+		consecutive++
+		score += consecutive
+
+		if t == 0 || !unicode.IsLetter(textRunes[t-1]) && !unicode.IsNumber(textRunes[t-1]) {
+			score += 2
+		}
+
+		p++
+	}
+
+	if p < len(patternRunes) {
+		return false, 0
+	}
+
+	return true, score
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		text    string
+		matches bool
+	}{
+		{"", "Anything", true},
+		{"dbmig", "Database migrations", true},
+		{"DBMIG", "database migrations", true},
+		{"migdb", "Database migrations", false},
+		{"xyz", "Database migrations", false},
+	}
+
+	for _, tt := range tests {
+		matches, _ := FuzzyMatch(tt.pattern, tt.text)
+		if matches != tt.matches {
+			t.Errorf("FuzzyMatch(%q, %q) = %v; want %v", tt.pattern, tt.text, matches, tt.matches)
+		}
+	}
+
+	// Consecutive matches and matches at the start of words rank higher
+	_, contiguous := FuzzyMatch("mig", "Database migrations")
+	_, scattered := FuzzyMatch("mig", "Make it go")
+	_, inWord := FuzzyMatch("mig", "Admiring")
+
+	if contiguous <= inWord || scattered <= inWord {
+		t.Errorf("unexpected ranking: contiguous=%d scattered=%d inWord=%d", contiguous, scattered, inWord)
+	}
+}